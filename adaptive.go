@@ -0,0 +1,204 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimits bounds the AIMD controller adjusting the number of
+// in-flight requests per host.
+type AdaptiveLimits struct {
+	// In-flight requests allowed per host
+	Min int
+	Max int
+	// Decrease when the smoothed latency grows beyond this multiple of the
+	// fastest latency observed on the host
+	LatencyTolerance float64
+	// Factor the limit is multiplied by when backing off
+	Backoff float64
+	// Throttled and timed out requests are retried until they've been tried
+	// this many times
+	MaxAttempts int
+	// Time a throttled or timed out request waits before it's retried,
+	// doubling on every further attempt
+	RetryDelay time.Duration
+}
+
+func DefaultAdaptiveLimits() AdaptiveLimits {
+	return AdaptiveLimits{
+		Min:              1,
+		Max:              20,
+		LatencyTolerance: 3,
+		Backoff:          0.5,
+		MaxAttempts:      3,
+		RetryDelay:       time.Second,
+	}
+}
+
+// outcome classifies a fetch for the controller.
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	// 429 and 503 responses and timeouts
+	outcomeCongested
+	// Errors which say nothing about the host's load, e.g. 404s
+	outcomeFailure
+)
+
+func classify(err error) outcome {
+	if err == nil {
+		return outcomeSuccess
+	}
+
+	if errors.Is(err, ErrTooManyRequests) {
+		return outcomeCongested
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		if httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode == http.StatusServiceUnavailable {
+			return outcomeCongested
+		}
+
+		return outcomeFailure
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return outcomeCongested
+	}
+
+	return outcomeFailure
+}
+
+// adaptiveLimiter is an AIMD controller per host: the limit grows
+// additively while a host copes and is cut multiplicatively on congestion
+// signals. Until the first congestion signal the limit grows by one on every
+// success, doubling roughly every round trip, so it reaches a good limit quickly.
+type adaptiveLimiter struct {
+	limits AdaptiveLimits
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+type hostLimit struct {
+	limit    float64
+	inFlight int
+
+	slowStart bool
+	// Completions since the last decrease, so concurrent requests failing
+	// together only cut the limit once
+	sinceDecrease int
+
+	fastest time.Duration
+	latency float64
+}
+
+func newAdaptiveLimiter(limits AdaptiveLimits) *adaptiveLimiter {
+	if limits.Min < 1 {
+		limits.Min = 1
+	}
+	if limits.Max < limits.Min {
+		limits.Max = limits.Min
+	}
+	if limits.Backoff <= 0 || limits.Backoff >= 1 {
+		limits.Backoff = 0.5
+	}
+
+	return &adaptiveLimiter{limits: limits, hosts: make(map[string]*hostLimit)}
+}
+
+// acquire takes a slot of the host when it has room for another request. It
+// doesn't wait, so a busy host doesn't hold up the requests of the others.
+func (l *adaptiveLimiter) acquire(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(host)
+	if h.inFlight >= int(h.limit) {
+		return false
+	}
+
+	h.inFlight++
+
+	return true
+}
+
+func (l *adaptiveLimiter) release(host string, latency time.Duration, o outcome) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(host)
+	h.inFlight--
+	h.sinceDecrease++
+
+	switch o {
+	case outcomeCongested:
+		l.decrease(h)
+	case outcomeSuccess:
+		if h.fastest == 0 || latency < h.fastest {
+			h.fastest = latency
+		}
+
+		if h.latency == 0 {
+			h.latency = float64(latency)
+		} else {
+			h.latency = 0.8*h.latency + 0.2*float64(latency)
+		}
+
+		if l.limits.LatencyTolerance > 0 && h.latency > l.limits.LatencyTolerance*float64(h.fastest) {
+			l.decrease(h)
+		} else if h.slowStart {
+			h.limit++
+		} else {
+			h.limit += 1 / h.limit
+		}
+	}
+
+	h.limit = math.Max(float64(l.limits.Min), math.Min(float64(l.limits.Max), h.limit))
+}
+
+func (l *adaptiveLimiter) decrease(h *hostLimit) {
+	h.slowStart = false
+	if h.sinceDecrease < int(h.limit) {
+		return
+	}
+
+	h.limit *= l.limits.Backoff
+	h.sinceDecrease = 0
+}
+
+// limit returns the current in-flight limit of the host.
+func (l *adaptiveLimiter) limit(host string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.host(host).limit)
+}
+
+// retryDelay returns how long a request which has failed attempts times
+// waits before it's tried again.
+func (l *adaptiveLimiter) retryDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+
+	return l.limits.RetryDelay << uint(attempts-1)
+}
+
+func (l *adaptiveLimiter) host(host string) *hostLimit {
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimit{limit: float64(l.limits.Min), slowStart: true}
+		l.hosts[host] = h
+	}
+
+	return h
+}
@@ -0,0 +1,171 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	stdmock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, outcomeSuccess, classify(nil))
+	assert.Equal(t, outcomeCongested, classify(&CrawlError{Err: ErrTooManyRequests}))
+	assert.Equal(t, outcomeCongested, classify(&CrawlError{Err: &HTTPError{StatusCode: http.StatusServiceUnavailable}}))
+	assert.Equal(t, outcomeCongested, classify(&url.Error{Op: "Get", URL: "https://monzo.com", Err: timeoutError{}}))
+	assert.Equal(t, outcomeFailure, classify(&CrawlError{Err: &HTTPError{StatusCode: http.StatusNotFound}}))
+	assert.Equal(t, outcomeFailure, classify(errors.New("connection refused")))
+}
+
+func TestAdaptiveLimiterGrowsAndBacksOff(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveLimits{Min: 1, Max: 8, LatencyTolerance: 3, Backoff: 0.5})
+	host := "monzo.com"
+
+	assert.Equal(t, 1, l.limit(host))
+
+	// Slow start adds one per success
+	for i := 0; i < 5; i++ {
+		require.True(t, l.acquire(host))
+		l.release(host, 10*time.Millisecond, outcomeSuccess)
+	}
+	assert.Equal(t, 6, l.limit(host))
+
+	require.True(t, l.acquire(host))
+	l.release(host, 10*time.Millisecond, outcomeCongested)
+	assert.Equal(t, 3, l.limit(host))
+
+	// A burst of failures within the same window only backs off once
+	require.True(t, l.acquire(host))
+	l.release(host, 10*time.Millisecond, outcomeCongested)
+	assert.Equal(t, 3, l.limit(host))
+
+	// Additive increase after the first congestion signal
+	for i := 0; i < 3; i++ {
+		require.True(t, l.acquire(host))
+		l.release(host, 10*time.Millisecond, outcomeSuccess)
+	}
+	assert.Equal(t, 3, l.limit(host))
+	for i := 0; i < 3; i++ {
+		require.True(t, l.acquire(host))
+		l.release(host, 10*time.Millisecond, outcomeSuccess)
+	}
+	assert.Equal(t, 4, l.limit(host))
+
+	// Hosts are controlled independently
+	assert.Equal(t, 1, l.limit("google.com"))
+}
+
+func TestAdaptiveLimiterBacksOffOnLatency(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveLimits{Min: 1, Max: 8, LatencyTolerance: 2, Backoff: 0.5})
+	host := "monzo.com"
+
+	for i := 0; i < 7; i++ {
+		require.True(t, l.acquire(host))
+		l.release(host, 10*time.Millisecond, outcomeSuccess)
+	}
+	assert.Equal(t, 8, l.limit(host))
+
+	for i := 0; i < 10; i++ {
+		require.True(t, l.acquire(host))
+		l.release(host, time.Second, outcomeSuccess)
+	}
+	assert.True(t, l.limit(host) < 8)
+}
+
+func TestAdaptiveLimiterRefusesBusyHosts(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveLimits{Min: 1, Max: 1})
+
+	require.True(t, l.acquire("monzo.com"))
+	assert.False(t, l.acquire("monzo.com"))
+	assert.True(t, l.acquire("google.com"))
+
+	l.release("monzo.com", 10*time.Millisecond, outcomeSuccess)
+	assert.True(t, l.acquire("monzo.com"))
+}
+
+func TestRetryDelayDoubles(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveLimits{RetryDelay: time.Second})
+
+	assert.Equal(t, time.Second, l.retryDelay(1))
+	assert.Equal(t, 2*time.Second, l.retryDelay(2))
+	assert.Equal(t, 4*time.Second, l.retryDelay(3))
+}
+
+func TestThrottledURLsAreRetried(t *testing.T) {
+	limits := DefaultAdaptiveLimits()
+	limits.RetryDelay = 20 * time.Millisecond
+	s := setup(2, 100, 100, Adaptive(limits))
+
+	root, _ := url.Parse("https://monzo.com")
+	about, _ := url.Parse("https://monzo.com/about")
+	busy, _ := url.Parse("https://monzo.com/busy")
+
+	s.f.On("Fetch", root.String()).Return([]byte("body"), nil)
+	s.f.On("Fetch", about.String()).Once().Return([]byte{}, &HTTPError{StatusCode: http.StatusTooManyRequests})
+	s.f.On("Fetch", about.String()).Once().Return([]byte("body"), nil)
+	s.f.On("Fetch", busy.String()).Times(3).Return([]byte{}, &HTTPError{StatusCode: http.StatusServiceUnavailable})
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{about, busy}, []*url.URL{}, nil)
+	s.p.On("Parse", about, []byte("body")).Return([]*url.URL{}, []*url.URL{}, nil)
+
+	s.c.Enqueue(root)
+
+	start := time.Now()
+	p, e := run(s.c, root, context.Background())
+
+	// The busy url waited 20ms before its second attempt and 40ms before its third
+	assert.True(t, time.Since(start) >= 60*time.Millisecond)
+	assert.Len(t, p, 2)
+	require.Len(t, e, 1)
+
+	var crawlErr *CrawlError
+	require.True(t, errors.As(e[0], &crawlErr))
+	assert.Equal(t, busy, crawlErr.URL)
+	assert.Equal(t, 3, crawlErr.Attempt)
+
+	s.AssertExpectations(t)
+}
+
+func TestBusyHostsDontHoldUpOthers(t *testing.T) {
+	s := setup(2, 100, 100, Adaptive(AdaptiveLimits{Min: 1, Max: 1}))
+
+	monzo, _ := url.Parse("https://monzo.com")
+	monzoAbout, _ := url.Parse("https://monzo.com/about")
+	google, _ := url.Parse("https://google.com")
+
+	// Monzo's only slot is taken until google has been crawled, which would
+	// never happen if the worker popping monzo's second url waited for it
+	googleCrawled := make(chan struct{})
+	s.f.On("Fetch", monzo.String()).Run(func(stdmock.Arguments) {
+		select {
+		case <-googleCrawled:
+		case <-time.After(time.Second):
+		}
+	}).Return([]byte("body"), nil)
+	s.f.On("Fetch", monzoAbout.String()).Return([]byte("body"), nil)
+	s.f.On("Fetch", google.String()).Run(func(stdmock.Arguments) {
+		close(googleCrawled)
+	}).Return([]byte("body"), nil)
+	s.p.On("Parse", stdmock.Anything, []byte("body")).Return([]*url.URL{}, []*url.URL{}, nil)
+
+	s.c.Enqueue(monzo)
+	s.c.Enqueue(monzoAbout)
+	s.c.Enqueue(google)
+
+	start := time.Now()
+	p, e := run(s.c, monzo, context.Background())
+
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Len(t, p, 3)
+	assert.Empty(t, e)
+}
@@ -0,0 +1,368 @@
+package crawler
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachePolicy decides how long responses are served from the cache without
+// revalidating them with the server.
+type CachePolicy struct {
+	// Ignore Cache-Control and Expires, storing every response and treating it as fresh for MaxAge
+	IgnoreHeaders bool
+	// Only used with IgnoreHeaders, zero revalidates every response
+	MaxAge time.Duration
+}
+
+// CacheStats counts how fetches were served by the cache.
+type CacheStats struct {
+	// Served from the cache without a request
+	Hits int
+	// Served from the cache after the server answered 304 Not Modified
+	Revalidated int
+	// Downloaded, including stale entries which had changed
+	Misses int
+}
+
+// HTTPCache stores response bodies on disk along with their validators so
+// that recrawls only download pages which changed. Attach it to the fetcher
+// with Cache.
+//
+// Responses are fresh for their Cache-Control max-age, or until their
+// Expires date. Responses without either are revalidated on every fetch with
+// If-None-Match and If-Modified-Since. Responses with no-store or Vary: *
+// aren't cached, and responses with Vary are only used for requests with the
+// same values of the headers it names.
+type HTTPCache struct {
+	dir    string
+	policy CachePolicy
+
+	mu    sync.Mutex
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	Stored       time.Time `json:"stored"`
+	// Zero when the entry always needs to be revalidated
+	FreshFor time.Duration `json:"fresh_for"`
+	// Values of the request headers named by the response's Vary header
+	Vary map[string]string `json:"vary,omitempty"`
+
+	body []byte
+}
+
+// OpenHTTPCache opens the cache in dir, creating it if needed.
+func OpenHTTPCache(dir string, policy CachePolicy) (*HTTPCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &HTTPCache{dir: dir, policy: policy}, nil
+}
+
+// Cache serves fetches from the cache when possible and stores successful responses in it.
+// Fresh responses are observed by InstrumentFetcher like any other fetch,
+// but they aren't archived as they never reach the server.
+func Cache(c *HTTPCache) FetcherOption {
+	return func(f *fetcher) {
+		f.cache = c
+	}
+}
+
+func (c *HTTPCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+func (c *HTTPCache) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	k := hex.EncodeToString(sum[:])
+
+	return filepath.Join(c.dir, k[:2], k)
+}
+
+// get returns nil when the url isn't cached or the entry can't be read.
+func (c *HTTPCache) get(url string) *cacheEntry {
+	f, err := os.Open(c.path(url))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil
+	}
+
+	e := &cacheEntry{}
+	if err := json.Unmarshal(header, e); err != nil || e.URL != url {
+		return nil
+	}
+
+	if e.body, err = ioutil.ReadAll(r); err != nil {
+		return nil
+	}
+
+	return e
+}
+
+func (c *HTTPCache) fresh(e *cacheEntry) bool {
+	return time.Since(e.Stored) < e.FreshFor
+}
+
+// conditional adds the validators of the entry to the request.
+func (e *cacheEntry) conditional(req *http.Request) {
+	if e.ETag != "" {
+		req.Header.Set("If-None-Match", e.ETag)
+	}
+
+	if e.LastModified != "" {
+		req.Header.Set("If-Modified-Since", e.LastModified)
+	}
+}
+
+// matches tells whether the entry can be used for the request, which needs
+// the same values of the headers the response varied on.
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for name, v := range e.Vary {
+		if strings.Join(req.Header[name], ", ") != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// varyValues returns the values of the request headers named by the
+// response's Vary header, false when the response varies on something other
+// than request headers and can't be cached.
+func varyValues(rsp *http.Response) (map[string]string, bool) {
+	var header http.Header
+	if rsp.Request != nil {
+		header = rsp.Request.Header
+	}
+
+	var vary map[string]string
+	for _, v := range rsp.Header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+
+			if name == "*" {
+				return nil, false
+			}
+
+			if vary == nil {
+				vary = make(map[string]string)
+			}
+			vary[name] = strings.Join(header[name], ", ")
+		}
+	}
+
+	return vary, true
+}
+
+// response stands in for the stored response when it's served without a request.
+func (e *cacheEntry) response() *http.Response {
+	rsp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+
+	if e.ContentType != "" {
+		rsp.Header.Set("Content-Type", e.ContentType)
+	}
+
+	return rsp
+}
+
+// put stores a 200 response.
+func (c *HTTPCache) put(url string, rsp *http.Response, body []byte) error {
+	freshFor, store := c.freshness(rsp)
+	vary, ok := varyValues(rsp)
+	if !store || !ok {
+		return c.remove(url)
+	}
+
+	e := &cacheEntry{
+		URL:          url,
+		ETag:         rsp.Header.Get("ETag"),
+		LastModified: rsp.Header.Get("Last-Modified"),
+		ContentType:  rsp.Header.Get("Content-Type"),
+		Stored:       time.Now(),
+		FreshFor:     freshFor,
+		Vary:         vary,
+		body:         body,
+	}
+
+	return c.write(e)
+}
+
+func (c *HTTPCache) write(e *cacheEntry) error {
+	header, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	p := c.path(e.URL)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// Readers never see a partially written entry, and every write has a
+	// file of its own as the same url can be fetched concurrently
+	tmp, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(append(append(header, '\n'), e.body...)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// TempFile creates the file readable by the owner only
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+// revalidated refreshes an entry the server confirmed is still current. The
+// validators and freshness of the 304 take precedence over the stored ones.
+func (c *HTTPCache) revalidated(e *cacheEntry, rsp *http.Response) error {
+	c.mu.Lock()
+	c.stats.Revalidated++
+	c.mu.Unlock()
+
+	freshFor, store := c.freshness(rsp)
+	if !store {
+		return c.remove(e.URL)
+	}
+
+	if etag := rsp.Header.Get("ETag"); etag != "" {
+		e.ETag = etag
+	}
+	if lm := rsp.Header.Get("Last-Modified"); lm != "" {
+		e.LastModified = lm
+	}
+	e.Stored, e.FreshFor = time.Now(), freshFor
+
+	return c.write(e)
+}
+
+func (c *HTTPCache) remove(url string) error {
+	if err := os.Remove(c.path(url)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *HTTPCache) hit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Hits++
+}
+
+func (c *HTTPCache) miss() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Misses++
+}
+
+// freshness returns how long the response can be served without revalidation
+// and whether it can be stored at all.
+func (c *HTTPCache) freshness(rsp *http.Response) (time.Duration, bool) {
+	if c.policy.IgnoreHeaders {
+		return c.policy.MaxAge, true
+	}
+
+	directives := parseCacheControl(rsp.Header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return 0, false
+	}
+
+	if _, ok := directives["no-cache"]; ok {
+		return 0, true
+	}
+
+	if v, ok := directives["max-age"]; ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return 0, true
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if expires := rsp.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, true
+		}
+
+		date := time.Now()
+		if d, err := http.ParseTime(rsp.Header.Get("Date")); err == nil {
+			date = d
+		}
+
+		if t.After(date) {
+			return t.Sub(date), true
+		}
+	}
+
+	return 0, true
+}
+
+func parseCacheControl(v string) map[string]string {
+	directives := make(map[string]string)
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+
+		name, value := d, ""
+		if i := strings.Index(d, "="); i >= 0 {
+			name, value = d[:i], strings.Trim(d[i+1:], `"`)
+		}
+
+		directives[strings.ToLower(name)] = value
+	}
+
+	return directives
+}
@@ -0,0 +1,254 @@
+package crawler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheRevalidatesWithValidators(t *testing.T) {
+	body := "v1"
+	var conditional []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match")+"|"+r.Header.Get("If-Modified-Since"))
+
+		etag := `"` + body + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := OpenHTTPCache(dir, CachePolicy{})
+	require.NoError(t, err)
+	f := NewFetcher(srv.Client(), Cache(c))
+
+	for _, expected := range []string{"v1", "v1"} {
+		b, err := f.Fetch(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(b))
+	}
+
+	body = "v2"
+	b, err := f.Fetch(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(b))
+
+	assert.Equal(t, []string{
+		"|",
+		`"v1"|Mon, 02 Jan 2006 15:04:05 GMT`,
+		`"v1"|Mon, 02 Jan 2006 15:04:05 GMT`,
+	}, conditional)
+	assert.Equal(t, CacheStats{Revalidated: 1, Misses: 2}, c.Stats())
+}
+
+func TestCacheHitsAreObservedButNotArchived(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := OpenHTTPCache(filepath.Join(dir, "cache"), CachePolicy{})
+	require.NoError(t, err)
+	w, err := NewWARCWriter(filepath.Join(dir, "warc"), "crawl", 0)
+	require.NoError(t, err)
+	m := NewMetrics()
+	f := NewFetcher(srv.Client(), Cache(c), Archive(w), InstrumentFetcher(m))
+
+	for i := 0; i < 2; i++ {
+		_, err := f.Fetch(srv.URL)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, c.Stats())
+
+	b := &bytes.Buffer{}
+	m.WriteTo(b)
+	assert.Contains(t, b.String(), `crawler_requests_total{host="`+hostOf(srv.URL)+`",code="200"} 2`)
+
+	files, err := filepath.Glob(filepath.Join(dir, "warc", "*.warc.gz"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	// The warcinfo record and the exchange of the miss
+	assert.Len(t, readWARC(t, files[0]), 3)
+}
+
+func TestCacheHonoursCacheControl(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		case "/private":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := OpenHTTPCache(dir, CachePolicy{})
+	require.NoError(t, err)
+	f := NewFetcher(srv.Client(), Cache(c))
+
+	for i := 0; i < 2; i++ {
+		b, err := f.Fetch(srv.URL + "/fresh")
+		require.NoError(t, err)
+		assert.Equal(t, "/fresh", string(b))
+
+		_, err = f.Fetch(srv.URL + "/private")
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 3}, c.Stats())
+
+	// The override caches everything
+	c, err = OpenHTTPCache(dir, CachePolicy{IgnoreHeaders: true, MaxAge: time.Hour})
+	require.NoError(t, err)
+	f = NewFetcher(srv.Client(), Cache(c))
+
+	for i := 0; i < 2; i++ {
+		_, err = f.Fetch(srv.URL + "/private")
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 4, requests)
+}
+
+func TestCacheKeepsTheContentType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte("%PDF"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := OpenHTTPCache(dir, CachePolicy{})
+	require.NoError(t, err)
+	f := NewFetcher(srv.Client(), Cache(c))
+
+	for i := 0; i < 2; i++ {
+		_, contentType, err := fetchContentType(f, srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "application/pdf", contentType)
+	}
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, c.Stats())
+}
+
+func TestCacheHonoursVary(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		switch r.URL.Path {
+		case "/language":
+			w.Header().Set("Vary", "accept-language")
+		case "/anything":
+			w.Header().Set("Vary", "Accept-Encoding, *")
+		}
+
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := OpenHTTPCache(dir, CachePolicy{})
+	require.NoError(t, err)
+	f := NewFetcher(srv.Client(), Cache(c))
+
+	for i := 0; i < 2; i++ {
+		for _, path := range []string{"/language", "/anything"} {
+			_, err := f.Fetch(srv.URL + path)
+			require.NoError(t, err)
+		}
+	}
+
+	// Requests for the same language are served from the cache
+	assert.Equal(t, 3, requests)
+	assert.Nil(t, c.get(srv.URL+"/anything"))
+
+	e := c.get(srv.URL + "/language")
+	require.NotNil(t, e)
+	assert.Equal(t, map[string]string{"Accept-Language": ""}, e.Vary)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/language", nil)
+	require.NoError(t, err)
+	assert.True(t, e.matches(req))
+	req.Header.Set("Accept-Language", "fr")
+	assert.False(t, e.matches(req))
+}
+
+func TestCacheWritesOfTheSameUrlDontCollide(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := OpenHTTPCache(dir, CachePolicy{IgnoreHeaders: true, MaxAge: time.Hour})
+	require.NoError(t, err)
+
+	bodies := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		body := strings.Repeat(strconv.Itoa(i), 10000)
+		bodies[body] = true
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, c.put("https://monzo.com/", &http.Response{Header: http.Header{}}, []byte(body)))
+		}()
+	}
+	wg.Wait()
+
+	e := c.get("https://monzo.com/")
+	require.NotNil(t, e)
+	assert.True(t, bodies[string(e.body)])
+
+	// Only the entry is left behind
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestParseCacheControl(t *testing.T) {
+	assert.Equal(t, map[string]string{"public": "", "max-age": "60", "no-cache": "set-cookie"},
+		parseCacheControl(`Public, max-age=60, no-cache="set-cookie",`))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+// checkCommand reports the links which couldn't be fetched.
+func checkCommand(s *settings) func() int {
+	o := &crawlOptions{}
+	o.register(s)
+
+	return func() int {
+		seeds, ok := o.seeds(s, s.fs.Args())
+		if !ok {
+			return 1
+		}
+
+		return o.crawl(seeds, newLinkChecker(os.Stdout))
+	}
+}
+
+type brokenLink struct {
+	url string
+	err error
+}
+
+// linkChecker collects the fetches which failed and the pages linking to
+// them. Links are keyed by their canonical url since the same page can be
+// linked in several ways.
+type linkChecker struct {
+	w io.Writer
+
+	mu        sync.Mutex
+	referrers map[string]map[string]bool
+	broken    map[string]*brokenLink
+}
+
+func newLinkChecker(w io.Writer) *linkChecker {
+	return &linkChecker{
+		w:         w,
+		referrers: make(map[string]map[string]bool),
+		broken:    make(map[string]*brokenLink),
+	}
+}
+
+func (c *linkChecker) Page(page *crawler.Page, p *pageResult) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, l := range page.Links {
+		c.linkedFrom(l, p.URL)
+	}
+
+	return nil
+}
+
+func (c *linkChecker) Error(err error) error {
+	var crawlErr *crawler.CrawlError
+	if !stderrors.As(err, &crawlErr) || crawlErr.Phase != crawler.PhaseFetch || crawlErr.URL == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.broken[crawler.CanonicalURL(crawlErr.URL)] = &brokenLink{url: crawlErr.URL.String(), err: crawlErr.Err}
+	if crawlErr.Referrer != nil {
+		c.linkedFrom(crawlErr.URL, crawlErr.Referrer.String())
+	}
+
+	return nil
+}
+
+func (c *linkChecker) linkedFrom(link *url.URL, page string) {
+	k := crawler.CanonicalURL(link)
+	if c.referrers[k] == nil {
+		c.referrers[k] = make(map[string]bool)
+	}
+	c.referrers[k][page] = true
+}
+
+func (c *linkChecker) Done() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.broken) == 0 {
+		fmt.Fprintln(os.Stderr, "No broken links")
+		return 0
+	}
+
+	keys := make([]string, 0, len(c.broken))
+	for k := range c.broken {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(c.w, "%d broken links\n", len(keys))
+	for _, k := range keys {
+		b := c.broken[k]
+		fmt.Fprintf(c.w, "\n%s: %v\n", b.url, b.err)
+
+		referrers := make([]string, 0, len(c.referrers[k]))
+		for r := range c.referrers[k] {
+			referrers = append(referrers, r)
+		}
+		sort.Strings(referrers)
+
+		for _, r := range referrers {
+			fmt.Fprintf(c.w, "  linked from %s\n", r)
+		}
+	}
+
+	return 1
+}
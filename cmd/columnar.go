@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// The columnar format is a much simplified Parquet: results are stored
+// column by column in row groups, so that urls, which share long prefixes,
+// compress well. A file is laid out as
+//
+//	magic row-group* footer footer-length magic
+//
+// where the footer-length is a little-endian uint32. Each column of a row
+// group is a gzip member. Strings are front coded against the previous string
+// of the column as the uvarint length of the shared prefix followed by the
+// uvarint length of the rest and the rest, numbers are uvarints and lists are
+// their uvarint length followed by their items. The footer is JSON listing the
+// columns and where each row group's columns are.
+const columnarMagic = "CRWLCOL1"
+
+// Rows buffered before they're written out as a row group
+const columnarRowGroupSize = 10000
+
+type columnarFooter struct {
+	Columns   []columnarColumn   `json:"columns"`
+	RowGroups []columnarRowGroup `json:"row_groups"`
+}
+
+type columnarColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type columnarRowGroup struct {
+	Rows   int           `json:"rows"`
+	Chunks []columnChunk `json:"chunks"`
+}
+
+type columnChunk struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+var resultColumns = []columnarColumn{
+	{"url", "string"},
+	{"status", "uint"},
+	{"duplicate_of", "string"},
+	{"links", "list<string>"},
+	{"assets", "list<string>"},
+}
+
+type columnarWriter struct {
+	w       io.Writer
+	offset  int64
+	started bool
+
+	rows    int
+	columns []*columnEncoder
+	footer  columnarFooter
+}
+
+func newColumnarWriter(w io.Writer) resultWriter {
+	c := &columnarWriter{
+		w:       w,
+		columns: make([]*columnEncoder, len(resultColumns)),
+		footer:  columnarFooter{Columns: resultColumns, RowGroups: []columnarRowGroup{}},
+	}
+
+	for i := range c.columns {
+		c.columns[i] = &columnEncoder{}
+	}
+
+	return c
+}
+
+func (c *columnarWriter) Write(p *pageResult) error {
+	c.columns[0].string(p.URL)
+	c.columns[1].uvarint(uint64(p.Status))
+	c.columns[2].string(p.DuplicateOf)
+	c.columns[3].list(p.Links)
+	c.columns[4].list(p.Assets)
+
+	c.rows++
+	if c.rows == columnarRowGroupSize {
+		return c.flush()
+	}
+
+	return nil
+}
+
+func (c *columnarWriter) write(b []byte) error {
+	n, err := c.w.Write(b)
+	c.offset += int64(n)
+
+	return err
+}
+
+func (c *columnarWriter) start() error {
+	if c.started {
+		return nil
+	}
+	c.started = true
+
+	return c.write([]byte(columnarMagic))
+}
+
+// flush writes the buffered rows as a row group.
+func (c *columnarWriter) flush() error {
+	if err := c.start(); err != nil {
+		return err
+	}
+
+	g := columnarRowGroup{Rows: c.rows}
+	for _, col := range c.columns {
+		var b bytes.Buffer
+		z := gzip.NewWriter(&b)
+		if _, err := z.Write(col.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := z.Close(); err != nil {
+			return err
+		}
+
+		g.Chunks = append(g.Chunks, columnChunk{Offset: c.offset, Length: int64(b.Len())})
+		if err := c.write(b.Bytes()); err != nil {
+			return err
+		}
+
+		// Row groups can be decoded on their own
+		col.reset()
+	}
+
+	c.footer.RowGroups = append(c.footer.RowGroups, g)
+	c.rows = 0
+
+	return nil
+}
+
+func (c *columnarWriter) Close() error {
+	if c.rows > 0 {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.start(); err != nil {
+		return err
+	}
+
+	footer, err := json.Marshal(c.footer)
+	if err != nil {
+		return err
+	}
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+
+	for _, b := range [][]byte{footer, length[:], []byte(columnarMagic)} {
+		if err := c.write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type columnEncoder struct {
+	buf  bytes.Buffer
+	prev string
+	tmp  [binary.MaxVarintLen64]byte
+}
+
+func (e *columnEncoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.tmp[:], v)
+	e.buf.Write(e.tmp[:n])
+}
+
+func (e *columnEncoder) string(s string) {
+	shared := 0
+	for shared < len(s) && shared < len(e.prev) && s[shared] == e.prev[shared] {
+		shared++
+	}
+
+	e.uvarint(uint64(shared))
+	e.uvarint(uint64(len(s) - shared))
+	e.buf.WriteString(s[shared:])
+	e.prev = s
+}
+
+func (e *columnEncoder) list(items []string) {
+	e.uvarint(uint64(len(items)))
+	for _, s := range items {
+		e.string(s)
+	}
+}
+
+func (e *columnEncoder) reset() {
+	e.buf.Reset()
+	e.prev = ""
+}
+
+var errCorruptColumnar = errors.New("Corrupt columnar file")
+
+// isColumnar reports whether the file starts like a columnar file.
+func isColumnar(r io.ReaderAt) bool {
+	magic := make([]byte, len(columnarMagic))
+	_, err := r.ReadAt(magic, 0)
+
+	return err == nil && string(magic) == columnarMagic
+}
+
+// readColumnar calls fn with every result in a columnar file of the given size.
+func readColumnar(r io.ReaderAt, size int64, fn func(p *pageResult) error) error {
+	tail := int64(4 + len(columnarMagic))
+	if size < int64(len(columnarMagic))+tail {
+		return errCorruptColumnar
+	}
+
+	end := make([]byte, tail)
+	if _, err := r.ReadAt(end, size-tail); err != nil {
+		return err
+	}
+	if string(end[4:]) != columnarMagic {
+		return errCorruptColumnar
+	}
+
+	length := int64(binary.LittleEndian.Uint32(end[:4]))
+	if length > size-tail-int64(len(columnarMagic)) {
+		return errCorruptColumnar
+	}
+
+	b := make([]byte, length)
+	if _, err := r.ReadAt(b, size-tail-length); err != nil {
+		return err
+	}
+
+	var footer columnarFooter
+	if err := json.Unmarshal(b, &footer); err != nil {
+		return fmt.Errorf("%v: %v", errCorruptColumnar, err)
+	}
+
+	if len(footer.Columns) != len(resultColumns) {
+		return fmt.Errorf("%v: expected %d columns, got %d", errCorruptColumnar, len(resultColumns), len(footer.Columns))
+	}
+	for i, c := range footer.Columns {
+		if c != resultColumns[i] {
+			return fmt.Errorf("%v: unexpected column %s %s", errCorruptColumnar, c.Name, c.Type)
+		}
+	}
+
+	for _, g := range footer.RowGroups {
+		if len(g.Chunks) != len(resultColumns) {
+			return errCorruptColumnar
+		}
+
+		columns := make([]*columnDecoder, len(g.Chunks))
+		for i, chunk := range g.Chunks {
+			d, err := readChunk(r, chunk)
+			if err != nil {
+				return err
+			}
+			columns[i] = d
+		}
+
+		for i := 0; i < g.Rows; i++ {
+			p := &pageResult{
+				URL:         columns[0].string(),
+				Status:      int(columns[1].uvarint()),
+				DuplicateOf: columns[2].string(),
+				Links:       columns[3].list(),
+				Assets:      columns[4].list(),
+			}
+
+			for _, c := range columns {
+				if c.err != nil {
+					return c.err
+				}
+			}
+
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func readChunk(r io.ReaderAt, c columnChunk) (*columnDecoder, error) {
+	if c.Offset < 0 || c.Length < 0 {
+		return nil, errCorruptColumnar
+	}
+
+	z, err := gzip.NewReader(io.NewSectionReader(r, c.Offset, c.Length))
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		return nil, err
+	}
+
+	return &columnDecoder{b: b}, nil
+}
+
+// columnDecoder reads a column written by columnEncoder, keeping the first
+// error so that a row can be decoded before checking it.
+type columnDecoder struct {
+	b    []byte
+	prev string
+	err  error
+}
+
+func (d *columnDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errCorruptColumnar
+		return 0
+	}
+	d.b = d.b[n:]
+
+	return v
+}
+
+func (d *columnDecoder) string() string {
+	shared, rest := d.uvarint(), d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+
+	if shared > uint64(len(d.prev)) || rest > uint64(len(d.b)) {
+		d.err = errCorruptColumnar
+		return ""
+	}
+
+	s := d.prev[:shared] + string(d.b[:rest])
+	d.b = d.b[rest:]
+	d.prev = s
+
+	return s
+}
+
+func (d *columnDecoder) list() []string {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+
+	// Every item takes at least two bytes
+	if n > uint64(len(d.b))/2 {
+		d.err = errCorruptColumnar
+		return nil
+	}
+
+	items := make([]string, n)
+	for i := range items {
+		items[i] = d.string()
+	}
+
+	return items
+}
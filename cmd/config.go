@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	crawler "github.com/dovys/monzo-crawler"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the crawler's tuning knobs. Every field is a flag named after
+// its setting tag with dashes, e.g. -http-timeout, and can be set with the
+// upper-cased tag as an environment variable, e.g. HTTP_TIMEOUT. Defaults
+// are set by the default tags, or by defaultConfig for the knobs the crawler
+// package has defaults for.
+type Config struct {
+	HTTPTimeout        time.Duration `setting:"http_timeout" default:"10s" desc:"Timeout of a single fetch"`
+	Concurrency        int           `setting:"concurrency" default:"5" desc:"Number of pages fetched at the same time"`
+	ResultBufferLength int           `setting:"result_buffer" default:"100" desc:"Number of results buffered before the crawl waits for them to be written"`
+	MaxQueueLength     int           `setting:"queue_length" default:"0" desc:"Maximum number of queued urls, 0 for no limit"`
+	HotQueueLength     int           `setting:"hot_queue_length" default:"10000" desc:"Number of queued urls kept in memory before spilling to disk with -frontier bfs"`
+	SpillDir           string        `setting:"spill_dir" desc:"Directory the bfs frontier spills to, defaults to the system's temporary directory"`
+	SeenSet            string        `setting:"seen_set" default:"map" desc:"Seen-set backend: map, sharded or cuckoo"`
+	SeenSetShards      int           `setting:"seen_set_shards" default:"64" desc:"Number of shards of the sharded seen-set"`
+	SeenSetCapacity    int           `setting:"seen_set_capacity" default:"1000000" desc:"Number of urls the cuckoo seen-set is sized for"`
+	SeenSetFPRate      float64       `setting:"seen_set_fp_rate" default:"0.0001" desc:"False positive rate of the cuckoo seen-set"`
+	DistinctSchemes    bool          `setting:"distinct_schemes" desc:"Treat the http and https versions of a url as different urls"`
+	DistinctFragments  bool          `setting:"distinct_fragments" desc:"Treat urls which only differ by their fragment as different urls"`
+	DuplicateDistance  int           `setting:"duplicate_distance" default:"3" desc:"Maximum SimHash distance of near-duplicate pages with -duplicates"`
+	SkipDuplicateLinks bool          `setting:"skip_duplicate_links" desc:"Don't follow the links of duplicate pages with -duplicates"`
+	MaxURLLength       int           `setting:"max_url_length" desc:"Skip urls longer than this"`
+	MaxPathDepth       int           `setting:"max_path_depth" desc:"Skip urls with more path segments than this"`
+	MaxSegmentRepeats  int           `setting:"max_segment_repeats" desc:"Skip urls repeating a path segment more times than this"`
+	MaxURLsPerPattern  int           `setting:"max_urls_per_pattern" desc:"Skip urls once this many urls with the same shape were queued"`
+	MaxQueryParams     int           `setting:"max_query_params" desc:"Skip urls with more query parameters than this"`
+	MaxQueryVariants   int           `setting:"max_query_variants" desc:"Skip urls once a path was queued with this many different queries"`
+	Adaptive           bool          `setting:"adaptive" desc:"Adapt the concurrency of each host to its latency and throttling"`
+	MinHostConcurrency int           `setting:"min_host_concurrency" desc:"Minimum number of concurrent fetches per host with -adaptive"`
+	MaxHostConcurrency int           `setting:"max_host_concurrency" desc:"Maximum number of concurrent fetches per host with -adaptive"`
+	LatencyTolerance   float64       `setting:"latency_tolerance" desc:"Back off when a host's latency grows beyond this multiple of its fastest with -adaptive"`
+	Backoff            float64       `setting:"backoff" desc:"Factor a host's concurrency is multiplied by when backing off with -adaptive"`
+	MaxAttempts        int           `setting:"max_attempts" desc:"Number of times throttled and timed out fetches are tried with -adaptive"`
+	RetryDelay         time.Duration `setting:"retry_delay" desc:"Time a throttled or timed out fetch waits before it's retried with -adaptive, doubling on every further attempt"`
+	WARCMaxSize        int64         `setting:"warc_max_size" default:"1000000000" desc:"Size in bytes after which a new WARC file is started with -warc"`
+	CacheIgnoreHeaders bool          `setting:"cache_ignore_headers" desc:"Cache every response for -cache-max-age regardless of its headers with -cache"`
+	CacheMaxAge        time.Duration `setting:"cache_max_age" desc:"How long responses are served from the cache without revalidation with -cache-ignore-headers"`
+}
+
+// defaultConfig returns the defaults the crawler package provides, so that
+// they aren't repeated in the default tags.
+func defaultConfig() Config {
+	traps := crawler.DefaultTrapLimits()
+	adaptive := crawler.DefaultAdaptiveLimits()
+
+	return Config{
+		MaxURLLength:       traps.MaxURLLength,
+		MaxPathDepth:       traps.MaxPathDepth,
+		MaxSegmentRepeats:  traps.MaxSegmentRepeats,
+		MaxURLsPerPattern:  traps.MaxURLsPerPattern,
+		MaxQueryParams:     traps.MaxQueryParams,
+		MaxQueryVariants:   traps.MaxQueryVariants,
+		MinHostConcurrency: adaptive.Min,
+		MaxHostConcurrency: adaptive.Max,
+		LatencyTolerance:   adaptive.LatencyTolerance,
+		Backoff:            adaptive.Backoff,
+		MaxAttempts:        adaptive.MaxAttempts,
+		RetryDelay:         adaptive.RetryDelay,
+	}
+}
+
+// settings resolves the flags of a command. A flag given on the command line
+// takes precedence over its environment variable, which takes precedence over
+// the config file, which takes precedence over the default.
+type settings struct {
+	fs *flag.FlagSet
+	// Environment variables of the flags, all but -config and -profile have one
+	env     map[string]string
+	file    string
+	profile string
+	// Where settings in the config file no command knows are pointed out
+	warnings io.Writer
+}
+
+// newSettings creates the flag set of a command, along with its -help output.
+func newSettings(name, args, summary string) *settings {
+	s := &settings{
+		fs:       flag.NewFlagSet(name, flag.ExitOnError),
+		env:      make(map[string]string),
+		warnings: os.Stderr,
+	}
+
+	s.fs.StringVar(&s.file, "config", "", "Read settings from a JSON, YAML or TOML `file`")
+	s.fs.StringVar(&s.profile, "profile", "", "Apply the settings of the `profile` in the config file on top of the others")
+	s.fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n\n%s\n\nFlags:\n", os.Args[0], name, args, summary)
+		s.fs.PrintDefaults()
+	}
+
+	return s
+}
+
+// bindConfig adds a flag for every field of cfg, defaulting to the value of
+// the field unless it has a default tag.
+func (s *settings) bindConfig(cfg *Config) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("setting")
+		name := strings.Replace(tag, "_", "-", -1)
+		usage := field.Tag.Get("desc")
+
+		switch p := v.Field(i).Addr().Interface().(type) {
+		case *time.Duration:
+			s.fs.DurationVar(p, name, *p, usage)
+		case *int:
+			s.fs.IntVar(p, name, *p, usage)
+		case *int64:
+			s.fs.Int64Var(p, name, *p, usage)
+		case *float64:
+			s.fs.Float64Var(p, name, *p, usage)
+		case *bool:
+			s.fs.BoolVar(p, name, *p, usage)
+		case *string:
+			s.fs.StringVar(p, name, *p, usage)
+		default:
+			panic(fmt.Sprintf("Unsupported config field %s", field.Name))
+		}
+
+		// Setting the value directly so the flag doesn't count as given on the command line
+		if def := field.Tag.Get("default"); def != "" {
+			f := s.fs.Lookup(name)
+			if err := f.Value.Set(def); err != nil {
+				panic(fmt.Sprintf("Invalid default of config field %s: %v", field.Name, err))
+			}
+			f.DefValue = def
+		}
+	}
+}
+
+// parse parses the command line and fills in the flags it didn't set from
+// the environment and the config file.
+func (s *settings) parse(args []string) error {
+	s.bindEnv()
+	s.fs.Parse(args)
+
+	given := make(map[string]bool)
+	s.fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	if s.profile != "" && s.file == "" {
+		return fmt.Errorf("-profile requires -config")
+	}
+
+	var file map[string][]string
+	if s.file != "" {
+		var err error
+		if file, err = readConfigFile(s.file, s.profile); err != nil {
+			return err
+		}
+
+		s.warnUnknown(file)
+	}
+
+	var err error
+	s.fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+
+		if name, ok := s.env[f.Name]; ok {
+			if v := os.Getenv(name); v != "" {
+				if e := f.Value.Set(v); e != nil {
+					err = fmt.Errorf("Invalid value %q for %s: %v", v, name, e)
+				}
+				return
+			}
+		}
+
+		for _, v := range file[f.Name] {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("%s: invalid value %q for %s: %v", s.file, v, f.Name, e)
+				return
+			}
+		}
+	})
+
+	return err
+}
+
+// bindEnv names the environment variable of every flag after it, upper-cased
+// with underscores, e.g. -http-timeout is $HTTP_TIMEOUT, and lists it in -help.
+// The flags picking the config file can't come from it or the environment.
+func (s *settings) bindEnv() {
+	s.fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "profile" {
+			return
+		}
+
+		if _, ok := s.env[f.Name]; ok {
+			return
+		}
+
+		s.env[f.Name] = strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		f.Usage = fmt.Sprintf("%s, $%s", f.Usage, s.env[f.Name])
+	})
+}
+
+// warnUnknown points out the settings in the config file which no command has
+// a flag for, as they're most likely typos.
+func (s *settings) warnUnknown(file map[string][]string) {
+	known := knownSettings()
+
+	names := make([]string, 0, len(file))
+	for name := range file {
+		if !known[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(s.warnings, "%s: unknown setting %s\n", s.file, name)
+	}
+}
+
+// knownSettings returns the names of the flags of every command.
+func knownSettings() map[string]bool {
+	known := make(map[string]bool)
+	for _, c := range commands {
+		s := newSettings(c.name, c.args, c.help)
+		c.setup(s)
+		s.fs.VisitAll(func(f *flag.Flag) {
+			known[f.Name] = true
+		})
+	}
+
+	return known
+}
+
+// readConfigFile returns the values of the settings in the file, with the
+// settings of the profile replacing the top level ones. The format is picked
+// by the file's extension.
+//
+// Keys are flag names, with either dashes or underscores. Settings for flags
+// a command doesn't have are ignored so that one file can be shared by all of
+// them, only those no command has are warned about. Profiles are tables under
+// "profiles":
+//
+//	concurrency: 5
+//	profiles:
+//	  fast:
+//	    concurrency: 50
+//	    adaptive: true
+func readConfigFile(path, profile string) (map[string][]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		err = d.Decode(&doc)
+	case ".yaml", ".yml":
+		doc, err = parseYAML(b)
+	case ".toml":
+		doc, err = parseTOML(b)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format, expected .json, .yaml, .yml or .toml", path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	profiles, _ := doc["profiles"].(map[string]interface{})
+	delete(doc, "profiles")
+
+	values, err := settingValues(doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if profile == "" {
+		return values, nil
+	}
+
+	p, ok := profiles[profile].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown profile %q, available: %s", path, profile, strings.Join(sortedNames(profiles), ", "))
+	}
+
+	overrides, err := settingValues(p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: profile %s: %v", path, profile, err)
+	}
+
+	for k, v := range overrides {
+		values[k] = v
+	}
+
+	return values, nil
+}
+
+// settingValues turns a parsed document into flag values keyed by flag name.
+// Lists are kept for flags which can be repeated.
+func settingValues(doc map[string]interface{}) (map[string][]string, error) {
+	values := make(map[string][]string, len(doc))
+	for k, v := range doc {
+		name := strings.Replace(k, "_", "-", -1)
+
+		if list, ok := v.([]interface{}); ok {
+			for _, item := range list {
+				s, err := scalarValue(item)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", k, err)
+				}
+				values[name] = append(values[name], s)
+			}
+			continue
+		}
+
+		s, err := scalarValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		values[name] = []string{s}
+	}
+
+	return values, nil
+}
+
+func scalarValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		// Written without an exponent so that 1e9 is accepted by integer flags
+		if _, err := v.Int64(); err != nil {
+			if f, err := v.Float64(); err == nil {
+				return strconv.FormatFloat(f, 'f', -1, 64), nil
+			}
+		}
+		return v.String(), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+
+	return "", fmt.Errorf("expected a value, got %T", v)
+}
+
+func parseYAML(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	return stringKeys(doc).(map[string]interface{}), nil
+}
+
+// stringKeys converts the mappings nested in a YAML document, which are keyed
+// by interface{}, to the map[string]interface{} the JSON and TOML ones use.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = stringKeys(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = stringKeys(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = stringKeys(item)
+		}
+	}
+
+	return v
+}
+
+func parseTOML(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(string(b), &doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+func sortedNames(m map[string]interface{}) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
+}
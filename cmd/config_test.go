@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	crawler "github.com/dovys/monzo-crawler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigFormats(t *testing.T) {
+	expected := map[string][]string{
+		"concurrency":  {"5"},
+		"http-timeout": {"30s"},
+		"adaptive":     {"true"},
+		"backoff":      {"0.25"},
+		"exclude":      {"/admin", "/private # not a comment"},
+		"user-agent":   {"monzo-crawler (+https://monzo.com)"},
+	}
+
+	tests := []struct {
+		name  string
+		parse func([]byte) (map[string]interface{}, error)
+		doc   string
+	}{
+		{"yaml block list", parseYAML, `
+# Crawler settings
+concurrency: 5
+http_timeout: 30s # inline comment
+adaptive: yes
+backoff: 0.25
+exclude:
+  - /admin
+  - "/private # not a comment"
+user_agent: >-
+  monzo-crawler
+  (+https://monzo.com)
+profiles:
+  fast: {concurrency: 50}
+`},
+		{"yaml flow list and anchors", parseYAML, `---
+defaults: &defaults
+  concurrency: 5
+http_timeout: "30s"
+adaptive: true
+backoff: 2.5e-1
+exclude: [/admin, '/private # not a comment']
+user_agent: 'monzo-crawler (+https://monzo.com)'
+profiles:
+  fast:
+    <<: *defaults
+`},
+		{"toml", parseTOML, `
+# Crawler settings
+concurrency = 5
+http_timeout = "30s" # inline comment
+adaptive = true
+backoff = 0.25
+exclude = [
+  "/admin",
+  "/private # not a comment",
+]
+user_agent = 'monzo-crawler (+https://monzo.com)'
+
+[profiles]
+fast = { concurrency = 50 }
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := tt.parse([]byte(tt.doc))
+			require.NoError(t, err)
+
+			require.IsType(t, map[string]interface{}{}, doc["profiles"])
+			delete(doc, "profiles")
+			// Anchors are resolved, but the mapping they're defined on is kept
+			if defaults, ok := doc["defaults"].(map[string]interface{}); ok {
+				doc["concurrency"] = defaults["concurrency"]
+				delete(doc, "defaults")
+			}
+
+			values, err := settingValues(doc)
+			require.NoError(t, err)
+			assert.Equal(t, expected, values)
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func([]byte) (map[string]interface{}, error)
+		doc   string
+	}{
+		{"yaml unterminated list", parseYAML, "exclude: [/admin\n"},
+		{"yaml bad indentation", parseYAML, "profiles:\n  fast:\n    concurrency: 50\n   adaptive: true\n"},
+		{"toml missing equals", parseTOML, "concurrency 5\n"},
+		{"toml unterminated string", parseTOML, "http_timeout = \"30s\n"},
+		{"toml duplicate key", parseTOML, "concurrency = 5\nconcurrency = 6\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.parse([]byte(tt.doc))
+
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := settingValues(map[string]interface{}{"concurrency": map[string]interface{}{"max": 5}})
+	assert.Error(t, err)
+}
+
+func TestReadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"crawler.json": `{"concurrency": 5, "warc_max_size": 1e9, "exclude": ["/admin"], "profiles": {"fast": {"concurrency": 50, "adaptive": true}}}`,
+		"crawler.yaml": "concurrency: 5\nwarc-max-size: 1000000000\nexclude: [/admin]\nprofiles:\n  fast:\n    concurrency: 50\n    adaptive: true\n",
+		"crawler.toml": "concurrency = 5\nwarc_max_size = 1000000000\nexclude = [\"/admin\"]\n[profiles.fast]\nconcurrency = 50\nadaptive = true\n",
+	}
+
+	tests := []struct {
+		name     string
+		profile  string
+		expected map[string][]string
+		err      string
+	}{
+		{
+			name:    "without a profile",
+			profile: "",
+			expected: map[string][]string{
+				"concurrency":   {"5"},
+				"warc-max-size": {"1000000000"},
+				"exclude":       {"/admin"},
+			},
+		},
+		{
+			name:    "with a profile overriding the settings",
+			profile: "fast",
+			expected: map[string][]string{
+				"concurrency":   {"50"},
+				"warc-max-size": {"1000000000"},
+				"exclude":       {"/admin"},
+				"adaptive":      {"true"},
+			},
+		},
+		{
+			name:    "with an unknown profile",
+			profile: "slow",
+			err:     `unknown profile "slow", available: fast`,
+		},
+	}
+
+	for file, contents := range files {
+		path := filepath.Join(dir, file)
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+
+		for _, tt := range tests {
+			t.Run(file+" "+tt.name, func(t *testing.T) {
+				values, err := readConfigFile(path, tt.profile)
+
+				if tt.err != "" {
+					require.Error(t, err)
+					assert.Contains(t, err.Error(), tt.err)
+					return
+				}
+
+				require.NoError(t, err)
+				assert.Equal(t, tt.expected, values)
+			})
+		}
+	}
+
+	_, err = readConfigFile(filepath.Join(dir, "crawler.ini"), "")
+	assert.Error(t, err)
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "crawler.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte("concurrency: 3\nprofiles:\n  fast:\n    concurrency: 4\n"), 0644))
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      string
+		expected int
+	}{
+		{"default", nil, "", 5},
+		{"file over default", []string{"-config", file}, "", 3},
+		{"profile over file", []string{"-config", file, "-profile", "fast"}, "", 4},
+		{"env over file", []string{"-config", file, "-profile", "fast"}, "6", 6},
+		{"flag over env", []string{"-config", file, "-concurrency", "7"}, "6", 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("CONCURRENCY", tt.env)
+			defer os.Unsetenv("CONCURRENCY")
+
+			cfg := defaultConfig()
+			s := newSettings("crawl", "", "")
+			s.bindConfig(&cfg)
+
+			require.NoError(t, s.parse(tt.args))
+			assert.Equal(t, tt.expected, cfg.Concurrency)
+			assert.Equal(t, 10*time.Second, cfg.HTTPTimeout)
+		})
+	}
+}
+
+func TestSettingsApplyToEveryFlag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "crawler.toml")
+	require.NoError(t, ioutil.WriteFile(file, []byte("output = \"file.ndjson\"\nresume = true\n"), 0644))
+
+	os.Setenv("OUTPUT", "env.ndjson")
+	defer os.Unsetenv("OUTPUT")
+	os.Setenv("CONFIG", "missing.toml")
+	defer os.Unsetenv("CONFIG")
+
+	s := newSettings("crawl", "", "")
+	output := s.fs.String("output", "", "Write results to `file`")
+	resume := s.fs.Bool("resume", false, "Continue the crawl")
+
+	require.NoError(t, s.parse([]string{"-config", file}))
+	assert.Equal(t, "env.ndjson", *output)
+	assert.True(t, *resume)
+	assert.Equal(t, "Write results to `file`, $OUTPUT", s.fs.Lookup("output").Usage)
+	assert.Equal(t, "RESUME", s.env["resume"])
+	assert.NotContains(t, s.env, "config")
+	assert.NotContains(t, s.env, "profile")
+}
+
+func TestSettingsRejectInvalidValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "crawler.toml")
+	require.NoError(t, ioutil.WriteFile(file, []byte("concurrency = \"many\"\n"), 0644))
+
+	cfg := defaultConfig()
+	s := newSettings("crawl", "", "")
+	s.bindConfig(&cfg)
+
+	assert.Error(t, s.parse([]string{"-config", file}))
+	assert.Error(t, newSettings("crawl", "", "").parse([]string{"-profile", "fast"}))
+}
+
+func TestSettingsWarnAboutUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// -addr only belongs to serve, so crawl ignores it without a warning
+	file := filepath.Join(dir, "crawler.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte("concurency: 50\naddr: :8080\nhttp_timeout: 5s\n"), 0644))
+
+	cfg := defaultConfig()
+	s := newSettings("crawl", "", "")
+	s.bindConfig(&cfg)
+	warnings := &bytes.Buffer{}
+	s.warnings = warnings
+
+	require.NoError(t, s.parse([]string{"-config", file}))
+	assert.Equal(t, file+": unknown setting concurency\n", warnings.String())
+	assert.Equal(t, 5, cfg.Concurrency)
+	assert.Equal(t, 5*time.Second, cfg.HTTPTimeout)
+}
+
+func TestDefaultConfigMatchesTheCrawler(t *testing.T) {
+	cfg := defaultConfig()
+
+	assert.Equal(t, crawler.DefaultTrapLimits(), crawler.TrapLimits{
+		MaxURLLength:      cfg.MaxURLLength,
+		MaxPathDepth:      cfg.MaxPathDepth,
+		MaxSegmentRepeats: cfg.MaxSegmentRepeats,
+		MaxURLsPerPattern: cfg.MaxURLsPerPattern,
+		MaxQueryParams:    cfg.MaxQueryParams,
+		MaxQueryVariants:  cfg.MaxQueryVariants,
+	})
+	assert.Equal(t, crawler.DefaultAdaptiveLimits(), crawler.AdaptiveLimits{
+		Min:              cfg.MinHostConcurrency,
+		Max:              cfg.MaxHostConcurrency,
+		LatencyTolerance: cfg.LatencyTolerance,
+		Backoff:          cfg.Backoff,
+		MaxAttempts:      cfg.MaxAttempts,
+		RetryDelay:       cfg.RetryDelay,
+	})
+}
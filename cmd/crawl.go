@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+// results receives what a crawl finds. Pages and errors are delivered
+// concurrently.
+type results interface {
+	Page(page *crawler.Page, p *pageResult) error
+	Error(err error) error
+	// Done is called once the crawl stopped and returns the command's exit status
+	Done() int
+}
+
+// crawlOptions holds the flags shared by the commands which crawl.
+type crawlOptions struct {
+	cfg              Config
+	stateFile        string
+	resume           bool
+	ordering         string
+	seedsFile        string
+	errorLogFile     string
+	duplicatesReport string
+	progressInterval time.Duration
+	warcDir          string
+	recordFile       string
+	replayFile       string
+	cacheDir         string
+	dbFile           string
+	changesFile      string
+	storeDir         string
+	metricsAddr      string
+	weights          weightsFlag
+
+	// Set by the commands rather than flags
+	mirrorDir    string
+	printSummary bool
+}
+
+func (o *crawlOptions) register(s *settings) {
+	o.cfg = defaultConfig()
+	s.bindConfig(&o.cfg)
+
+	fs := s.fs
+	fs.StringVar(&o.stateFile, "state", "", "File where crawl progress is checkpointed")
+	fs.BoolVar(&o.resume, "resume", false, "Continue the crawl checkpointed in -state")
+	fs.StringVar(&o.ordering, "frontier", "", "Crawl order: bfs, dfs, best or roundrobin. Defaults to bfs for a single seed and roundrobin for many")
+	fs.StringVar(&o.seedsFile, "seeds", "", "Read seed urls from `file`, one per line, - for stdin")
+	fs.StringVar(&o.errorLogFile, "error-log", "", "Write crawl errors as JSON lines to `file`")
+	fs.StringVar(&o.duplicatesReport, "duplicates", "", "Detect duplicate content and write a report of duplicate pages to `file`")
+	fs.DurationVar(&o.progressInterval, "progress", time.Second, "Refresh a progress line on stderr every `interval` when it's a terminal, 0 disables it")
+	fs.StringVar(&o.warcDir, "warc", "", "Archive every fetch as gzipped WARC 1.1 files in `dir`")
+	fs.StringVar(&o.recordFile, "record", "", "Record every fetch as a HAR archive in `file`")
+	fs.StringVar(&o.replayFile, "replay", "", "Serve fetches from a HAR archive written by -record instead of the network")
+	fs.StringVar(&o.cacheDir, "cache", "", "Cache responses in `dir` and revalidate them on the next crawl")
+	fs.StringVar(&o.dbFile, "db", "", "Compare the crawl with the previous run recorded in `file` and record this run in its place")
+	fs.StringVar(&o.changesFile, "changes", "", "Write the changes since the previous run as JSON to `file`, requires -db")
+	fs.StringVar(&o.storeDir, "store", "", "Record pages, links, assets, errors and redirects as tables in `dir` for the query command, appending to them with -resume")
+	fs.StringVar(&o.metricsAddr, "metrics", "", "Serve Prometheus metrics on `addr` at /metrics")
+	o.weights = weightsFlag{}
+	fs.Var(o.weights, "weight", "Score `pattern=weight` added to urls matching the pattern with -frontier best, can be repeated")
+}
+
+// seeds validates the flags and reads the seed urls from the arguments left
+// after them. It prints why the command can't crawl when it returns false.
+func (o *crawlOptions) seeds(s *settings, args []string) ([]*url.URL, bool) {
+	if o.resume && o.stateFile == "" {
+		fmt.Println("-resume requires -state")
+		return nil, false
+	}
+
+	if o.changesFile != "" && o.dbFile == "" {
+		fmt.Println("-changes requires -db")
+		return nil, false
+	}
+
+	// Both need the network's responses
+	if o.replayFile != "" && (o.warcDir != "" || o.cacheDir != "") {
+		fmt.Println("-replay can't be used with -warc or -cache")
+		return nil, false
+	}
+
+	seeds, err := readSeeds(args, o.seedsFile)
+	if err != nil {
+		fmt.Println(err)
+		return nil, false
+	}
+
+	// Seeds are optional when resuming since the frontier is restored from the state file
+	if len(seeds) == 0 && !o.resume {
+		s.fs.Usage()
+		return nil, false
+	}
+
+	// Taking turns between sites so a large site doesn't hold up the others
+	if o.ordering == "" {
+		o.ordering = "bfs"
+		if len(seeds) > 1 {
+			o.ordering = "roundrobin"
+		}
+	}
+
+	return seeds, true
+}
+
+// crawl runs the crawl until the frontier is exhausted or it's interrupted
+// and returns the exit status of the command.
+func (o *crawlOptions) crawl(seeds []*url.URL, r results) int {
+	cfg := o.cfg
+
+	var store *crawler.Store
+	if o.storeDir != "" {
+		var err error
+		store, err = crawler.OpenStore(o.storeDir, o.resume)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "Failed to create the store"))
+			return 1
+		}
+	}
+
+	h := &http.Client{
+		Timeout: cfg.HTTPTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if store != nil {
+				store.RecordRedirect(via[len(via)-1].URL, req.URL, req.Response.StatusCode)
+			}
+
+			// Preventing redirects to a different host
+			for _, v := range via {
+				if req.URL.Host != v.URL.Host {
+					return http.ErrUseLastResponse
+				}
+			}
+
+			return nil
+		},
+	}
+
+	frontier, err := newFrontier(o.ordering, o.weights, cfg)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	seen, err := newUniqueSet(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	var metrics *crawler.Metrics
+	var fetcherOpts []crawler.FetcherOption
+	if o.metricsAddr != "" {
+		metrics = crawler.NewMetrics()
+		fetcherOpts = append(fetcherOpts, crawler.InstrumentFetcher(metrics))
+	}
+
+	opts := []crawler.CrawlerOption{
+		crawler.Concurrency(cfg.Concurrency),
+		crawler.ResultBufferLength(cfg.ResultBufferLength),
+		crawler.MaxQueueLength(cfg.MaxQueueLength),
+		crawler.Queue(frontier),
+		crawler.DetectTraps(crawler.NewTrapDetector(crawler.TrapLimits{
+			MaxURLLength:      cfg.MaxURLLength,
+			MaxPathDepth:      cfg.MaxPathDepth,
+			MaxSegmentRepeats: cfg.MaxSegmentRepeats,
+			MaxURLsPerPattern: cfg.MaxURLsPerPattern,
+			MaxQueryParams:    cfg.MaxQueryParams,
+			MaxQueryVariants:  cfg.MaxQueryVariants,
+		})),
+	}
+
+	var journal *crawler.FileJournal
+	if o.stateFile != "" {
+		var err error
+		journal, err = crawler.OpenFileJournal(o.stateFile, o.resume)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "Failed to open state"))
+			return 1
+		}
+		defer journal.Close()
+
+		if o.resume {
+			opts = append(opts, crawler.Resume(journal))
+		} else {
+			opts = append(opts, crawler.Checkpoints(journal))
+		}
+	}
+
+	if cfg.Adaptive {
+		opts = append(opts, crawler.Adaptive(crawler.AdaptiveLimits{
+			Min:              cfg.MinHostConcurrency,
+			Max:              cfg.MaxHostConcurrency,
+			LatencyTolerance: cfg.LatencyTolerance,
+			Backoff:          cfg.Backoff,
+			MaxAttempts:      cfg.MaxAttempts,
+			RetryDelay:       cfg.RetryDelay,
+		}))
+	}
+
+	var duplicates *crawler.DuplicateDetector
+	if o.duplicatesReport != "" {
+		duplicates = crawler.NewDuplicateDetector(cfg.DuplicateDistance)
+		opts = append(opts, crawler.DetectDuplicates(duplicates))
+
+		if cfg.SkipDuplicateLinks {
+			opts = append(opts, crawler.SkipDuplicateLinks())
+		}
+	}
+
+	if metrics != nil {
+		opts = append(opts, crawler.Instrument(metrics))
+	}
+
+	var archive *crawler.WARCWriter
+	if o.warcDir != "" {
+		var err error
+		archive, err = crawler.NewWARCWriter(o.warcDir, "crawl", cfg.WARCMaxSize)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "Failed to open the WARC archive"))
+			return 1
+		}
+		defer archive.Close()
+
+		fetcherOpts = append(fetcherOpts, crawler.Archive(archive))
+		opts = append(opts, crawler.Pipeline(crawler.Stage{Name: "warc", Processor: archive}))
+		opts = append(opts, crawler.RegisterHooks(archive))
+	}
+
+	var cache *crawler.HTTPCache
+	if o.cacheDir != "" {
+		var err error
+		cache, err = crawler.OpenHTTPCache(o.cacheDir, crawler.CachePolicy{
+			IgnoreHeaders: cfg.CacheIgnoreHeaders,
+			MaxAge:        cfg.CacheMaxAge,
+		})
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "Failed to open the cache"))
+			return 1
+		}
+
+		fetcherOpts = append(fetcherOpts, crawler.Cache(cache))
+	}
+
+	var db *crawler.CrawlDB
+	if o.dbFile != "" {
+		var err error
+		db, err = crawler.OpenCrawlDB(o.dbFile)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "Failed to open the crawl database"))
+			return 1
+		}
+
+		// The resumed run only crawls what the interrupted one had left
+		if o.resume {
+			if err := db.Resume(); err != nil {
+				fmt.Println(errors.Wrap(err, "Failed to resume the crawl database"))
+				return 1
+			}
+		}
+
+		opts = append(opts, crawler.RegisterHooks(db))
+	}
+
+	if store != nil {
+		opts = append(opts, crawler.RegisterHooks(store))
+	}
+
+	fetcher := crawler.NewFetcher(h, fetcherOpts...)
+	if o.replayFile != "" {
+		var err error
+		fetcher, err = crawler.OpenReplayFetcher(o.replayFile, fetcherOpts...)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "Failed to open the recording"))
+			return 1
+		}
+	}
+
+	var recorder *crawler.RecordingFetcher
+	if o.recordFile != "" {
+		var err error
+		recorder, err = crawler.CreateRecordingFetcher(fetcher, o.recordFile)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "Failed to create the recording"))
+			return 1
+		}
+		fetcher = recorder
+	}
+
+	var mirror *crawler.Mirror
+	if o.mirrorDir != "" {
+		var err error
+		mirror, err = crawler.OpenMirror(o.mirrorDir, fetcher)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "Failed to open mirror"))
+			return 1
+		}
+
+		opts = append(opts, crawler.Pipeline(crawler.Stage{Name: "mirror", Processor: mirror}))
+	}
+
+	c := crawler.NewCrawler(
+		crawler.NewParser(),
+		fetcher,
+		seen,
+		opts...,
+	)
+
+	for _, seed := range seeds {
+		if err := c.Enqueue(seed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stopping gracefully on SIGINT so in-flight pages are checkpointed
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	if metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+
+		go func() {
+			if err := http.ListenAndServe(o.metricsAddr, mux); err != nil {
+				fmt.Fprintln(os.Stderr, "Metrics listener failed:", err)
+			}
+		}()
+	}
+
+	var errLog *errorLog
+	if o.errorLogFile != "" {
+		f, err := os.Create(o.errorLogFile)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer f.Close()
+
+		errLog = newErrorLog(f)
+	}
+
+	// Anything written to stderr while the progress line is shown goes through it
+	var stderr io.Writer = os.Stderr
+	var status *progress
+	if o.progressInterval > 0 && isTerminal(os.Stderr) {
+		status = newProgress(os.Stderr, c)
+		status.Start(o.progressInterval)
+		stderr = status
+	}
+
+	summary := sitesSummary{}
+	var summaryMu sync.Mutex
+
+	pages, errors := c.Run(ctx)
+	errorsDone := make(chan struct{})
+	go func() {
+		defer close(errorsDone)
+
+		logger := log.New(stderr, "", log.LstdFlags)
+		for err := range errors {
+			// The adaptive controller backs off on its own
+			if !cfg.Adaptive && stderrors.Is(err, crawler.ErrTooManyRequests) {
+				logger.Println("Stopping due to too many requests")
+				cancel()
+			}
+
+			if errLog != nil {
+				if err := errLog.Write(err); err != nil {
+					logger.Println(err)
+				}
+			}
+
+			if err := r.Error(err); err != nil {
+				logger.Println(err)
+			}
+
+			if site := errorSite(err); site != "" {
+				summaryMu.Lock()
+				summary.site(site).Errors++
+				summaryMu.Unlock()
+			}
+
+			logger.Println(err)
+		}
+	}()
+
+	for page := range pages {
+		p := pageResult{
+			URL:    page.String(),
+			Status: http.StatusOK,
+			Links:  make([]string, len(page.Links)),
+			Assets: make([]string, len(page.Assets)),
+		}
+
+		for i := 0; i < len(page.Links); i++ {
+			p.Links[i] = page.Links[i].String()
+		}
+
+		for i := 0; i < len(page.Assets); i++ {
+			p.Assets[i] = page.Assets[i].String()
+		}
+
+		if page.Duplicate != nil {
+			p.DuplicateOf = page.Duplicate.Of.String()
+		}
+
+		if err := r.Page(page, &p); err != nil {
+			fmt.Fprintln(stderr, err)
+		}
+
+		summaryMu.Lock()
+		st := summary.site(page.Site)
+		st.Pages++
+		st.Links += len(page.Links)
+		st.Assets += len(page.Assets)
+		if page.Duplicate != nil {
+			st.Duplicates++
+		}
+		summaryMu.Unlock()
+	}
+
+	<-errorsDone
+	if status != nil {
+		status.Stop()
+	}
+
+	if len(seeds) > 1 || o.printSummary {
+		summary.Print(os.Stderr)
+	}
+
+	// Pages an interrupted crawl didn't get to would show up as removed, and
+	// the next run would compare against the partial crawl
+	if db != nil && ctx.Err() != nil {
+		if err := db.SaveInterrupted(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to save the interrupted crawl:", err)
+		} else {
+			fmt.Fprintln(os.Stderr, "The crawl was interrupted, it's compared and recorded in", o.dbFile, "once it's finished with -resume")
+		}
+	} else if db != nil {
+		if err := reportChanges(db, o.changesFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to report changes:", err)
+		}
+	}
+
+	if store != nil {
+		if err := store.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to write the store:", err)
+		}
+	}
+
+	if cache != nil {
+		s := cache.Stats()
+		fmt.Fprintf(os.Stderr, "Cache: %d hits, %d revalidated, %d downloaded\n", s.Hits, s.Revalidated, s.Misses)
+	}
+
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to write the recording:", err)
+		}
+	}
+
+	if mirror != nil {
+		if err := mirror.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to save the mirror manifest:", err)
+		}
+
+		s := mirror.Summary()
+		fmt.Fprintf(os.Stderr, "Mirrored %d pages and %d assets to %s, %d unchanged\n", s.Pages, s.Assets, o.mirrorDir, s.Unchanged)
+	}
+
+	if duplicates != nil {
+		if err := writeDuplicatesReport(o.duplicatesReport, duplicates); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to write the duplicates report:", err)
+		}
+	}
+
+	return r.Done()
+}
+
+func writeDuplicatesReport(path string, d *crawler.DuplicateDetector) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := d.WriteReport(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// reportChanges prints the changes since the previous run, unless this is the
+// first one, and records this run as the previous one for the next crawl.
+func reportChanges(db *crawler.CrawlDB, path string) error {
+	changes := db.Changes()
+	if db.Previous() > 0 {
+		if err := changes.WriteText(os.Stderr); err != nil {
+			return err
+		}
+	}
+
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+
+		if err := changes.WriteJSON(f); err != nil {
+			f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return db.Save()
+}
+
+func newFrontier(ordering string, weights weightsFlag, cfg Config) (crawler.Frontier, error) {
+	switch ordering {
+	case "bfs":
+		return crawler.NewSpillingFrontier(cfg.SpillDir, cfg.HotQueueLength), nil
+	case "dfs":
+		return crawler.NewDFSFrontier(), nil
+	case "roundrobin":
+		return crawler.NewRoundRobinFrontier(), nil
+	case "best":
+		score, err := crawler.PatternWeights(weights)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid weight pattern")
+		}
+
+		return crawler.NewBestFirstFrontier(crawler.CombineScores(crawler.ShallowFirst, score)), nil
+	}
+
+	return nil, fmt.Errorf("Unknown frontier %q", ordering)
+}
+
+func newUniqueSet(cfg Config) (crawler.UniqueSet, error) {
+	var opts []crawler.UniqueSetOption
+	if cfg.DistinctSchemes {
+		opts = append(opts, crawler.DistinctSchemes())
+	}
+	if cfg.DistinctFragments {
+		opts = append(opts, crawler.DistinctFragments())
+	}
+
+	switch cfg.SeenSet {
+	case "map":
+		return crawler.NewUniqueSet(opts...), nil
+	case "sharded":
+		return crawler.NewShardedUniqueSet(cfg.SeenSetShards, opts...), nil
+	case "cuckoo":
+		return crawler.NewCuckooUniqueSet(cfg.SeenSetCapacity, cfg.SeenSetFPRate, opts...), nil
+	}
+
+	return nil, fmt.Errorf("Unknown seen set %q", cfg.SeenSet)
+}
+
+type weightsFlag map[string]float64
+
+func (w weightsFlag) String() string {
+	return fmt.Sprint(map[string]float64(w))
+}
+
+func (w weightsFlag) Set(v string) error {
+	i := strings.LastIndex(v, "=")
+	if i < 0 {
+		return fmt.Errorf("Expected pattern=weight, got %q", v)
+	}
+
+	weight, err := strconv.ParseFloat(v[i+1:], 64)
+	if err != nil {
+		return err
+	}
+
+	w[v[:i]] = weight
+
+	return nil
+}
+
+// crawlCommand writes the pages found as results.
+func crawlCommand(s *settings) func() int {
+	o := &crawlOptions{}
+	o.register(s)
+	format := s.fs.String("format", "ndjson", "Write results as `format`: "+outputFormatNames())
+	outFile := s.fs.String("output", "", "Write results to `file` instead of stdout")
+	outDir := s.fs.String("out-dir", "", "Write each site's results to <host>.<ext> in `dir` instead of stdout")
+	rotateSize := s.fs.Int64("rotate-size", 0, "Start a new numbered output file once one reaches `bytes`, 0 disables rotation")
+	includeFailures := s.fs.Bool("include-failures", false, "Include pages which failed with an HTTP error in the results along with their status")
+	s.fs.StringVar(&o.mirrorDir, "mirror", "", "Save pages and assets under `dir` with links rewritten for offline browsing, refreshes the pages of an existing mirror")
+
+	return func() int {
+		seeds, ok := o.seeds(s, s.fs.Args())
+		if !ok {
+			return 1
+		}
+
+		if *outFile != "" && *outDir != "" {
+			fmt.Println("-output and -out-dir can't be used together")
+			return 1
+		}
+
+		output, err := newPartitionedOutput(*outDir, *outFile, *format, *rotateSize)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer output.Close()
+
+		o.printSummary = *outDir != ""
+
+		return o.crawl(seeds, &pageOutput{output: output, includeFailures: *includeFailures})
+	}
+}
+
+// pageOutput writes the results of the crawl command.
+type pageOutput struct {
+	output          *partitionedOutput
+	includeFailures bool
+}
+
+func (o *pageOutput) Page(page *crawler.Page, p *pageResult) error {
+	return o.output.Write(page.Site, p)
+}
+
+func (o *pageOutput) Error(err error) error {
+	if !o.includeFailures {
+		return nil
+	}
+
+	if site, p := failedResult(err); p != nil {
+		return o.output.Write(site, p)
+	}
+
+	return nil
+}
+
+func (o *pageOutput) Done() int {
+	if err := o.output.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write the results:", err)
+		return 1
+	}
+
+	return 0
+}
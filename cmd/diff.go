@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+// diffReport lists the differences between two crawl outputs.
+type diffReport struct {
+	Added         []string               `json:"added"`
+	Removed       []string               `json:"removed"`
+	StatusChanged []crawler.StatusChange `json:"status_changed"`
+	Links         []crawler.LinkChange   `json:"links"`
+	Assets        []crawler.LinkChange   `json:"assets"`
+}
+
+func (r *diffReport) empty() bool {
+	return len(r.Added) == 0 && len(r.Removed) == 0 && len(r.StatusChanged) == 0 && len(r.Links) == 0 && len(r.Assets) == 0
+}
+
+// diffCommand compares two files of results and exits with 1 when they differ, like diff(1).
+func diffCommand(s *settings) func() int {
+	asJSON := s.fs.Bool("json", false, "Write the differences as JSON")
+	ignoreHost := s.fs.Bool("ignore-host", false, "Align pages by path and query only, e.g. to compare staging with production")
+
+	return func() int {
+		if s.fs.NArg() != 2 {
+			s.fs.Usage()
+			return 2
+		}
+
+		before, err := readResults(s.fs.Arg(0), *ignoreHost)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		after, err := readResults(s.fs.Arg(1), *ignoreHost)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		report := diffResults(before, after)
+		if *asJSON {
+			e := json.NewEncoder(os.Stdout)
+			e.SetIndent("", "  ")
+			err = e.Encode(report)
+		} else {
+			err = report.WriteText(os.Stdout)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		if report.empty() {
+			return 0
+		}
+
+		return 1
+	}
+}
+
+// readResults reads results written in any of the output formats but CSV,
+// keyed by their normalised url. Links and assets are normalised the same way.
+func readResults(path string, ignoreHost bool) (map[string]*pageResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pages []*pageResult
+	add := func(p *pageResult) error {
+		pages = append(pages, p)
+		return nil
+	}
+
+	if isColumnar(f) {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		err = readColumnar(f, fi.Size(), add)
+	} else {
+		err = decodeResults(f, add)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	// Only the crawled sites lose their host, the same path on two external
+	// hosts is still two different urls
+	var sites map[string]bool
+	if ignoreHost {
+		sites = make(map[string]bool)
+		for _, p := range pages {
+			if u, err := url.Parse(p.URL); err == nil {
+				sites[strings.ToLower(u.Host)] = true
+			}
+		}
+	}
+
+	results := make(map[string]*pageResult, len(pages))
+	for _, p := range pages {
+		// Results written before the status was recorded only contain crawled pages
+		if p.Status == 0 {
+			p.Status = http.StatusOK
+		}
+
+		for i := range p.Links {
+			p.Links[i] = normaliseURL(p.Links[i], sites)
+		}
+
+		for i := range p.Assets {
+			p.Assets[i] = normaliseURL(p.Assets[i], sites)
+		}
+
+		results[normaliseURL(p.URL, sites)] = p
+	}
+
+	return results, nil
+}
+
+// decodeResults reads a stream of JSON results, which can be wrapped in an array.
+func decodeResults(r io.Reader, fn func(p *pageResult) error) error {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		br.Discard(1)
+	}
+
+	d := json.NewDecoder(br)
+	b, _ := br.Peek(1)
+	array := b[0] == '['
+	if array {
+		if _, err := d.Token(); err != nil {
+			return err
+		}
+	}
+
+	for d.More() {
+		p := &pageResult{}
+		if err := d.Decode(p); err != nil {
+			return err
+		}
+
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+
+	if array {
+		if _, err := d.Token(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normaliseURL canonicalises the url and leaves out its host when it's one of
+// the sites.
+func normaliseURL(raw string, sites map[string]bool) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	c := crawler.CanonicalURL(u)
+	if !sites[strings.ToLower(u.Host)] {
+		return c
+	}
+
+	u, _ = url.Parse(c)
+
+	return u.RequestURI()
+}
+
+func diffResults(before, after map[string]*pageResult) *diffReport {
+	r := &diffReport{
+		Added:         []string{},
+		Removed:       []string{},
+		StatusChanged: []crawler.StatusChange{},
+		Links:         []crawler.LinkChange{},
+		Assets:        []crawler.LinkChange{},
+	}
+
+	for _, k := range sortedResultKeys(after) {
+		a := after[k]
+		b, ok := before[k]
+		if !ok {
+			r.Added = append(r.Added, k)
+			continue
+		}
+
+		if a.Status != b.Status {
+			r.StatusChanged = append(r.StatusChanged, crawler.StatusChange{URL: k, From: b.Status, To: a.Status})
+		}
+
+		if added, removed := crawler.DiffLinks(b.Links, a.Links); len(added) > 0 || len(removed) > 0 {
+			r.Links = append(r.Links, crawler.LinkChange{URL: k, Added: added, Removed: removed})
+		}
+
+		if added, removed := crawler.DiffLinks(b.Assets, a.Assets); len(added) > 0 || len(removed) > 0 {
+			r.Assets = append(r.Assets, crawler.LinkChange{URL: k, Added: added, Removed: removed})
+		}
+	}
+
+	for _, k := range sortedResultKeys(before) {
+		if _, ok := after[k]; !ok {
+			r.Removed = append(r.Removed, k)
+		}
+	}
+
+	return r
+}
+
+func (r *diffReport) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%d added, %d removed, %d status changes, %d pages with changed links, %d pages with changed assets\n",
+		len(r.Added), len(r.Removed), len(r.StatusChanged), len(r.Links), len(r.Assets)); err != nil {
+		return err
+	}
+
+	for _, u := range r.Added {
+		fmt.Fprintf(w, "+ %s\n", u)
+	}
+
+	for _, u := range r.Removed {
+		fmt.Fprintf(w, "- %s\n", u)
+	}
+
+	for _, c := range r.StatusChanged {
+		fmt.Fprintf(w, "~ %s %d -> %d\n", c.URL, c.From, c.To)
+	}
+
+	writeChanges := func(kind string, changes []crawler.LinkChange) {
+		for _, c := range changes {
+			fmt.Fprintf(w, "~ %s %s\n", c.URL, kind)
+			for _, l := range c.Added {
+				fmt.Fprintf(w, "    + %s\n", l)
+			}
+			for _, l := range c.Removed {
+				fmt.Fprintf(w, "    - %s\n", l)
+			}
+		}
+	}
+
+	writeChanges("links", r.Links)
+	writeChanges("assets", r.Assets)
+
+	return nil
+}
+
+func sortedResultKeys(m map[string]*pageResult) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	crawler "github.com/dovys/monzo-crawler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffResults(t *testing.T) {
+	before := map[string]*pageResult{
+		"https://monzo.com/":      {URL: "https://monzo.com/", Status: 200, Links: []string{"https://monzo.com/about", "https://monzo.com/blog"}, Assets: []string{"https://monzo.com/logo.png"}},
+		"https://monzo.com/about": {URL: "https://monzo.com/about", Status: 200},
+		"https://monzo.com/blog":  {URL: "https://monzo.com/blog", Status: 200},
+	}
+	after := map[string]*pageResult{
+		"https://monzo.com/":      {URL: "https://monzo.com/", Status: 200, Links: []string{"https://monzo.com/about", "https://monzo.com/jobs"}, Assets: []string{"https://monzo.com/logo.svg"}},
+		"https://monzo.com/about": {URL: "https://monzo.com/about", Status: 404},
+		"https://monzo.com/jobs":  {URL: "https://monzo.com/jobs", Status: 200},
+	}
+
+	r := diffResults(before, after)
+
+	assert.Equal(t, []string{"https://monzo.com/jobs"}, r.Added)
+	assert.Equal(t, []string{"https://monzo.com/blog"}, r.Removed)
+	assert.Equal(t, []crawler.StatusChange{{URL: "https://monzo.com/about", From: 200, To: 404}}, r.StatusChanged)
+	assert.Equal(t, []crawler.LinkChange{{
+		URL:     "https://monzo.com/",
+		Added:   []string{"https://monzo.com/jobs"},
+		Removed: []string{"https://monzo.com/blog"},
+	}}, r.Links)
+	assert.Equal(t, []crawler.LinkChange{{
+		URL:     "https://monzo.com/",
+		Added:   []string{"https://monzo.com/logo.svg"},
+		Removed: []string{"https://monzo.com/logo.png"},
+	}}, r.Assets)
+	assert.False(t, r.empty())
+
+	b := &bytes.Buffer{}
+	require.NoError(t, r.WriteText(b))
+	assert.Equal(t, `1 added, 1 removed, 1 status changes, 1 pages with changed links, 1 pages with changed assets
++ https://monzo.com/jobs
+- https://monzo.com/blog
+~ https://monzo.com/about 200 -> 404
+~ https://monzo.com/ links
+    + https://monzo.com/jobs
+    - https://monzo.com/blog
+~ https://monzo.com/ assets
+    + https://monzo.com/logo.svg
+    - https://monzo.com/logo.png
+`, b.String())
+
+	assert.True(t, diffResults(after, after).empty())
+}
+
+func TestDiffIgnoringHostsKeepsExternalHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	staging := filepath.Join(dir, "staging.ndjson")
+	production := filepath.Join(dir, "production.ndjson")
+	require.NoError(t, ioutil.WriteFile(staging, []byte(
+		`{"url":"https://staging.monzo.com","links":["https://staging.monzo.com/about","https://twitter.com/about"],"assets":[]}`+"\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(production, []byte(
+		`{"url":"https://monzo.com/","links":["https://monzo.com/about","https://facebook.com/about"],"assets":[]}`+"\n"), 0644))
+
+	before, err := readResults(staging, true)
+	require.NoError(t, err)
+	after, err := readResults(production, true)
+	require.NoError(t, err)
+
+	require.Contains(t, before, "/")
+	assert.Equal(t, []string{"/about", "https://twitter.com/about"}, before["/"].Links)
+	assert.Equal(t, 200, before["/"].Status)
+
+	r := diffResults(before, after)
+	assert.Empty(t, r.Added)
+	assert.Empty(t, r.Removed)
+	assert.Equal(t, []crawler.LinkChange{{
+		URL:     "/",
+		Added:   []string{"https://facebook.com/about"},
+		Removed: []string{"https://twitter.com/about"},
+	}}, r.Links)
+}
+
+func TestDecodeResultsReadsArrays(t *testing.T) {
+	var urls []string
+	err := decodeResults(bytes.NewBufferString(` [{"url":"https://monzo.com/"},{"url":"https://monzo.com/about"}]`), func(p *pageResult) error {
+		urls = append(urls, p.URL)
+		return nil
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://monzo.com/", "https://monzo.com/about"}, urls)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"io"
+	"sync"
+	"time"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+type errorRecord struct {
+	Time     time.Time `json:"time"`
+	URL      string    `json:"url,omitempty"`
+	Referrer string    `json:"referrer,omitempty"`
+	Depth    int       `json:"depth"`
+	Phase    string    `json:"phase,omitempty"`
+	Attempt  int       `json:"attempt,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error"`
+}
+
+// errorLog writes crawl errors as JSON lines.
+type errorLog struct {
+	mu sync.Mutex
+	e  *json.Encoder
+}
+
+func newErrorLog(w io.Writer) *errorLog {
+	return &errorLog{e: json.NewEncoder(w)}
+}
+
+func (l *errorLog) Write(err error) error {
+	r := errorRecord{Time: time.Now().UTC(), Error: err.Error()}
+
+	var crawlErr *crawler.CrawlError
+	if stderrors.As(err, &crawlErr) {
+		r.Phase, r.Depth, r.Attempt = string(crawlErr.Phase), crawlErr.Depth, crawlErr.Attempt
+		r.Error = crawlErr.Err.Error()
+
+		if crawlErr.URL != nil {
+			r.URL = crawlErr.URL.String()
+		}
+
+		if crawlErr.Referrer != nil {
+			r.Referrer = crawlErr.Referrer.String()
+		}
+	}
+
+	var httpErr *crawler.HTTPError
+	if stderrors.As(err, &httpErr) {
+		r.Status = httpErr.StatusCode
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.e.Encode(r)
+}
@@ -1,118 +1,121 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
-	"encoding/json"
 	"fmt"
-	"log"
-	"net/http"
-	"net/url"
+	"io"
 	"os"
-	"time"
-
-	"github.com/kelseyhightower/envconfig"
-	"github.com/pkg/errors"
-
-	crawler "github.com/dovys/monzo-crawler"
+	"strings"
 )
 
-type Config struct {
-	HTTPTimeout        time.Duration `envconfig:"http_timeout" default:"10s"`
-	Concurrency        int           `envconfig:"concurrency" default:"5"`
-	ResultBufferLength int           `envconfig:"result_buffer" default:"100"`
-	MaxQueueLength     int           `envconfig:"queue_length" default:"1000000"`
-}
-
 type pageResult struct {
-	URL    string   `json:"url"`
-	Links  []string `json:"links"`
-	Assets []string `json:"assets"`
+	URL         string   `json:"url"`
+	Status      int      `json:"status,omitempty"`
+	Links       []string `json:"links"`
+	Assets      []string `json:"assets"`
+	DuplicateOf string   `json:"duplicate_of,omitempty"`
 }
 
-func main() {
-	var cfg Config
-	envconfig.MustProcess("", &cfg)
+type command struct {
+	name    string
+	summary string
+	// Arguments and description shown by -help
+	args string
+	help string
+	// Defines the command's flags and returns the function running it once
+	// they're parsed, which returns the exit status
+	setup func(s *settings) func() int
+}
 
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: %s <url>\n", os.Args[0])
-		os.Exit(1)
-	}
+var commands = []command{
+	{"crawl", "Crawl sites and write the pages found as JSON",
+		"[flags] <url>...",
+		"Crawls the sites of the seed urls and writes every page found as JSON.",
+		crawlCommand},
+	{"check", "Crawl sites and report broken links",
+		"[flags] <url>...",
+		"Crawls the sites of the seed urls and lists the pages which couldn't be fetched\nalong with the pages linking to them. Exits with 1 when any were found.",
+		checkCommand},
+	{"sitemap", "Crawl sites and write a sitemap",
+		"[flags] <url>...",
+		"Crawls the sites of the seed urls and writes the pages found as a sitemap.",
+		sitemapCommand},
+	{"mirror", "Save sites with their assets for offline browsing",
+		"[flags] <dir> <url>...",
+		"Crawls the sites of the seed urls and saves their pages and assets under dir with\nlinks rewritten for offline browsing. An existing mirror is refreshed: pages which\nchanged are saved again and missing assets are fetched, assets already saved are kept.",
+		mirrorCommand},
+	{"serve", "Serve a mirror over HTTP",
+		"[flags] <dir>",
+		"Serves a mirror saved by the mirror command over HTTP. Sites are in directories\nnamed after their host.",
+		serveCommand},
+	{"diff", "Compare the results of two crawls",
+		"[flags] <before.json> <after.json>",
+		"Compares the results of two crawls and exits with 1 when they differ, like diff(1).",
+		diffCommand},
+	{"query", "Query the tables recorded by crawl -store",
+		"[flags] <query>",
+		"Queries the tables recorded by crawl -store, see the examples below.",
+		queryCommand},
+	{"report", "Write an HTML report of the crawl recorded by crawl -store",
+		"[flags]",
+		"Writes a self-contained HTML report of the crawl recorded by crawl -store.",
+		reportCommand},
+}
 
-	uri, err := url.Parse(os.Args[1])
-	if err != nil {
-		fmt.Println(errors.Wrap(err, "Invalid url"))
-		os.Exit(1)
-	}
+// run parses the command's flags and runs it. Invalid settings exit with 2.
+func (c command) run(args []string) int {
+	s := newSettings(c.name, c.args, c.help)
+	run := c.setup(s)
 
-	if uri.Scheme != "https" && uri.Scheme != "http" {
-		fmt.Println("Supported schemes: http, https.")
-		os.Exit(1)
+	if err := s.parse(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
 	}
 
-	h := &http.Client{
-		Timeout: cfg.HTTPTimeout,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// Preventing redirects to a different host
-			for _, v := range via {
-				if req.URL.Host != v.URL.Host {
-					return http.ErrUseLastResponse
-				}
-			}
+	return run()
+}
 
-			return nil
-		},
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
 	}
 
-	c := crawler.NewCrawler(
-		crawler.NewParser(),
-		crawler.NewFetcher(h),
-		crawler.NewUniqueSet(),
-
-		crawler.Concurrency(cfg.Concurrency),
-		crawler.ResultBufferLength(cfg.ResultBufferLength),
-		crawler.MaxQueueLength(cfg.MaxQueueLength),
-	)
-
-	c.Enqueue(uri)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	pages, errors := c.Run(ctx)
-	go func() {
-		logger := log.New(os.Stderr, "", log.LstdFlags)
-		for err := range errors {
-			if err == crawler.ErrTooManyRequests {
-				logger.Println("Stopping due to too many requests")
-				cancel()
-			}
-
-			logger.Println(err)
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		if name == "help" && len(args) > 0 {
+			name, args = args[0], []string{"-help"}
+			break
 		}
-	}()
 
-	e := json.NewEncoder(os.Stdout)
-	e.SetIndent("", "  ")
+		usage(os.Stdout)
+		os.Exit(0)
+	}
 
-	for page := range pages {
-		p := pageResult{
-			URL:    page.String(),
-			Links:  make([]string, len(page.Links)),
-			Assets: make([]string, len(page.Assets)),
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(c.run(args))
 		}
+	}
 
-		for i := 0; i < len(page.Links); i++ {
-			p.Links[i] = page.Links[i].String()
-		}
+	// Crawling without naming the command, which is how the crawler used to be run
+	if strings.HasPrefix(name, "-") || strings.Contains(name, "://") {
+		os.Exit(commands[0].run(os.Args[1:]))
+	}
 
-		for i := 0; i < len(page.Assets); i++ {
-			p.Assets[i] = page.Assets[i].String()
-		}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
 
-		e.Encode(p)
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8s  %s\n", c.name, c.summary)
 	}
+
+	fmt.Fprintf(w, "\nRun %s <command> -help for the flags of a command. Every flag can also be\n", os.Args[0])
+	fmt.Fprintln(w, "set with the environment variable named after it, e.g. $HTTP_TIMEOUT, or in the")
+	fmt.Fprintln(w, "-config file. Flags take precedence over environment variables, which take")
+	fmt.Fprintln(w, "precedence over the -config file.")
 }
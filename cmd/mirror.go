@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+// mirrorCommand saves the pages found with their assets.
+func mirrorCommand(s *settings) func() int {
+	o := &crawlOptions{}
+	o.register(s)
+
+	return func() int {
+		if s.fs.NArg() < 1 {
+			s.fs.Usage()
+			return 1
+		}
+
+		o.mirrorDir = s.fs.Arg(0)
+		seeds, ok := o.seeds(s, s.fs.Args()[1:])
+		if !ok {
+			return 1
+		}
+
+		return o.crawl(seeds, discardResults{})
+	}
+}
+
+// discardResults is for commands which only care about the side effects of the crawl.
+type discardResults struct{}
+
+func (discardResults) Page(page *crawler.Page, p *pageResult) error { return nil }
+func (discardResults) Error(err error) error                        { return nil }
+func (discardResults) Done() int                                    { return 0 }
+
+// serveCommand serves a mirror over HTTP.
+func serveCommand(s *settings) func() int {
+	addr := s.fs.String("addr", "localhost:8080", "Listen on `addr`")
+
+	return func() int {
+		if s.fs.NArg() != 1 {
+			s.fs.Usage()
+			return 1
+		}
+
+		dir := s.fs.Arg(0)
+		if _, err := os.Stat(dir); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		fmt.Fprintf(os.Stderr, "Serving %s on http://%s/\n", dir, *addr)
+		if err := http.ListenAndServe(*addr, http.FileServer(http.Dir(dir))); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		return 0
+	}
+}
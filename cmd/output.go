@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// resultWriter writes a stream of results in one of the output formats.
+// Close finishes the stream, e.g. closes the JSON array, without closing the
+// underlying writer.
+type resultWriter interface {
+	Write(p *pageResult) error
+	Close() error
+}
+
+type outputFormat struct {
+	ext string
+	new func(w io.Writer) resultWriter
+}
+
+var outputFormats = map[string]outputFormat{
+	"ndjson":    {".ndjson", newNDJSONWriter},
+	"json":      {".json", newJSONArrayWriter},
+	"csv":       {".csv", newCSVPageWriter},
+	"csv-links": {".csv", newCSVLinkWriter},
+	"columnar":  {".col", newColumnarWriter},
+}
+
+func outputFormatNames() string {
+	names := make([]string, 0, len(outputFormats))
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// ndjsonWriter writes a compact JSON object per line.
+type ndjsonWriter struct {
+	e *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) resultWriter {
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+
+	return &ndjsonWriter{e: e}
+}
+
+func (w *ndjsonWriter) Write(p *pageResult) error {
+	return w.e.Encode(p)
+}
+
+func (w *ndjsonWriter) Close() error {
+	return nil
+}
+
+// jsonArrayWriter writes a single JSON array with an element per line.
+type jsonArrayWriter struct {
+	w io.Writer
+	n int
+}
+
+func newJSONArrayWriter(w io.Writer) resultWriter {
+	return &jsonArrayWriter{w: w}
+}
+
+func (w *jsonArrayWriter) Write(p *pageResult) error {
+	b, err := marshalResult(p)
+	if err != nil {
+		return err
+	}
+
+	sep := ",\n"
+	if w.n == 0 {
+		sep = "[\n"
+	}
+	w.n++
+
+	_, err = io.WriteString(w.w, sep+b)
+
+	return err
+}
+
+func (w *jsonArrayWriter) Close() error {
+	end := "\n]\n"
+	if w.n == 0 {
+		end = "[]\n"
+	}
+
+	_, err := io.WriteString(w.w, end)
+
+	return err
+}
+
+func marshalResult(p *pageResult) (string, error) {
+	var b strings.Builder
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(p); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// csvPageWriter writes a row per page with the number of its links and assets.
+type csvPageWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func newCSVPageWriter(w io.Writer) resultWriter {
+	return &csvPageWriter{w: csv.NewWriter(w)}
+}
+
+func (w *csvPageWriter) Write(p *pageResult) error {
+	if !w.header {
+		w.header = true
+		if err := w.w.Write([]string{"url", "status", "links", "assets", "duplicate_of"}); err != nil {
+			return err
+		}
+	}
+
+	w.w.Write([]string{
+		p.URL,
+		strconv.Itoa(p.Status),
+		strconv.Itoa(len(p.Links)),
+		strconv.Itoa(len(p.Assets)),
+		p.DuplicateOf,
+	})
+
+	// Flushing every row so that the size of the output is known for rotation
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+func (w *csvPageWriter) Close() error {
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+// csvLinkWriter writes a row per link and asset of a page, i.e. the edges of
+// the site's graph.
+type csvLinkWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func newCSVLinkWriter(w io.Writer) resultWriter {
+	return &csvLinkWriter{w: csv.NewWriter(w)}
+}
+
+func (w *csvLinkWriter) Write(p *pageResult) error {
+	if !w.header {
+		w.header = true
+		if err := w.w.Write([]string{"from", "to", "type"}); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range p.Links {
+		if err := w.w.Write([]string{p.URL, l, "link"}); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range p.Assets {
+		if err := w.w.Write([]string{p.URL, a, "asset"}); err != nil {
+			return err
+		}
+	}
+
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+func (w *csvLinkWriter) Close() error {
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+// fileOutput writes results to a file. When maxSize isn't zero a new file is
+// started once that many bytes were written to the current one and the files
+// are numbered, e.g. results.ndjson becomes results-00000.ndjson,
+// results-00001.ndjson and so on. Every file is complete on its own.
+// Columnar files can only be rotated between row groups.
+type fileOutput struct {
+	path    string
+	format  outputFormat
+	maxSize int64
+
+	part int
+	f    *os.File
+	buf  *bufio.Writer
+	n    *byteCounter
+	w    resultWriter
+}
+
+func newFileOutput(path string, format outputFormat, maxSize int64) *fileOutput {
+	return &fileOutput{path: path, format: format, maxSize: maxSize}
+}
+
+func (o *fileOutput) Write(p *pageResult) error {
+	if o.w == nil {
+		if err := o.open(); err != nil {
+			return err
+		}
+	}
+
+	if err := o.w.Write(p); err != nil {
+		return err
+	}
+
+	// The next result goes to a new file
+	if o.maxSize > 0 && o.n.n >= o.maxSize {
+		return o.close()
+	}
+
+	return nil
+}
+
+func (o *fileOutput) open() error {
+	path := o.path
+	if o.maxSize > 0 {
+		ext := filepath.Ext(path)
+		path = fmt.Sprintf("%s-%05d%s", strings.TrimSuffix(path, ext), o.part, ext)
+		o.part++
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	o.f, o.buf = f, bufio.NewWriter(f)
+	o.n = &byteCounter{w: o.buf}
+	o.w = o.format.new(o.n)
+
+	return nil
+}
+
+func (o *fileOutput) close() error {
+	err := o.w.Close()
+	if flushErr := o.buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := o.f.Close(); err == nil {
+		err = closeErr
+	}
+
+	o.f, o.buf, o.n, o.w = nil, nil, nil, nil
+
+	return err
+}
+
+// Close finishes the current file, creating it when nothing was written so
+// that the output is never missing.
+func (o *fileOutput) Close() error {
+	if o.w == nil {
+		if o.part > 0 {
+			return nil
+		}
+
+		if err := o.open(); err != nil {
+			return err
+		}
+	}
+
+	return o.close()
+}
+
+type byteCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testResults(n int) []*pageResult {
+	results := make([]*pageResult, n)
+	for i := range results {
+		results[i] = &pageResult{
+			URL:    fmt.Sprintf("https://monzo.com/%d", i),
+			Status: 200,
+			Links:  []string{"https://monzo.com/", fmt.Sprintf("https://monzo.com/%d", i+1)},
+			Assets: []string{"https://monzo.com/logo.png"},
+		}
+	}
+
+	if n > 1 {
+		results[1].Status = 404
+		results[1].Links, results[1].Assets = []string{}, []string{}
+	}
+	if n > 2 {
+		results[2].DuplicateOf = results[0].URL
+	}
+
+	return results
+}
+
+func readResultFile(t *testing.T, path string) []*pageResult {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var results []*pageResult
+	add := func(p *pageResult) error {
+		results = append(results, p)
+		return nil
+	}
+
+	if isColumnar(f) {
+		fi, err := f.Stat()
+		require.NoError(t, err)
+		require.NoError(t, readColumnar(f, fi.Size(), add))
+	} else {
+		require.NoError(t, decodeResults(f, add))
+	}
+
+	return results
+}
+
+func TestOutputFormatsRoundTrip(t *testing.T) {
+	tests := []struct {
+		format string
+		rows   int
+	}{
+		{"ndjson", 3},
+		{"json", 3},
+		{"columnar", 3},
+		{"columnar", columnarRowGroupSize},
+		{"columnar", 2*columnarRowGroupSize + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d rows", tt.format, tt.rows), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "output")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			expected := testResults(tt.rows)
+			path := filepath.Join(dir, "results"+outputFormats[tt.format].ext)
+
+			o := newFileOutput(path, outputFormats[tt.format], 0)
+			for _, p := range expected {
+				require.NoError(t, o.Write(p))
+			}
+			require.NoError(t, o.Close())
+
+			assert.Equal(t, expected, readResultFile(t, path))
+		})
+	}
+}
+
+func TestEmptyOutputsCanBeRead(t *testing.T) {
+	for _, format := range []string{"ndjson", "json", "columnar"} {
+		t.Run(format, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "output")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "results"+outputFormats[format].ext)
+			require.NoError(t, newFileOutput(path, outputFormats[format], 0).Close())
+
+			assert.Empty(t, readResultFile(t, path))
+		})
+	}
+}
+
+func TestColumnarWriterStartsARowGroupEveryRowGroupSize(t *testing.T) {
+	b := &bytes.Buffer{}
+	w := newColumnarWriter(b).(*columnarWriter)
+
+	for _, p := range testResults(columnarRowGroupSize) {
+		require.NoError(t, w.Write(p))
+	}
+	assert.Len(t, w.footer.RowGroups, 1)
+
+	for _, p := range testResults(columnarRowGroupSize + 1) {
+		require.NoError(t, w.Write(p))
+	}
+	require.NoError(t, w.Close())
+
+	require.Len(t, w.footer.RowGroups, 3)
+	assert.Equal(t, columnarRowGroupSize, w.footer.RowGroups[0].Rows)
+	assert.Equal(t, columnarRowGroupSize, w.footer.RowGroups[1].Rows)
+	assert.Equal(t, 1, w.footer.RowGroups[2].Rows)
+}
+
+func TestJSONArrayWriter(t *testing.T) {
+	b := &bytes.Buffer{}
+	w := newJSONArrayWriter(b)
+	require.NoError(t, w.Close())
+	assert.Equal(t, "[]\n", b.String())
+
+	b.Reset()
+	w = newJSONArrayWriter(b)
+	require.NoError(t, w.Write(&pageResult{URL: "https://monzo.com/?a=1&b=2", Links: []string{"https://monzo.com/about"}, Assets: []string{}}))
+	require.NoError(t, w.Write(&pageResult{URL: "https://monzo.com/about", Status: 404, Links: []string{}, Assets: []string{}}))
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, `[
+{"url":"https://monzo.com/?a=1&b=2","links":["https://monzo.com/about"],"assets":[]},
+{"url":"https://monzo.com/about","status":404,"links":[],"assets":[]}
+]
+`, b.String())
+}
+
+func TestCSVWriters(t *testing.T) {
+	results := []*pageResult{
+		{URL: "https://monzo.com/", Links: []string{"https://monzo.com/about", "https://monzo.com/a,b"}, Assets: []string{"https://monzo.com/logo.png"}},
+		{URL: "https://monzo.com/about", Status: 404},
+		{URL: "https://monzo.com/copy", Links: []string{"https://monzo.com/about"}, DuplicateOf: "https://monzo.com/"},
+	}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"csv", `url,status,links,assets,duplicate_of
+https://monzo.com/,0,2,1,
+https://monzo.com/about,404,0,0,
+https://monzo.com/copy,0,1,0,https://monzo.com/
+`},
+		{"csv-links", `from,to,type
+https://monzo.com/,https://monzo.com/about,link
+https://monzo.com/,"https://monzo.com/a,b",link
+https://monzo.com/,https://monzo.com/logo.png,asset
+https://monzo.com/copy,https://monzo.com/about,link
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			w := outputFormats[tt.format].new(b)
+			for _, p := range results {
+				require.NoError(t, w.Write(p))
+			}
+			require.NoError(t, w.Close())
+
+			assert.Equal(t, tt.expected, b.String())
+		})
+	}
+}
+
+func TestFileOutputRotation(t *testing.T) {
+	// Size of the first results written as ndjson
+	size := func(n int) int64 {
+		var size int64
+		for _, p := range testResults(n) {
+			b, err := marshalResult(p)
+			require.NoError(t, err)
+			size += int64(len(b) + 1)
+		}
+
+		return size
+	}
+
+	tests := []struct {
+		name    string
+		format  string
+		maxSize int64
+		rows    int
+		// Rows in each file
+		expected []int
+	}{
+		{"below the size", "ndjson", size(3) + 1, 3, []int{3}},
+		{"reaching the size exactly", "ndjson", size(2), 5, []int{2, 2, 1}},
+		{"past the size", "ndjson", size(2) + 1, 5, []int{3, 2}},
+		{"every result", "json", 1, 3, []int{1, 1, 1}},
+		{"nothing written", "ndjson", 1, 0, []int{0}},
+		{"between row groups", "columnar", 1, columnarRowGroupSize + 1, []int{columnarRowGroupSize, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "output")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			format := outputFormats[tt.format]
+			results := testResults(tt.rows)
+			o := newFileOutput(filepath.Join(dir, "results"+format.ext), format, tt.maxSize)
+			for _, p := range results {
+				require.NoError(t, o.Write(p))
+			}
+			require.NoError(t, o.Close())
+
+			files, err := filepath.Glob(filepath.Join(dir, "*"))
+			require.NoError(t, err)
+			require.Len(t, files, len(tt.expected))
+
+			var read []*pageResult
+			for i, rows := range tt.expected {
+				path := filepath.Join(dir, fmt.Sprintf("results-%05d%s", i, format.ext))
+				require.Equal(t, path, files[i])
+
+				part := readResultFile(t, path)
+				assert.Len(t, part, rows, path)
+				read = append(read, part...)
+			}
+
+			if tt.rows > 0 {
+				assert.Equal(t, results, read)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+// clearLine moves the cursor to the start of the line and erases it.
+const clearLine = "\r\033[K"
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progress redraws a single status line with the crawl's stats. Everything else
+// written to the terminal should go through it so log lines don't get mixed
+// up with the status line.
+type progress struct {
+	mu   sync.Mutex
+	w    io.Writer
+	c    crawler.Crawler
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newProgress(w io.Writer, c crawler.Crawler) *progress {
+	return &progress{w: w, c: c, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (p *progress) Start(interval time.Duration) {
+	go func() {
+		defer close(p.done)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				p.draw()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop clears the status line.
+func (p *progress) Stop() {
+	close(p.stop)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprint(p.w, clearLine)
+}
+
+// Write clears the status line before writing, it's redrawn on the next tick.
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprint(p.w, clearLine)
+
+	return p.w.Write(b)
+}
+
+func (p *progress) draw() {
+	line := formatStats(p.c.Stats())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprint(p.w, clearLine+line)
+}
+
+func formatStats(s crawler.Stats) string {
+	return fmt.Sprintf(
+		"queued %d | in-flight %d | crawled %d (%.1f/s) | failed %d | skipped %d | %s | p50 %s p99 %s",
+		s.Queued,
+		s.InFlight,
+		s.Crawled,
+		s.PagesPerSecond,
+		s.Failed,
+		s.Skipped,
+		formatBytes(s.Bytes),
+		s.Latency.P50.Round(time.Millisecond),
+		s.Latency.P99.Round(time.Millisecond),
+	)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+const queryExamples = `Examples:
+  pages where status = 404 and linked_from(depth <= 2)
+  select url, depth from pages where title is empty order by depth
+  select count(*) from errors where phase = 'fetch'
+  select url, inlinks from pages order by inlinks desc limit 10
+`
+
+// queryCommand queries the tables recorded by crawling with -store.
+func queryCommand(s *settings) func() int {
+	dir := s.fs.String("store", "", "Read the tables from `dir`")
+	asJSON := s.fs.Bool("json", false, "Write the rows as JSON lines")
+
+	usage := s.fs.Usage
+	s.fs.Usage = func() {
+		usage()
+
+		fmt.Fprintln(os.Stderr, "\nTables:")
+		for _, t := range crawler.StoreSchema() {
+			fmt.Fprintf(os.Stderr, "  %-9s  %s\n", t.Name, strings.Join(t.Columns, ", "))
+		}
+		fmt.Fprint(os.Stderr, "\n"+queryExamples)
+	}
+
+	return func() int {
+		// Quoting the query is optional
+		q := strings.Join(s.fs.Args(), " ")
+		if *dir == "" || q == "" {
+			s.fs.Usage()
+			return 2
+		}
+
+		tables, err := crawler.ReadStore(*dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		r, err := tables.Query(q)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		if *asJSON {
+			err = writeRowsJSON(r)
+		} else {
+			err = writeRowsText(r)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		return 0
+	}
+}
+
+func writeRowsJSON(r *crawler.QueryResult) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetEscapeHTML(false)
+
+	for _, row := range r.Rows {
+		o := make(map[string]interface{}, len(row))
+		for i, c := range r.Columns {
+			o[c] = row[i]
+		}
+
+		if err := e.Encode(o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeRowsText(r *crawler.QueryResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(r.Columns, "\t")))
+
+	for _, row := range r.Rows {
+		values := make([]string, len(row))
+		for i, v := range row {
+			switch v := v.(type) {
+			case float64:
+				values[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				values[i] = fmt.Sprint(v)
+			}
+		}
+
+		fmt.Fprintln(w, strings.Join(values, "\t"))
+	}
+
+	return w.Flush()
+}
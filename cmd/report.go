@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+// reportCommand writes an HTML report of the crawl recorded by crawl -store.
+func reportCommand(s *settings) func() int {
+	dir := s.fs.String("store", "", "Read the crawl from `dir`")
+	out := s.fs.String("o", "-", "Write the report to `file`, - for stdout")
+	assetSizes := s.fs.Bool("asset-sizes", false, "Measure the size of every asset with a HEAD request, the crawl doesn't download them")
+	concurrency := s.fs.Int("asset-concurrency", 8, "Assets measured at the same time")
+	timeout := s.fs.Duration("asset-timeout", 10*time.Second, "Give up measuring an asset after `duration`")
+
+	return func() int {
+		if *dir == "" || s.fs.NArg() > 0 {
+			s.fs.Usage()
+			return 2
+		}
+
+		tables, err := crawler.ReadStore(*dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		var sizes map[string]int64
+		if *assetSizes {
+			r, err := tables.Query("select url from assets")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+
+			urls := make(map[string]bool)
+			for _, row := range r.Rows {
+				urls[row[0].(string)] = true
+			}
+
+			sizes = measureAssets(urls, *concurrency, *timeout)
+		}
+
+		report := crawler.NewCrawlReport(tables, sizes)
+		if err := writeReport(*out, report); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to write the report:", err)
+			return 1
+		}
+
+		return 0
+	}
+}
+
+// measureAssets returns the Content-Length of the assets, leaving out those
+// which failed or didn't say.
+func measureAssets(urls map[string]bool, concurrency int, timeout time.Duration) map[string]int64 {
+	h := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	queue := make(chan string)
+	sizes := make(map[string]int64)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for u := range queue {
+				resp, err := h.Head(u)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Failed to measure", u+":", err)
+					continue
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+					continue
+				}
+
+				mu.Lock()
+				sizes[u] = resp.ContentLength
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for u := range urls {
+		queue <- u
+	}
+	close(queue)
+	wg.Wait()
+
+	return sizes
+}
+
+func writeReport(path string, r *crawler.CrawlReport) error {
+	if path == "-" {
+		return r.WriteHTML(os.Stdout)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := r.WriteHTML(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+// Search engines ignore the urls of a sitemap beyond this
+const maxSitemapURLs = 50000
+
+// sitemapCommand writes the pages found as a sitemap.
+func sitemapCommand(s *settings) func() int {
+	o := &crawlOptions{}
+	o.register(s)
+	out := s.fs.String("o", "-", "Write the sitemap to `file`, - for stdout")
+
+	return func() int {
+		seeds, ok := o.seeds(s, s.fs.Args())
+		if !ok {
+			return 1
+		}
+
+		return o.crawl(seeds, &sitemap{path: *out, urls: make(map[string]bool)})
+	}
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+// sitemap collects the pages which were crawled, leaving out duplicates when
+// they're detected.
+type sitemap struct {
+	path string
+
+	mu   sync.Mutex
+	urls map[string]bool
+}
+
+func (s *sitemap) Page(page *crawler.Page, p *pageResult) error {
+	if page.Duplicate != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.urls[crawler.CanonicalURL(&page.URL)] = true
+
+	return nil
+}
+
+func (s *sitemap) Error(err error) error {
+	return nil
+}
+
+func (s *sitemap) Done() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.urls) > maxSitemapURLs {
+		fmt.Fprintf(os.Stderr, "The sitemap has %d urls, more than the %d search engines read\n", len(s.urls), maxSitemapURLs)
+	}
+
+	var w io.Writer = os.Stdout
+	if s.path != "-" {
+		f, err := os.Create(s.path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := s.write(w); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write the sitemap:", err)
+		return 1
+	}
+
+	return 0
+}
+
+func (s *sitemap) write(w io.Writer) error {
+	set := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for u := range s.urls {
+		set.URLs = append(set.URLs, sitemapURL{Loc: u})
+	}
+	sort.Slice(set.URLs, func(i, j int) bool {
+		return set.URLs[i].Loc < set.URLs[j].Loc
+	})
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(set); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+
+	return err
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	crawler "github.com/dovys/monzo-crawler"
+)
+
+// readSeeds parses seed urls from the arguments and, when path is set, from
+// a file with one url per line. A path of "-" reads from stdin.
+func readSeeds(args []string, path string) ([]*url.URL, error) {
+	raw := append([]string(nil), args...)
+
+	if path != "" {
+		var r io.Reader = os.Stdin
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				raw = append(raw, line)
+			}
+		}
+
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	seeds := make([]*url.URL, 0, len(raw))
+	for _, r := range raw {
+		u, err := url.Parse(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid url")
+		}
+
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return nil, fmt.Errorf("Invalid url %s, supported schemes: http, https.", r)
+		}
+
+		seeds = append(seeds, u)
+	}
+
+	return seeds, nil
+}
+
+// siteStats counts the results of a single site, which is defined by the
+// host of a seed url.
+type siteStats struct {
+	Pages      int `json:"pages"`
+	Links      int `json:"links"`
+	Assets     int `json:"assets"`
+	Duplicates int `json:"duplicates"`
+	Errors     int `json:"errors"`
+}
+
+type sitesSummary map[string]*siteStats
+
+func (s sitesSummary) site(host string) *siteStats {
+	if _, ok := s[host]; !ok {
+		s[host] = &siteStats{}
+	}
+
+	return s[host]
+}
+
+func (s sitesSummary) Print(w io.Writer) {
+	hosts := make([]string, 0, len(s))
+	for h := range s {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	for _, h := range hosts {
+		st := s[h]
+		fmt.Fprintf(w, "%s: %d pages, %d links, %d assets, %d duplicates, %d errors\n",
+			h, st.Pages, st.Links, st.Assets, st.Duplicates, st.Errors)
+	}
+}
+
+// errorSite returns the site of the url an error is about when it's known.
+func errorSite(err error) string {
+	var e *crawler.CrawlError
+	if stderrors.As(err, &e) && e.URL != nil {
+		return e.Site
+	}
+
+	return ""
+}
+
+// failedResult turns a fetch which failed with an HTTP error into a result
+// for the site the url belongs to.
+func failedResult(err error) (string, *pageResult) {
+	var crawlErr *crawler.CrawlError
+	var httpErr *crawler.HTTPError
+	if !stderrors.As(err, &crawlErr) || crawlErr.Phase != crawler.PhaseFetch || !stderrors.As(err, &httpErr) {
+		return "", nil
+	}
+
+	return crawlErr.Site, &pageResult{
+		URL:    crawlErr.URL.String(),
+		Status: httpErr.StatusCode,
+		Links:  []string{},
+		Assets: []string{},
+	}
+}
+
+var errOutputClosed = stderrors.New("Output closed")
+
+// partitionedOutput writes each site's results to its own file in dir, or
+// everything to path, or to stdout when neither is set. It's safe for
+// concurrent use.
+type partitionedOutput struct {
+	dir     string
+	path    string
+	format  outputFormat
+	maxSize int64
+
+	mu      sync.Mutex
+	writers map[string]resultWriter
+	closed  bool
+}
+
+func newPartitionedOutput(dir, path, format string, maxSize int64) (*partitionedOutput, error) {
+	f, ok := outputFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown output format %q, supported formats: %s", format, outputFormatNames())
+	}
+
+	if maxSize > 0 && dir == "" && path == "" {
+		return nil, fmt.Errorf("Only output to files can be rotated")
+	}
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &partitionedOutput{
+		dir:     dir,
+		path:    path,
+		format:  f,
+		maxSize: maxSize,
+		writers: make(map[string]resultWriter),
+	}, nil
+}
+
+func (o *partitionedOutput) Write(site string, p *pageResult) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return errOutputClosed
+	}
+
+	return o.writer(site).Write(p)
+}
+
+func (o *partitionedOutput) writer(site string) resultWriter {
+	if o.dir == "" {
+		site = ""
+	}
+
+	w, ok := o.writers[site]
+	if !ok {
+		switch {
+		case o.dir != "":
+			w = newFileOutput(filepath.Join(o.dir, sanitizeFileName(site)+o.format.ext), o.format, o.maxSize)
+		case o.path != "":
+			w = newFileOutput(o.path, o.format, o.maxSize)
+		default:
+			w = o.format.new(os.Stdout)
+		}
+
+		o.writers[site] = w
+	}
+
+	return w
+}
+
+// Close finishes the output. A single output is written even when there
+// were no results, e.g. as an empty JSON array. Closing it again does nothing.
+func (o *partitionedOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+
+	if o.dir == "" && len(o.writers) == 0 {
+		o.writer("")
+	}
+
+	var firstErr error
+	for _, w := range o.writers {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == os.PathSeparator {
+			return '_'
+		}
+
+		return r
+	}, s)
+}
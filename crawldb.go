@@ -0,0 +1,409 @@
+package crawler
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PageRecord is what the crawl database remembers about a url.
+type PageRecord struct {
+	URL string `json:"url"`
+	// Zero when the fetch failed without a response
+	Status  int       `json:"status"`
+	Hash    string    `json:"hash,omitempty"`
+	Title   string    `json:"title,omitempty"`
+	Links   []string  `json:"links,omitempty"`
+	Crawled time.Time `json:"crawled"`
+}
+
+// CrawlDB keeps the pages of the previous run of a crawl to report what changed
+// in the current one. Register it with RegisterHooks to record the current
+// run, then Save it to make it the previous run of the next crawl. Records are
+// keyed by canonical url so that equivalent urls are compared with each other.
+//
+// An interrupted run is only part of the crawl, so it's kept aside with
+// SaveInterrupted rather than compared, and Resume picks it up again when the
+// crawl is resumed.
+type CrawlDB struct {
+	NoopHooks
+
+	path string
+
+	mu       sync.Mutex
+	previous map[string]*PageRecord
+	current  map[string]*PageRecord
+}
+
+// ErrNoInterruptedRun is returned by Resume when no interrupted run was saved.
+var ErrNoInterruptedRun = errors.New("No interrupted run was saved to resume")
+
+// OpenCrawlDB loads the previous run from path if it exists.
+func OpenCrawlDB(path string) (*CrawlDB, error) {
+	db := &CrawlDB{
+		path:     path,
+		previous: make(map[string]*PageRecord),
+		current:  make(map[string]*PageRecord),
+	}
+
+	err := readRecords(path, db.previous)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Resume restores the pages recorded by the interrupted run saved with
+// SaveInterrupted, so that the resumed run is compared and saved as a whole
+// crawl rather than just the pages it had left.
+func (db *CrawlDB) Resume() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := readRecords(db.interruptedPath(), db.current)
+	if os.IsNotExist(err) {
+		return ErrNoInterruptedRun
+	}
+
+	return err
+}
+
+func readRecords(path string, records map[string]*PageRecord) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d := json.NewDecoder(bufio.NewReader(f))
+	for {
+		r := &PageRecord{}
+		err := d.Decode(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if u, err := url.Parse(r.URL); err == nil {
+			records[CanonicalURL(u)] = r
+		}
+	}
+}
+
+// Previous returns the number of pages recorded by the previous run.
+func (db *CrawlDB) Previous() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return len(db.previous)
+}
+
+func (db *CrawlDB) OnParsed(p *Page) {
+	sum := sha256.Sum256(p.Body)
+	r := &PageRecord{
+		URL:     p.String(),
+		Status:  200,
+		Hash:    hex.EncodeToString(sum[:]),
+		Title:   ExtractTitle(p.Body),
+		Links:   make([]string, len(p.Links)),
+		Crawled: time.Now().UTC(),
+	}
+
+	for i, l := range p.Links {
+		r.Links[i] = CanonicalURL(l)
+	}
+
+	db.record(&p.URL, r)
+}
+
+// OnError records pages which couldn't be fetched.
+func (db *CrawlDB) OnError(err error) {
+	var crawlErr *CrawlError
+	if !errors.As(err, &crawlErr) || crawlErr.Phase != PhaseFetch || crawlErr.URL == nil {
+		return
+	}
+
+	db.record(crawlErr.URL, &PageRecord{
+		URL:     crawlErr.URL.String(),
+		Status:  statusCode(crawlErr.Err),
+		Crawled: time.Now().UTC(),
+	})
+}
+
+func (db *CrawlDB) record(u *url.URL, r *PageRecord) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.current[CanonicalURL(u)] = r
+}
+
+// Save replaces the previous run with the current one, and forgets the
+// interrupted run the current one resumed.
+func (db *CrawlDB) Save() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := writeRecords(db.path, db.current); err != nil {
+		return err
+	}
+
+	err := os.Remove(db.interruptedPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// SaveInterrupted keeps the current run aside until it's resumed, leaving the
+// previous run in place.
+func (db *CrawlDB) SaveInterrupted() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return writeRecords(db.interruptedPath(), db.current)
+}
+
+func (db *CrawlDB) interruptedPath() string {
+	return db.path + ".interrupted"
+}
+
+func writeRecords(path string, records map[string]*PageRecord) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	e := json.NewEncoder(w)
+	for _, k := range sortedKeys(records) {
+		if err := e.Encode(records[k]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// ChangeReport lists the differences between two runs of a crawl.
+type ChangeReport struct {
+	Added         []string       `json:"added"`
+	Removed       []string       `json:"removed"`
+	Changed       []string       `json:"changed"`
+	StatusChanged []StatusChange `json:"status_changed"`
+	Links         []LinkChange   `json:"links"`
+}
+
+type StatusChange struct {
+	URL  string `json:"url"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// LinkChange lists the links added to and removed from a page.
+type LinkChange struct {
+	URL     string   `json:"url"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Changes compares the current run with the previous one. Pages which weren't
+// crawled in the current run are reported as removed, so an interrupted crawl
+// reports everything it didn't get to, see SaveInterrupted.
+func (db *CrawlDB) Changes() *ChangeReport {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return compareRuns(db.previous, db.current)
+}
+
+func compareRuns(previous, current map[string]*PageRecord) *ChangeReport {
+	r := &ChangeReport{
+		Added:         []string{},
+		Removed:       []string{},
+		Changed:       []string{},
+		StatusChanged: []StatusChange{},
+		Links:         []LinkChange{},
+	}
+
+	for _, k := range sortedKeys(current) {
+		cur := current[k]
+		prev, ok := previous[k]
+		if !ok {
+			r.Added = append(r.Added, cur.URL)
+			continue
+		}
+
+		if prev.Status != cur.Status {
+			r.StatusChanged = append(r.StatusChanged, StatusChange{URL: cur.URL, From: prev.Status, To: cur.Status})
+		}
+
+		// Failed fetches have no content to compare
+		if prev.Hash == "" || cur.Hash == "" {
+			continue
+		}
+
+		if prev.Hash != cur.Hash {
+			r.Changed = append(r.Changed, cur.URL)
+		}
+
+		added, removed := DiffLinks(prev.Links, cur.Links)
+		if len(added) > 0 || len(removed) > 0 {
+			r.Links = append(r.Links, LinkChange{URL: cur.URL, Added: added, Removed: removed})
+		}
+	}
+
+	for _, k := range sortedKeys(previous) {
+		if _, ok := current[k]; !ok {
+			r.Removed = append(r.Removed, previous[k].URL)
+		}
+	}
+
+	return r
+}
+
+// DiffLinks returns the sorted urls which are only in after and those which
+// are only in before.
+func DiffLinks(before, after []string) (added, removed []string) {
+	was, is := stringSet(before), stringSet(after)
+
+	for l := range is {
+		if !was[l] {
+			added = append(added, l)
+		}
+	}
+
+	for l := range was {
+		if !is[l] {
+			removed = append(removed, l)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return added, removed
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+
+	return set
+}
+
+// Empty reports whether nothing changed between the runs.
+func (r *ChangeReport) Empty() bool {
+	return len(r.Added) == 0 && len(r.Removed) == 0 && len(r.Changed) == 0 && len(r.StatusChanged) == 0 && len(r.Links) == 0
+}
+
+func (r *ChangeReport) WriteJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+
+	return e.Encode(r)
+}
+
+// WriteText writes the report in a form meant to be read by people.
+func (r *ChangeReport) WriteText(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%d added, %d removed, %d changed, %d status changes, %d pages with changed links\n",
+		len(r.Added), len(r.Removed), len(r.Changed), len(r.StatusChanged), len(r.Links))
+
+	writeSection := func(title string, urls []string) {
+		if len(urls) == 0 {
+			return
+		}
+
+		fmt.Fprintf(b, "\n%s:\n", title)
+		for _, u := range urls {
+			fmt.Fprintf(b, "  %s\n", u)
+		}
+	}
+
+	writeSection("Added", r.Added)
+	writeSection("Removed", r.Removed)
+	writeSection("Changed", r.Changed)
+
+	if len(r.StatusChanged) > 0 {
+		fmt.Fprintf(b, "\nStatus changed:\n")
+		for _, c := range r.StatusChanged {
+			fmt.Fprintf(b, "  %s %s -> %s\n", c.URL, statusText(c.From), statusText(c.To))
+		}
+	}
+
+	if len(r.Links) > 0 {
+		fmt.Fprintf(b, "\nLinks:\n")
+		for _, c := range r.Links {
+			fmt.Fprintf(b, "  %s\n", c.URL)
+			for _, l := range c.Added {
+				fmt.Fprintf(b, "    + %s\n", l)
+			}
+			for _, l := range c.Removed {
+				fmt.Fprintf(b, "    - %s\n", l)
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+func statusText(status int) string {
+	if status == 0 {
+		return "no response"
+	}
+
+	return fmt.Sprint(status)
+}
+
+// CanonicalURL identifies equivalent urls across crawls: the scheme and
+// host are lowercased, the fragment is dropped and an empty path is "/".
+func CanonicalURL(u *url.URL) string {
+	c := *u
+	c.Host = strings.ToLower(c.Host)
+	c.Scheme = strings.ToLower(c.Scheme)
+	c.Fragment, c.RawFragment = "", ""
+	if c.Path == "" {
+		c.Path, c.RawPath = "/", ""
+	}
+
+	return c.String()
+}
+
+func sortedKeys(m map[string]*PageRecord) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,148 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func crawlWithDB(t *testing.T, path string, site siteFetcher) *CrawlDB {
+	db, err := OpenCrawlDB(path)
+	require.NoError(t, err)
+
+	root, _ := url.Parse("https://monzo.com/")
+	c := NewCrawler(NewParser(), site, NewUniqueSet(), Concurrency(1), RegisterHooks(db))
+	require.NoError(t, c.Enqueue(root))
+	run(c, root, context.Background())
+
+	return db
+}
+
+// siteFetcher serves a fixed set of pages, anything else is a 404.
+type siteFetcher map[string]string
+
+func (s siteFetcher) Fetch(u string) ([]byte, error) {
+	b, ok := s[u]
+	if !ok {
+		return nil, &HTTPError{StatusCode: http.StatusNotFound, Message: "404 Not Found"}
+	}
+
+	return []byte(b), nil
+}
+
+func TestCrawlDBReportsChangesBetweenRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crawldb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "crawl.db")
+
+	db := crawlWithDB(t, path, siteFetcher{
+		"https://monzo.com/":      `<title>Monzo</title><a href="/about">About</a><a href="/blog">Blog</a><a href="/jobs">Jobs</a>`,
+		"https://monzo.com/about": `<title>About</title>`,
+		"https://monzo.com/blog":  `<title>Blog</title>`,
+	})
+	assert.Equal(t, 0, db.Previous())
+	assert.Len(t, db.Changes().Added, 4)
+	require.NoError(t, db.Save())
+
+	db = crawlWithDB(t, path, siteFetcher{
+		"https://monzo.com/":      `<title>Monzo</title><a href="/about">About</a><a href="/jobs">Jobs</a><a href="/help">Help</a>`,
+		"https://monzo.com/about": `<title>About us</title>`,
+		"https://monzo.com/jobs":  `<title>Jobs</title>`,
+	})
+	assert.Equal(t, 4, db.Previous())
+
+	r := db.Changes()
+	assert.Equal(t, &ChangeReport{
+		Added:   []string{"https://monzo.com/help"},
+		Removed: []string{"https://monzo.com/blog"},
+		Changed: []string{"https://monzo.com/", "https://monzo.com/about"},
+		StatusChanged: []StatusChange{
+			{URL: "https://monzo.com/jobs", From: http.StatusNotFound, To: http.StatusOK},
+		},
+		Links: []LinkChange{
+			{URL: "https://monzo.com/", Added: []string{"https://monzo.com/help"}, Removed: []string{"https://monzo.com/blog"}},
+		},
+	}, r)
+
+	b := &bytes.Buffer{}
+	require.NoError(t, r.WriteText(b))
+	assert.Contains(t, b.String(), "1 added, 1 removed, 2 changed, 1 status changes, 1 pages with changed links\n")
+	assert.Contains(t, b.String(), "  https://monzo.com/jobs 404 -> 200\n")
+	assert.Contains(t, b.String(), "    + https://monzo.com/help\n")
+}
+
+// interruptingFetcher cancels the crawl once it fetched the url.
+type interruptingFetcher struct {
+	siteFetcher
+	url    string
+	cancel context.CancelFunc
+}
+
+func (f *interruptingFetcher) Fetch(u string) ([]byte, error) {
+	if u == f.url {
+		f.cancel()
+	}
+
+	return f.siteFetcher.Fetch(u)
+}
+
+func TestCrawlDBComparesResumedCrawlsAsAWhole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crawldb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "crawl.db")
+	journal := filepath.Join(dir, "crawl.state")
+
+	site := siteFetcher{
+		"https://monzo.com/":      `<title>Monzo</title><a href="/about">About</a><a href="/blog">Blog</a>`,
+		"https://monzo.com/about": `<title>About</title>`,
+		"https://monzo.com/blog":  `<title>Blog</title>`,
+	}
+	require.NoError(t, crawlWithDB(t, path, site).Save())
+
+	root, _ := url.Parse("https://monzo.com/")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := OpenCrawlDB(path)
+	require.NoError(t, err)
+	j, err := OpenFileJournal(journal, false)
+	require.NoError(t, err)
+	c := NewCrawler(NewParser(), &interruptingFetcher{site, root.String(), cancel}, NewUniqueSet(), Concurrency(1), Checkpoints(j), RegisterHooks(db))
+	require.NoError(t, c.Enqueue(root))
+	run(c, root, ctx)
+	require.NoError(t, j.Close())
+	require.Len(t, j.Pending(), 2)
+	require.NoError(t, db.SaveInterrupted())
+
+	db, err = OpenCrawlDB(path)
+	require.NoError(t, err)
+	require.NoError(t, db.Resume())
+	j, err = OpenFileJournal(journal, true)
+	require.NoError(t, err)
+	defer j.Close()
+	c = NewCrawler(NewParser(), site, NewUniqueSet(), Concurrency(1), Resume(j), RegisterHooks(db))
+	run(c, root, context.Background())
+
+	assert.True(t, db.Changes().Empty())
+	require.NoError(t, db.Save())
+
+	db, err = OpenCrawlDB(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, db.Previous())
+	assert.Equal(t, ErrNoInterruptedRun, db.Resume())
+}
+
+func TestCanonicalURL(t *testing.T) {
+	u, _ := url.Parse("HTTPS://Monzo.com#top")
+	assert.Equal(t, "https://monzo.com/", CanonicalURL(u))
+}
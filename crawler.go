@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 )
 
 var (
@@ -16,31 +17,48 @@ var (
 type Crawler interface {
 	Enqueue(*url.URL) error
 	Run(context.Context) (<-chan *Page, <-chan error)
+	// Stats is safe to call while the crawl is running
+	Stats() Stats
 }
 
 type Page struct {
 	url.URL
+	// Host of the seed url the page was reached from
+	Site   string
+	Depth  int
 	Links  []*url.URL
 	Assets []*url.URL
+	Body   []byte
+	// Content-Type of the response, empty when the fetcher can't tell
+	ContentType string
+	// Time it took to fetch the page
+	FetchDuration time.Duration
+	// Set when the page's content was already seen on another url
+	Duplicate *Duplicate
 }
 
 type CrawlerOption func(*crawler)
 
 func NewCrawler(p Parser, f Fetcher, u UniqueSet, options ...CrawlerOption) Crawler {
 	c := &crawler{
-		queue:              make(chan *url.URL, 1000000),
+		frontier:           NewSpillingFrontier("", 10000),
 		concurrency:        5,
 		parser:             p,
 		fetcher:            f,
 		uniqueSet:          u,
-		wg:                 sync.WaitGroup{},
 		resultBufferLength: 100,
+		stats:              newStatsCollector(),
 	}
+	c.cond = sync.NewCond(&c.mu)
 
 	for _, f := range options {
 		f(c)
 	}
 
+	if c.resumeFrom != nil {
+		c.restore(c.resumeFrom)
+	}
+
 	return c
 }
 
@@ -50,9 +68,18 @@ func Concurrency(limit int) CrawlerOption {
 	}
 }
 
+// MaxQueueLength caps the number of urls waiting in the frontier. Zero means unlimited.
 func MaxQueueLength(length int) CrawlerOption {
 	return func(c *crawler) {
-		c.queue = make(chan *url.URL, length)
+		c.maxQueueLength = length
+	}
+}
+
+// Queue replaces the default spilling frontier, which crawls breadth-first,
+// with a frontier using a different ordering strategy.
+func Queue(f Frontier) CrawlerOption {
+	return func(c *crawler) {
+		c.frontier = f
 	}
 }
 
@@ -62,45 +89,278 @@ func ResultBufferLength(length int) CrawlerOption {
 	}
 }
 
+// Checkpoints records crawl progress in the journal so the crawl can be resumed.
+func Checkpoints(j Journal) CrawlerOption {
+	return func(c *crawler) {
+		c.journal = j
+	}
+}
+
+// DetectDuplicates marks pages whose content was already crawled under another url.
+func DetectDuplicates(d *DuplicateDetector) CrawlerOption {
+	return func(c *crawler) {
+		c.duplicates = d
+	}
+}
+
+// SkipDuplicateLinks stops links on duplicate pages from being followed.
+// Duplicates usually link to the same pages as the original, just under a
+// different session id or sort order which multiplies the work.
+func SkipDuplicateLinks() CrawlerOption {
+	return func(c *crawler) {
+		c.skipDuplicateLinks = true
+	}
+}
+
+// DetectTraps skips urls which look like they lead into an infinite url space.
+// Skipped urls are reported as a *SkippedError.
+func DetectTraps(d *TrapDetector) CrawlerOption {
+	return func(c *crawler) {
+		c.traps = d
+	}
+}
+
+// Adaptive adjusts the number of in-flight requests per host with an AIMD
+// controller based on latency, throttling responses and timeouts. Throttled
+// and timed out urls are retried instead of being reported straight away.
+// Concurrency remains the overall number of workers shared by all hosts.
+func Adaptive(limits AdaptiveLimits) CrawlerOption {
+	return func(c *crawler) {
+		c.limiter = newAdaptiveLimiter(limits)
+	}
+}
+
+// Instrument exposes the crawl's stats through the metrics.
+func Instrument(m *Metrics) CrawlerOption {
+	return func(c *crawler) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.stats = c.Stats
+	}
+}
+
+// Pipeline runs crawled pages through the stages before sending them to the
+// results. Stages added by several options run in the order they were added.
+func Pipeline(stages ...Stage) CrawlerOption {
+	return func(c *crawler) {
+		c.stages = append(c.stages, stages...)
+	}
+}
+
+// RegisterHooks notifies the hooks of crawl events. Hooks registered with
+// several options are called in the order they were registered.
+func RegisterHooks(h Hooks) CrawlerOption {
+	return func(c *crawler) {
+		c.hooks = append(c.hooks, h)
+	}
+}
+
+// Resume restores the seen-set and frontier from the journal and keeps
+// checkpointing progress to it.
+func Resume(j *FileJournal) CrawlerOption {
+	return func(c *crawler) {
+		c.journal = j
+		c.resumeFrom = j
+	}
+}
+
 type crawler struct {
 	concurrency        int
 	resultBufferLength int
+	maxQueueLength     int
+	skipDuplicateLinks bool
+
+	// Guards the frontier. Pending counts urls which were enqueued, but haven't
+	// been crawled yet, so workers know when there's no more work to wait for.
+	mu       sync.Mutex
+	cond     *sync.Cond
+	frontier Frontier
+	pending  int
+	// Room kept in the frontier for urls the hooks are deciding about
+	slots int
+	// Requests taken from the frontier which wait for room on their host or
+	// for their retry delay with -adaptive, they're still pending
+	waiting []*waitingRequest
+
+	parser     Parser
+	fetcher    Fetcher
+	uniqueSet  UniqueSet
+	journal    Journal
+	resumeFrom *FileJournal
+	duplicates *DuplicateDetector
+	traps      *TrapDetector
+	limiter    *adaptiveLimiter
+	stats      *statsCollector
+	hooks      hookList
+	stages     []Stage
+}
 
-	queue     chan *url.URL
-	wg        sync.WaitGroup
-	parser    Parser
-	fetcher   Fetcher
-	uniqueSet UniqueSet
+type waitingRequest struct {
+	*Request
+	notBefore time.Time
 }
 
+// Enqueue reserves the url in the unique set and only commits the reservation
+// once the url is in the frontier. A rejected url is rolled back so it can be
+// enqueued again when it's discovered on another page.
 func (c *crawler) Enqueue(u *url.URL) error {
+	return c.enqueue(&Request{URL: u, Site: u.Host})
+}
+
+func (c *crawler) enqueue(r *Request) error {
+	if err := c.reserve(r); err != nil {
+		c.stats.rejected(err)
+		return newCrawlError(r, PhaseEnqueue, err)
+	}
+
+	return nil
+}
+
+func (c *crawler) reserve(r *Request) error {
 	// Making sure to not crawl the same page more than once
-	if !c.uniqueSet.AddIfNotExists(u) {
+	if !c.uniqueSet.AddIfNotExists(r.URL) {
 		return nil
 	}
 
-	select {
-	case c.queue <- u:
-		c.wg.Add(1)
-	default:
+	// Trapped urls stay in the unique set so they're only reported once
+	if c.traps != nil {
+		if reason := c.traps.Check(r.URL); reason != "" {
+			c.hooks.OnSkip(r, reason)
+			return &SkippedError{URL: r.URL, Reason: reason}
+		}
+	}
+
+	// Making room for the url before the hooks see it, so a url the frontier
+	// has no room for isn't seen by them again when it's rediscovered
+	if err := c.takeSlot(); err != nil {
+		c.uniqueSet.Remove(r.URL)
+		if c.traps != nil {
+			c.traps.Release(r.URL)
+		}
+
+		return err
+	}
+
+	// Filtered urls stay in the unique set as well so hooks see each url once
+	if !c.hooks.OnEnqueue(r) {
+		c.releaseSlot()
+		return nil
+	}
+
+	// The url stays in the unique set when the frontier fails, since the hooks
+	// have seen it
+	if err := c.pushIntoSlot(r); err != nil {
+		return err
+	}
+
+	c.stats.enqueued()
+
+	if c.journal != nil {
+		return c.journal.Enqueued(r)
+	}
+
+	return nil
+}
+
+// restore doesn't touch the journal, so requests which can't be pushed into
+// the frontier stay pending in it and are picked up by the next resume.
+// OnEnqueue isn't called for restored requests, the hooks saw them in the run
+// which enqueued them.
+func (c *crawler) restore(j *FileJournal) {
+	for _, u := range j.Visited() {
+		c.uniqueSet.AddIfNotExists(u)
+	}
+
+	for _, r := range j.Pending() {
+		if !c.uniqueSet.AddIfNotExists(r.URL) {
+			continue
+		}
+
+		if err := c.push(r); err != nil {
+			c.uniqueSet.Remove(r.URL)
+			continue
+		}
+
+		c.stats.enqueued()
+	}
+}
+
+func (c *crawler) push(r *Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.full() {
 		return ErrQueueLimitReached
 	}
 
+	return c.pushLocked(r)
+}
+
+// takeSlot keeps room in the frontier for a url until it's pushed into it
+// with pushIntoSlot or the slot is released.
+func (c *crawler) takeSlot() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.full() {
+		return ErrQueueLimitReached
+	}
+
+	c.slots++
+
+	return nil
+}
+
+func (c *crawler) releaseSlot() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.slots--
+}
+
+func (c *crawler) pushIntoSlot(r *Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.slots--
+
+	return c.pushLocked(r)
+}
+
+func (c *crawler) full() bool {
+	return c.maxQueueLength > 0 && c.frontier.Len()+c.slots >= c.maxQueueLength
+}
+
+func (c *crawler) pushLocked(r *Request) error {
+	if err := c.frontier.Push(r); err != nil {
+		return err
+	}
+
+	c.pending++
+	c.cond.Signal()
+
 	return nil
 }
 
 func (c *crawler) Run(ctx context.Context) (<-chan *Page, <-chan error) {
 	errors := make(chan error, c.resultBufferLength)
 	results := make(chan *Page, c.resultBufferLength)
-	// Finished is used to stop goroutines after the queue is emptied
-	finished := make(chan bool)
+	// Stopped is closed once all workers have returned
+	stopped := make(chan struct{})
 	// Running is used to make sure all goroutines are finished before the results and errors
 	// channels are closed so we don't end up writing to a closed channel.
 	running := sync.WaitGroup{}
 
+	c.stats.start()
+
+	// Waking up idle workers so they notice the cancellation
 	go func() {
-		c.wg.Wait()
-		close(finished)
+		select {
+		case <-ctx.Done():
+			c.wake()
+		case <-stopped:
+		}
 	}()
 
 	running.Add(c.concurrency)
@@ -109,43 +369,42 @@ func (c *crawler) Run(ctx context.Context) (<-chan *Page, <-chan error) {
 			defer running.Done()
 
 			for {
-				// Prioritising cancellation
-				select {
-				// Cancelled
-				case <-ctx.Done():
-					return
-				default:
-					select {
-					// Queue is empty
-					case <-finished:
-						return
-
-					// Work to be done
-					case u := <-c.queue:
-						page, err := c.crawl(u)
-						if err != nil {
-							errors <- err
-							c.wg.Done()
-							break
-						}
-
-						results <- page
-
-						for i := 0; i < len(page.Links); i++ {
-							if err := c.Enqueue(page.Links[i]); err != nil {
-								errors <- err
-							}
-						}
-
-						c.wg.Done()
+				r, err := c.next(ctx)
+				if err != nil {
+					c.report(errors, newCrawlError(nil, PhaseEnqueue, err))
+					if isMalformed(err) {
+						continue
 					}
+
+					// Popping again would fail the same way, the urls left stay
+					// pending in the journal
+					return
 				}
+
+				// Cancelled or the queue is empty
+				if r == nil {
+					return
+				}
+
+				c.process(r, results, errors)
+				c.done()
 			}
 		}()
 	}
 
 	go func() {
 		running.Wait()
+
+		// Urls left after a cancellation stay pending in the journal
+		c.mu.Lock()
+		err := c.frontier.Close()
+		c.mu.Unlock()
+		if err != nil {
+			c.report(errors, newCrawlError(nil, PhaseEnqueue, err))
+		}
+
+		c.hooks.OnFinish(c.Stats())
+		close(stopped)
 		close(results)
 		close(errors)
 	}()
@@ -153,27 +412,247 @@ func (c *crawler) Run(ctx context.Context) (<-chan *Page, <-chan error) {
 	return results, errors
 }
 
-func (c *crawler) crawl(u *url.URL) (*Page, error) {
-	b, err := c.fetcher.Fetch(u.String())
+func (c *crawler) process(r *Request, results chan<- *Page, errs chan<- error) {
+	page, latency, err := c.crawl(r)
+
+	if c.limiter != nil {
+		c.limiter.release(r.URL.Host, latency, classify(err))
+		// Requests waiting for the host may go ahead now
+		c.wake()
+	}
+
 	if err != nil {
-		if e, ok := err.(*HTTPError); ok && e.StatusCode == http.StatusTooManyRequests {
-			return nil, ErrTooManyRequests
+		if c.retry(r, err, errs) {
+			return
 		}
 
-		return nil, err
+		c.stats.finished(r.URL.Host, true)
+		c.report(errs, err)
+		// Throttled urls are left in the journal so they're retried on resume
+		if !isThrottled(err) {
+			c.checkpoint(r, errs)
+		}
+
+		return
+	}
+
+	c.stats.finished(r.URL.Host, false)
+
+	action := c.pipeline(r, page, errs)
+	if action&DropPage == 0 {
+		results <- page
+	}
+
+	links := page.Links
+	if action&SkipLinks != 0 || page.Duplicate != nil && c.skipDuplicateLinks {
+		links = nil
 	}
 
-	links, assets := c.parser.Parse(u, b)
-	linksOnSameHost := make([]*url.URL, 0)
 	for i := 0; i < len(links); i++ {
-		if links[i].Host == u.Host {
-			linksOnSameHost = append(linksOnSameHost, links[i])
+		if err := c.enqueue(&Request{URL: links[i], Depth: r.Depth + 1, Referrer: r.URL, Site: r.Site}); err != nil {
+			c.report(errs, err)
 		}
 	}
 
-	return &Page{
-		URL:    *u,
-		Links:  linksOnSameHost,
-		Assets: assets,
-	}, nil
+	c.checkpoint(r, errs)
+}
+
+// retry has congested requests wait for their retry delay while they have
+// attempts left. The url is already reserved in the unique set and the
+// attempts are journaled, so the budget isn't reset on resume.
+func (c *crawler) retry(r *Request, err error, errs chan<- error) bool {
+	if c.limiter == nil || classify(err) != outcomeCongested || r.Attempts+1 >= c.limiter.limits.MaxAttempts {
+		return false
+	}
+
+	retry := *r
+	retry.Attempts++
+
+	if c.journal != nil {
+		if err := c.journal.Enqueued(&retry); err != nil {
+			c.report(errs, newCrawlError(&retry, PhaseCheckpoint, err))
+		}
+	}
+
+	delay := c.limiter.retryDelay(retry.Attempts)
+
+	c.mu.Lock()
+	c.waiting = append(c.waiting, &waitingRequest{Request: &retry, notBefore: time.Now().Add(delay)})
+	c.pending++
+	c.mu.Unlock()
+
+	time.AfterFunc(delay, c.wake)
+	c.stats.retried()
+
+	return true
+}
+
+// next blocks until there's a url to crawl. It returns nil once the context is
+// cancelled or when the frontier is empty and no crawl in progress can add to it.
+func (c *crawler) next(ctx context.Context) (*Request, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Prioritising cancellation, the urls left stay pending in the journal
+	for ctx.Err() == nil {
+		if r := c.ready(); r != nil {
+			return r, nil
+		}
+
+		// The requests waiting for a busy host are bounded, so they can't
+		// drain the frontier into memory
+		if c.frontier.Len() > 0 && len(c.waiting) < c.concurrency {
+			// Nothing was taken from the frontier when Pop fails, so nothing is
+			// released, unless the frontier lost requests it couldn't read back
+			r, err := c.frontier.Pop()
+			var malformed *MalformedRequestsError
+			if errors.As(err, &malformed) {
+				for range malformed.Lines {
+					c.release()
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if c.limiter == nil || c.limiter.acquire(r.URL.Host) {
+				return r, nil
+			}
+
+			c.waiting = append(c.waiting, &waitingRequest{Request: r})
+			continue
+		}
+
+		if c.pending == 0 {
+			return nil, nil
+		}
+
+		c.cond.Wait()
+	}
+
+	return nil, nil
+}
+
+// ready takes the first waiting request whose host has room and whose retry
+// delay is over. It expects the lock to be held.
+func (c *crawler) ready() *Request {
+	now := time.Now()
+	for i, w := range c.waiting {
+		if now.Before(w.notBefore) || !c.limiter.acquire(w.URL.Host) {
+			continue
+		}
+
+		c.waiting = append(c.waiting[:i], c.waiting[i+1:]...)
+		return w.Request
+	}
+
+	return nil
+}
+
+// wake lets waiting workers have another look at the frontier.
+func (c *crawler) wake() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cond.Broadcast()
+}
+
+func (c *crawler) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.release()
+}
+
+// release expects the lock to be held.
+func (c *crawler) release() {
+	c.pending--
+	if c.pending == 0 {
+		c.cond.Broadcast()
+	}
+}
+
+func (c *crawler) checkpoint(r *Request, errs chan<- error) {
+	if c.journal == nil {
+		return
+	}
+
+	if err := c.journal.Crawled(r.URL); err != nil {
+		c.report(errs, newCrawlError(r, PhaseCheckpoint, err))
+	}
+}
+
+func (c *crawler) report(errs chan<- error, err error) {
+	c.hooks.OnError(err)
+	errs <- err
+}
+
+func (c *crawler) Stats() Stats {
+	s := c.stats.snapshot()
+
+	c.mu.Lock()
+	s.Queued = c.frontier.Len() + len(c.waiting)
+	c.mu.Unlock()
+
+	return s
+}
+
+func isThrottled(err error) bool {
+	return errors.Is(err, ErrTooManyRequests)
+}
+
+func isMalformed(err error) bool {
+	var malformed *MalformedRequestsError
+	return errors.As(err, &malformed)
+}
+
+func (c *crawler) crawl(r *Request) (*Page, time.Duration, error) {
+	u := r.URL
+	c.hooks.OnFetchStart(r)
+	c.stats.fetchStarted()
+	start := time.Now()
+	b, contentType, err := fetchContentType(c.fetcher, u.String())
+	latency := time.Since(start)
+	c.stats.fetched(u.Host, statusCode(err), len(b), latency)
+	c.hooks.OnFetchDone(r, latency, err)
+	if err != nil {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusTooManyRequests {
+			err = ErrTooManyRequests
+		}
+
+		return nil, latency, newCrawlError(r, PhaseFetch, err)
+	}
+
+	links, assets, err := c.parser.Parse(u, b)
+	if err != nil {
+		c.stats.parseFailed()
+		return nil, latency, newCrawlError(r, PhaseParse, err)
+	}
+	site := r.site()
+	linksOnSameSite := make([]*url.URL, 0)
+	for i := 0; i < len(links); i++ {
+		if links[i].Host == site {
+			linksOnSameSite = append(linksOnSameSite, links[i])
+		}
+	}
+
+	page := &Page{
+		URL:           *u,
+		Site:          site,
+		Depth:         r.Depth,
+		Links:         linksOnSameSite,
+		Assets:        assets,
+		Body:          b,
+		ContentType:   contentType,
+		FetchDuration: latency,
+	}
+
+	if c.duplicates != nil {
+		page.Duplicate = c.duplicates.Check(u, b)
+	}
+
+	c.hooks.OnParsed(page)
+
+	return page, latency, nil
 }
@@ -2,6 +2,7 @@ package crawler
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/dovys/monzo-crawler/mock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testSuite struct {
@@ -25,7 +27,7 @@ func (s *testSuite) AssertExpectations(t *testing.T) {
 	s.p.AssertExpectations(t)
 }
 
-func setup(concurrencyLimit, maxQueueLength, resultBufferLength int) *testSuite {
+func setup(concurrencyLimit, maxQueueLength, resultBufferLength int, options ...CrawlerOption) *testSuite {
 	p := &mock.ParserMock{}
 	f := &mock.FetcherMock{}
 
@@ -35,7 +37,7 @@ func setup(concurrencyLimit, maxQueueLength, resultBufferLength int) *testSuite
 		ResultBufferLength(resultBufferLength),
 	}
 
-	c := NewCrawler(p, f, NewUniqueSet(), opts...)
+	c := NewCrawler(p, f, NewUniqueSet(), append(opts, options...)...)
 
 	return &testSuite{c: c, p: p, f: f}
 }
@@ -47,8 +49,8 @@ func TestSamePageIsOnlyCrawledOnce(t *testing.T) {
 
 	s.f.On("Fetch", root.String()).Once().Return([]byte("body"), nil)
 	s.f.On("Fetch", link.String()).Once().Return([]byte("aboutBody"), nil)
-	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{root, link, root, root}, []*url.URL{})
-	s.p.On("Parse", link, []byte("aboutBody")).Return([]*url.URL{root, link}, []*url.URL{})
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{root, link, root, root}, []*url.URL{}, nil)
+	s.p.On("Parse", link, []byte("aboutBody")).Return([]*url.URL{root, link}, []*url.URL{}, nil)
 
 	s.c.Enqueue(root)
 
@@ -67,7 +69,7 @@ func TestConcurrentCrawls(t *testing.T) {
 	}
 
 	for i := 0; i < 26; i++ {
-		s.p.On("Parse", pages[i], []byte("body")).Once().Return(pages, []*url.URL{})
+		s.p.On("Parse", pages[i], []byte("body")).Once().Return(pages, []*url.URL{}, nil)
 	}
 
 	s.c.Enqueue(pages[0])
@@ -86,7 +88,7 @@ func TestExternalLinksAreNotFollowed(t *testing.T) {
 	external, _ := url.Parse("https://twitter.com/handle")
 
 	s.f.On("Fetch", root.String()).Once().Return([]byte("body"), nil)
-	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{root, external}, []*url.URL{})
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{root, external}, []*url.URL{}, nil)
 
 	s.c.Enqueue(root)
 
@@ -106,8 +108,8 @@ func TestLinksAndAssets(t *testing.T) {
 
 	s.f.On("Fetch", root.String()).Return([]byte("body"), nil)
 	s.f.On("Fetch", link.String()).Return([]byte("bodyAbout"), nil)
-	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{link}, []*url.URL{assetImg, assetJs})
-	s.p.On("Parse", link, []byte("bodyAbout")).Return([]*url.URL{root}, []*url.URL{assetImg2, assetJs})
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{link}, []*url.URL{assetImg, assetJs}, nil)
+	s.p.On("Parse", link, []byte("bodyAbout")).Return([]*url.URL{root}, []*url.URL{assetImg2, assetJs}, nil)
 
 	s.c.Enqueue(root)
 
@@ -139,10 +141,10 @@ func TestHTTPErrorsDontStopExecution(t *testing.T) {
 	s.f.On("Fetch", okDepth3.String()).Return([]byte("depth3Body"), nil)
 	s.f.On("Fetch", okDepth4.String()).Return([]byte("depth4Body"), nil)
 
-	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{errorDepth2, okDepth2}, []*url.URL{})
-	s.p.On("Parse", okDepth2, []byte("depth2Body")).Return([]*url.URL{okDepth3}, []*url.URL{})
-	s.p.On("Parse", okDepth3, []byte("depth3Body")).Return([]*url.URL{okDepth4}, []*url.URL{})
-	s.p.On("Parse", okDepth4, []byte("depth4Body")).Return([]*url.URL{}, []*url.URL{})
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{errorDepth2, okDepth2}, []*url.URL{}, nil)
+	s.p.On("Parse", okDepth2, []byte("depth2Body")).Return([]*url.URL{okDepth3}, []*url.URL{}, nil)
+	s.p.On("Parse", okDepth3, []byte("depth3Body")).Return([]*url.URL{okDepth4}, []*url.URL{}, nil)
+	s.p.On("Parse", okDepth4, []byte("depth4Body")).Return([]*url.URL{}, []*url.URL{}, nil)
 
 	s.c.Enqueue(root)
 
@@ -151,7 +153,8 @@ func TestHTTPErrorsDontStopExecution(t *testing.T) {
 	assert.Len(t, pages, 4)
 	assert.Len(t, errors, 1)
 
-	assert.Equal(t, err, errors[0])
+	expected := &CrawlError{URL: errorDepth2, Referrer: root, Site: "google.com", Depth: 1, Phase: PhaseFetch, Attempt: 1, Err: err}
+	assert.Equal(t, expected, errors[0])
 }
 
 func TestCancellationLetsCurrentCrawlFinish(t *testing.T) {
@@ -168,8 +171,8 @@ func TestCancellationLetsCurrentCrawlFinish(t *testing.T) {
 		cancel()
 	}).Return([]byte("body"), nil)
 
-	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{about}, []*url.URL{})
-	s.p.On("Parse", about, []byte("body")).Return([]*url.URL{tos}, []*url.URL{})
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{about}, []*url.URL{}, nil)
+	s.p.On("Parse", about, []byte("body")).Return([]*url.URL{tos}, []*url.URL{}, nil)
 
 	s.c.Enqueue(root)
 
@@ -193,8 +196,8 @@ func TestCrawlerDiscardsNewItemsInQueueWhenFull(t *testing.T) {
 	s.f.On("Fetch", root.String()).Return([]byte("body"), nil)
 	s.f.On("Fetch", about.String()).Return([]byte("body"), nil)
 
-	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{about, tos, sitemap}, []*url.URL{})
-	s.p.On("Parse", about, []byte("body")).Return([]*url.URL{root}, []*url.URL{})
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{about, tos, sitemap}, []*url.URL{}, nil)
+	s.p.On("Parse", about, []byte("body")).Return([]*url.URL{root}, []*url.URL{}, nil)
 
 	s.c.Enqueue(root)
 
@@ -205,12 +208,150 @@ func TestCrawlerDiscardsNewItemsInQueueWhenFull(t *testing.T) {
 	assert.Equal(t, about.String(), p[1].String())
 
 	assert.Len(t, e, 2)
-	assert.Equal(t, ErrQueueLimitReached, e[0])
-	assert.Equal(t, ErrQueueLimitReached, e[1])
+	assert.Equal(t, &CrawlError{URL: tos, Referrer: root, Site: "google.com", Depth: 1, Phase: PhaseEnqueue, Attempt: 1, Err: ErrQueueLimitReached}, e[0])
+	assert.Equal(t, &CrawlError{URL: sitemap, Referrer: root, Site: "google.com", Depth: 1, Phase: PhaseEnqueue, Attempt: 1, Err: ErrQueueLimitReached}, e[1])
 
 	s.AssertExpectations(t)
 }
 
+func TestURLsRejectedByFullQueueAreRetriedLater(t *testing.T) {
+	s := setup(1, 1, 10)
+
+	root, _ := url.Parse("https://google.com")
+	about, _ := url.Parse("https://google.com/about")
+	tos, _ := url.Parse("https://google.com/tos")
+
+	s.f.On("Fetch", root.String()).Once().Return([]byte("body"), nil)
+	s.f.On("Fetch", about.String()).Once().Return([]byte("body"), nil)
+	s.f.On("Fetch", tos.String()).Once().Return([]byte("body"), nil)
+
+	// Tos doesn't fit into the queue the first time it's discovered
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{about, tos}, []*url.URL{}, nil)
+	s.p.On("Parse", about, []byte("body")).Return([]*url.URL{tos}, []*url.URL{}, nil)
+	s.p.On("Parse", tos, []byte("body")).Return([]*url.URL{root}, []*url.URL{}, nil)
+
+	s.c.Enqueue(root)
+
+	p, e := run(s.c, root, context.Background())
+
+	require.Len(t, p, 3)
+	assert.Equal(t, tos.String(), p[2].String())
+
+	assert.Len(t, e, 1)
+	assert.True(t, stderrors.Is(e[0], ErrQueueLimitReached))
+
+	s.AssertExpectations(t)
+}
+
+func TestMultipleSeedsAreCrawledFairly(t *testing.T) {
+	s := setup(1, 100, 100, Queue(NewRoundRobinFrontier()))
+
+	monzo, _ := url.Parse("https://monzo.com")
+	monzoAbout, _ := url.Parse("https://monzo.com/about")
+	monzoBlog, _ := url.Parse("https://monzo.com/blog")
+	google, _ := url.Parse("https://google.com")
+	googleAbout, _ := url.Parse("https://google.com/about")
+
+	s.f.On("Fetch", stdmock.Anything).Return([]byte("body"), nil)
+	// Links to the other seed's site are out of scope
+	s.p.On("Parse", monzo, []byte("body")).Return([]*url.URL{monzoAbout, monzoBlog, googleAbout}, []*url.URL{}, nil)
+	s.p.On("Parse", google, []byte("body")).Return([]*url.URL{googleAbout}, []*url.URL{}, nil)
+	s.p.On("Parse", stdmock.Anything, []byte("body")).Return([]*url.URL{}, []*url.URL{}, nil)
+
+	s.c.Enqueue(monzo)
+	s.c.Enqueue(google)
+
+	p, _ := run(s.c, monzo, context.Background())
+
+	crawled := make([]string, len(p))
+	for i := range p {
+		crawled[i] = p[i].String()
+		assert.Equal(t, p[i].Host, p[i].Site)
+	}
+
+	expected := []string{
+		monzo.String(),
+		google.String(),
+		monzoAbout.String(),
+		googleAbout.String(),
+		monzoBlog.String(),
+	}
+	assert.Equal(t, expected, crawled)
+}
+
+func TestParseErrorsAreReported(t *testing.T) {
+	s := setup(1, 100, 100)
+	root, _ := url.Parse("https://google.com")
+	parseErr := stderrors.New("malformed")
+
+	s.f.On("Fetch", root.String()).Return([]byte("body"), nil)
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{}, []*url.URL{}, parseErr)
+
+	s.c.Enqueue(root)
+
+	p, e := run(s.c, root, context.Background())
+
+	assert.Len(t, p, 0)
+	require.Len(t, e, 1)
+	assert.Equal(t, &CrawlError{URL: root, Site: "google.com", Phase: PhaseParse, Attempt: 1, Err: parseErr}, e[0])
+	assert.Equal(t, "parse https://google.com: malformed", e[0].Error())
+}
+
+func TestCrawlErrorsWrapTheirCause(t *testing.T) {
+	root, _ := url.Parse("https://google.com")
+	about, _ := url.Parse("https://google.com/about")
+	err := error(&CrawlError{URL: about, Referrer: root, Depth: 1, Phase: PhaseFetch, Attempt: 1,
+		Err: &HTTPError{StatusCode: http.StatusNotFound, Message: "404 Not Found"}})
+
+	var httpErr *HTTPError
+	require.True(t, stderrors.As(err, &httpErr))
+	assert.Equal(t, http.StatusNotFound, httpErr.StatusCode)
+	assert.Equal(t, "fetch https://google.com/about (linked from https://google.com): 404 Not Found", err.Error())
+}
+
+func TestTooManyRequestsIsRecognisable(t *testing.T) {
+	s := setup(1, 100, 100)
+	root, _ := url.Parse("https://google.com")
+
+	s.f.On("Fetch", root.String()).Return([]byte{}, &HTTPError{StatusCode: http.StatusTooManyRequests})
+
+	s.c.Enqueue(root)
+
+	_, e := run(s.c, root, context.Background())
+
+	require.Len(t, e, 1)
+	assert.True(t, stderrors.Is(e[0], ErrTooManyRequests))
+}
+
+// The fixture is a recording of a small site made with RecordingFetcher
+func TestCrawlReplaysRecordedSite(t *testing.T) {
+	f, err := OpenReplayFetcher("testdata/site.har")
+	require.NoError(t, err)
+
+	root, _ := url.Parse("https://monzo.com/")
+	c := NewCrawler(NewParser(), f, NewUniqueSet(), Concurrency(1))
+	require.NoError(t, c.Enqueue(root))
+
+	pages, errs := run(c, root, context.Background())
+
+	crawled := make([]string, len(pages))
+	for i, p := range pages {
+		crawled[i] = p.String()
+	}
+	assert.Equal(t, []string{
+		"https://monzo.com/",
+		"https://monzo.com/about",
+		"https://monzo.com/blog/",
+		"https://monzo.com/blog/hello",
+	}, crawled)
+	assert.Len(t, pages[1].Assets, 1)
+
+	require.Len(t, errs, 1)
+	var httpErr *HTTPError
+	require.True(t, stderrors.As(errs[0], &httpErr))
+	assert.Equal(t, http.StatusNotFound, httpErr.StatusCode)
+}
+
 func run(c Crawler, root *url.URL, ctx context.Context) ([]*Page, []error) {
 	pagechn, errchn := c.Run(ctx)
 
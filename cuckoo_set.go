@@ -0,0 +1,234 @@
+package crawler
+
+import (
+	"math"
+	"math/rand"
+	"net/url"
+	"sync"
+)
+
+const (
+	cuckooBucketSize = 4
+	cuckooMaxKicks   = 500
+	cuckooLoadFactor = 0.95
+)
+
+// NewCuckooUniqueSet creates a probabilistic UniqueSet backed by a scalable
+// cuckoo filter. It only keeps a small fingerprint per url, so it uses a
+// fraction of the memory of the map based sets, but a url will be wrongly
+// reported as seen, and never crawled, with a probability of up to fpRate.
+//
+// The filter starts with room for capacity urls and adds a twice larger
+// filter with a tighter false positive rate each time the last one fills up,
+// so the total false positive rate stays below fpRate.
+//
+// Unlike a Bloom filter, a cuckoo filter supports removal, which keeps
+// rolled back reservations working.
+func NewCuckooUniqueSet(capacity int, fpRate float64, options ...UniqueSetOption) UniqueSet {
+	if capacity < cuckooBucketSize {
+		capacity = cuckooBucketSize
+	}
+
+	s := &cuckooUniqueSet{
+		capacity: capacity,
+		fpRate:   fpRate / 2,
+		rnd:      rand.New(rand.NewSource(1)),
+		key:      newURLKey(options),
+	}
+	s.grow()
+
+	return s
+}
+
+type cuckooUniqueSet struct {
+	mu       sync.Mutex
+	filters  []*cuckooFilter
+	capacity int
+	// False positive rate of the next filter to be added
+	fpRate float64
+	rnd    *rand.Rand
+	key    urlKey
+}
+
+func (s *cuckooUniqueSet) AddIfNotExists(u *url.URL) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.key.checksum(u)
+	for _, f := range s.filters {
+		if f.contains(h) {
+			return false
+		}
+	}
+
+	if !s.filters[len(s.filters)-1].insert(h, s.rnd) {
+		s.grow()
+		s.filters[len(s.filters)-1].insert(h, s.rnd)
+	}
+
+	return true
+}
+
+// Remove deletes a single matching fingerprint. Since fingerprints can
+// collide, removing a url that was never added may forget a different url.
+func (s *cuckooUniqueSet) Remove(u *url.URL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.key.checksum(u)
+	// Reservations are rolled back soon after they're made, so newest filters go first
+	for i := len(s.filters) - 1; i >= 0; i-- {
+		if s.filters[i].remove(h) {
+			return
+		}
+	}
+}
+
+func (s *cuckooUniqueSet) grow() {
+	s.filters = append(s.filters, newCuckooFilter(s.capacity, s.fpRate))
+	s.capacity *= 2
+	s.fpRate /= 2
+}
+
+type cuckooFilter struct {
+	buckets [][cuckooBucketSize]uint32
+	mask    uint64
+	fpMask  uint32
+
+	// A fingerprint which couldn't be placed after evicting cuckooMaxKicks
+	// entries. The filter is full once it's taken.
+	victim      uint32
+	victimIndex uint64
+	full        bool
+}
+
+func newCuckooFilter(capacity int, fpRate float64) *cuckooFilter {
+	buckets := uint64(1)
+	for float64(buckets*cuckooBucketSize)*cuckooLoadFactor < float64(capacity) {
+		buckets <<= 1
+	}
+
+	// Each lookup compares against 2 buckets of fingerprints, which gives an
+	// upper bound of 2*bucketSize/2^bits for the false positive rate
+	bits := uint(math.Ceil(math.Log2(2 * cuckooBucketSize / fpRate)))
+	if bits < 4 {
+		bits = 4
+	}
+	if bits > 32 {
+		bits = 32
+	}
+
+	return &cuckooFilter{
+		buckets: make([][cuckooBucketSize]uint32, buckets),
+		mask:    buckets - 1,
+		fpMask:  uint32(uint64(1)<<bits - 1),
+	}
+}
+
+// indexes derives the fingerprint and both candidate buckets from the hash.
+// Zero marks an empty slot, so it's never used as a fingerprint.
+func (f *cuckooFilter) indexes(h uint64) (fp uint32, i1, i2 uint64) {
+	fp = uint32(h>>32) & f.fpMask
+	if fp == 0 {
+		fp = 1
+	}
+
+	i1 = h & f.mask
+
+	return fp, i1, f.alternate(i1, fp)
+}
+
+func (f *cuckooFilter) alternate(i uint64, fp uint32) uint64 {
+	return (i ^ (uint64(fp) * 0x5bd1e995)) & f.mask
+}
+
+func (f *cuckooFilter) contains(h uint64) bool {
+	fp, i1, i2 := f.indexes(h)
+
+	if f.full && f.victim == fp && (f.victimIndex == i1 || f.victimIndex == i2) {
+		return true
+	}
+
+	for j := 0; j < cuckooBucketSize; j++ {
+		if f.buckets[i1][j] == fp || f.buckets[i2][j] == fp {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *cuckooFilter) insert(h uint64, rnd *rand.Rand) bool {
+	if f.full {
+		return false
+	}
+
+	fp, i1, i2 := f.indexes(h)
+	if f.place(i1, fp) || f.place(i2, fp) {
+		return true
+	}
+
+	i := i1
+	if rnd.Intn(2) == 1 {
+		i = i2
+	}
+
+	for k := 0; k < cuckooMaxKicks; k++ {
+		j := rnd.Intn(cuckooBucketSize)
+		fp, f.buckets[i][j] = f.buckets[i][j], fp
+
+		i = f.alternate(i, fp)
+		if f.place(i, fp) {
+			return true
+		}
+	}
+
+	// The evicted fingerprint can't be moved to another filter without the
+	// original hash, so it's kept aside and the filter stops taking new urls
+	f.victim, f.victimIndex, f.full = fp, i, true
+
+	return true
+}
+
+func (f *cuckooFilter) place(i uint64, fp uint32) bool {
+	for j := 0; j < cuckooBucketSize; j++ {
+		if f.buckets[i][j] == 0 {
+			f.buckets[i][j] = fp
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *cuckooFilter) remove(h uint64) bool {
+	fp, i1, i2 := f.indexes(h)
+
+	for _, i := range []uint64{i1, i2} {
+		for j := 0; j < cuckooBucketSize; j++ {
+			if f.buckets[i][j] == fp {
+				f.buckets[i][j] = 0
+				f.reinsertVictim()
+				return true
+			}
+		}
+	}
+
+	if f.full && f.victim == fp && (f.victimIndex == i1 || f.victimIndex == i2) {
+		f.victim, f.full = 0, false
+		return true
+	}
+
+	return false
+}
+
+// reinsertVictim moves the victim back into the table once a slot frees up.
+func (f *cuckooFilter) reinsertVictim() {
+	if !f.full {
+		return
+	}
+
+	if f.place(f.victimIndex, f.victim) || f.place(f.alternate(f.victimIndex, f.victim), f.victim) {
+		f.victim, f.full = 0, false
+	}
+}
@@ -0,0 +1,56 @@
+package crawler
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func numberedURL(i int) *url.URL {
+	return &url.URL{Scheme: "https", Host: "google.com", Path: fmt.Sprintf("/page/%d", i)}
+}
+
+func TestCuckooSetHasNoFalseNegatives(t *testing.T) {
+	s := NewCuckooUniqueSet(100, 0.001)
+
+	// Adding many more urls than the initial capacity to make the filter grow
+	for i := 0; i < 20000; i++ {
+		s.AddIfNotExists(numberedURL(i))
+	}
+
+	for i := 0; i < 20000; i++ {
+		assert.False(t, s.AddIfNotExists(numberedURL(i)))
+	}
+
+	assert.True(t, len(s.(*cuckooUniqueSet).filters) > 1)
+}
+
+func TestCuckooSetFalsePositiveRate(t *testing.T) {
+	s := NewCuckooUniqueSet(1000, 0.01)
+
+	for i := 0; i < 50000; i++ {
+		s.AddIfNotExists(numberedURL(i))
+	}
+
+	falsePositives := 0
+	for i := 50000; i < 100000; i++ {
+		if !s.AddIfNotExists(numberedURL(i)) {
+			falsePositives++
+		}
+	}
+
+	assert.True(t, float64(falsePositives)/50000 < 0.01, "false positives: %d", falsePositives)
+}
+
+func TestCuckooSetRemove(t *testing.T) {
+	s := NewCuckooUniqueSet(10, 0.001)
+
+	u := numberedURL(1)
+	assert.True(t, s.AddIfNotExists(u))
+
+	s.Remove(u)
+	assert.True(t, s.AddIfNotExists(u))
+	assert.False(t, s.AddIfNotExists(u))
+}
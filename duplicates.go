@@ -0,0 +1,229 @@
+package crawler
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"math/bits"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+const (
+	simhashBands     = 4
+	simhashBandWidth = 64 / simhashBands
+	shingleLength    = 3
+	// Pages with less text than this, such as redirect stubs, image galleries
+	// or pages rendered by JavaScript, only have exact duplicates: their
+	// SimHashes are too alike to tell them apart.
+	minSimHashWords = 10
+)
+
+// Duplicate describes a page whose content was already seen on another url.
+type Duplicate struct {
+	// First url the content was seen on
+	Of *url.URL
+	// Whether the bodies are byte for byte identical
+	Exact bool
+	// Number of differing SimHash bits for near duplicates
+	Distance int
+}
+
+// Cluster groups urls serving the same or nearly the same content.
+type Cluster struct {
+	Canonical  *url.URL
+	Duplicates []*url.URL
+}
+
+// DuplicateDetector finds pages with identical bodies by their hash, and
+// pages with nearly identical text by the Hamming distance between the
+// SimHashes of their word shingles. It's safe for concurrent use.
+type DuplicateDetector struct {
+	mu          sync.Mutex
+	maxDistance int
+
+	exact map[[sha256.Size]byte]int
+	// SimHashes are split into bands so that near duplicates can be looked up
+	// without comparing against every page: with a distance of at most
+	// simhashBands-1 bits at least one band has to match exactly.
+	bands    [simhashBands]map[uint16][]int
+	simhash  []uint64
+	clusters []*Cluster
+}
+
+// NewDuplicateDetector creates a detector treating pages whose SimHashes
+// differ by at most maxDistance bits as near duplicates. Distances above 3
+// can't be found by the band index and are capped, zero disables near
+// duplicate detection.
+func NewDuplicateDetector(maxDistance int) *DuplicateDetector {
+	if maxDistance > simhashBands-1 {
+		maxDistance = simhashBands - 1
+	}
+
+	d := &DuplicateDetector{
+		maxDistance: maxDistance,
+		exact:       make(map[[sha256.Size]byte]int),
+	}
+
+	for i := range d.bands {
+		d.bands[i] = make(map[uint16][]int)
+	}
+
+	return d
+}
+
+// Check records the page and returns a Duplicate when its content has
+// already been seen, otherwise nil.
+func (d *DuplicateDetector) Check(u *url.URL, body []byte) *Duplicate {
+	sum := sha256.Sum256(body)
+
+	var hash uint64
+	near := false
+	if d.maxDistance > 0 {
+		text := ExtractText(body)
+		if len(strings.Fields(text)) >= minSimHashWords {
+			hash, near = SimHash(text), true
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if i, ok := d.exact[sum]; ok {
+		d.clusters[i].Duplicates = append(d.clusters[i].Duplicates, u)
+		return &Duplicate{Of: d.clusters[i].Canonical, Exact: true}
+	}
+
+	if near {
+		if i, distance, ok := d.nearest(hash); ok {
+			d.clusters[i].Duplicates = append(d.clusters[i].Duplicates, u)
+			return &Duplicate{Of: d.clusters[i].Canonical, Distance: distance}
+		}
+	}
+
+	i := len(d.clusters)
+	d.clusters = append(d.clusters, &Cluster{Canonical: u})
+	d.simhash = append(d.simhash, hash)
+	d.exact[sum] = i
+
+	if near {
+		for b := range d.bands {
+			band := uint16(hash >> uint(b*simhashBandWidth))
+			d.bands[b][band] = append(d.bands[b][band], i)
+		}
+	}
+
+	return nil
+}
+
+func (d *DuplicateDetector) nearest(hash uint64) (int, int, bool) {
+	best, bestDistance := -1, d.maxDistance+1
+
+	for b := range d.bands {
+		for _, i := range d.bands[b][uint16(hash>>uint(b*simhashBandWidth))] {
+			if distance := bits.OnesCount64(hash ^ d.simhash[i]); distance < bestDistance {
+				best, bestDistance = i, distance
+			}
+		}
+	}
+
+	return best, bestDistance, best >= 0
+}
+
+// Clusters returns the groups of urls which share content, ordered by the
+// number of duplicates. Unique pages are left out.
+func (d *DuplicateDetector) Clusters() []Cluster {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	clusters := make([]Cluster, 0)
+	for _, c := range d.clusters {
+		if len(c.Duplicates) > 0 {
+			clusters = append(clusters, Cluster{
+				Canonical:  c.Canonical,
+				Duplicates: append([]*url.URL(nil), c.Duplicates...),
+			})
+		}
+	}
+
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i].Duplicates) > len(clusters[j].Duplicates)
+	})
+
+	return clusters
+}
+
+type duplicateReport struct {
+	Clusters   int                      `json:"clusters"`
+	Duplicates int                      `json:"duplicates"`
+	Groups     []duplicateReportCluster `json:"groups"`
+}
+
+type duplicateReportCluster struct {
+	Canonical  string   `json:"canonical"`
+	Duplicates []string `json:"duplicates"`
+}
+
+// WriteReport writes the duplicate clusters as JSON.
+func (d *DuplicateDetector) WriteReport(w io.Writer) error {
+	clusters := d.Clusters()
+	r := duplicateReport{Clusters: len(clusters), Groups: make([]duplicateReportCluster, len(clusters))}
+
+	for i, c := range clusters {
+		r.Groups[i].Canonical = c.Canonical.String()
+		for _, u := range c.Duplicates {
+			r.Groups[i].Duplicates = append(r.Groups[i].Duplicates, u.String())
+		}
+
+		r.Duplicates += len(c.Duplicates)
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+
+	return e.Encode(r)
+}
+
+// SimHash computes a 64 bit locality sensitive hash of the text's word
+// shingles: similar texts get hashes differing in only a few bits.
+func SimHash(text string) uint64 {
+	words := strings.Fields(strings.ToLower(text))
+	if len(words) == 0 {
+		return 0
+	}
+
+	var weights [64]int
+	n := len(words) - shingleLength + 1
+	if n < 1 {
+		n = 1
+	}
+
+	for i := 0; i < n; i++ {
+		end := i + shingleLength
+		if end > len(words) {
+			end = len(words)
+		}
+
+		h := xxhash.ChecksumString64(strings.Join(words[i:end], " "))
+		for b := uint(0); b < 64; b++ {
+			if h&(1<<b) != 0 {
+				weights[b]++
+			} else {
+				weights[b]--
+			}
+		}
+	}
+
+	var hash uint64
+	for b := uint(0); b < 64; b++ {
+		if weights[b] > 0 {
+			hash |= 1 << b
+		}
+	}
+
+	return hash
+}
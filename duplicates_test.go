@@ -0,0 +1,124 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var article = `<html><head><title>Monzo</title><style>body { color: red; }</style></head><body>
+	<p>Monzo is a bank that lives on your phone. It gives you instant spending notifications,
+	helps you budget and save, and lets you freeze your card in a tap if it goes missing.
+	You can split bills with friends, get paid a day early and spend abroad without fees.</p>
+	<script>var session = "%s";</script>
+	</body></html>`
+
+func TestExactDuplicates(t *testing.T) {
+	d := NewDuplicateDetector(0)
+	a, _ := url.Parse("https://monzo.com/?sort=asc")
+	b, _ := url.Parse("https://monzo.com/?sort=desc")
+
+	assert.Nil(t, d.Check(a, []byte(article)))
+
+	dup := d.Check(b, []byte(article))
+	require.NotNil(t, dup)
+	assert.True(t, dup.Exact)
+	assert.Equal(t, a, dup.Of)
+}
+
+func TestNearDuplicates(t *testing.T) {
+	d := NewDuplicateDetector(3)
+	a, _ := url.Parse("https://monzo.com/?session=1")
+	b, _ := url.Parse("https://monzo.com/?session=2")
+	c, _ := url.Parse("https://monzo.com/about")
+
+	// Only the session id embedded in a script differs
+	assert.Nil(t, d.Check(a, []byte(strings.Replace(article, "%s", "1", 1))))
+
+	dup := d.Check(b, []byte(strings.Replace(article, "%s", "2", 1)))
+	require.NotNil(t, dup)
+	assert.False(t, dup.Exact)
+	assert.Equal(t, a, dup.Of)
+
+	assert.Nil(t, d.Check(c, []byte(`<html><body><p>We're on a mission to make money work for everyone.</p></body></html>`)))
+
+	clusters := d.Clusters()
+	require.Len(t, clusters, 1)
+	assert.Equal(t, a, clusters[0].Canonical)
+	assert.Equal(t, []*url.URL{b}, clusters[0].Duplicates)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, d.WriteReport(buf))
+
+	report := duplicateReport{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &report))
+	assert.Equal(t, 1, report.Clusters)
+	assert.Equal(t, 1, report.Duplicates)
+}
+
+func TestPagesWithLittleTextAreNotNearDuplicates(t *testing.T) {
+	d := NewDuplicateDetector(3)
+	pages := []string{
+		`<html><head><meta http-equiv="refresh" content="0; url=/home"></head></html>`,
+		`<html><body><img src="/cat.jpg" /></body></html>`,
+		`<html><body><div id="app"></div><script src="/app.js"></script></body></html>`,
+		`<html><body><p>Moved</p></body></html>`,
+	}
+
+	for i, p := range pages {
+		u, _ := url.Parse(fmt.Sprintf("https://monzo.com/%d", i))
+		assert.Nil(t, d.Check(u, []byte(p)), p)
+	}
+
+	// They're still exact duplicates of themselves
+	u, _ := url.Parse("https://monzo.com/copy")
+	dup := d.Check(u, []byte(pages[0]))
+	require.NotNil(t, dup)
+	assert.True(t, dup.Exact)
+}
+
+func TestSimHashSimilarity(t *testing.T) {
+	original := ExtractText([]byte(strings.Replace(article, "%s", "", 1)))
+	edited := strings.Replace(original, "instant", "immediate", 1)
+	different := "Completely unrelated words about cooking pasta with tomatoes and basil in a big pot of water"
+
+	near := bits.OnesCount64(SimHash(original) ^ SimHash(edited))
+	far := bits.OnesCount64(SimHash(original) ^ SimHash(different))
+
+	assert.True(t, near < far, "near: %d, far: %d", near, far)
+}
+
+func TestCrawlerMarksDuplicatesAndSkipsTheirLinks(t *testing.T) {
+	s := setup(1, 100, 100)
+	c := NewCrawler(s.p, s.f, NewUniqueSet(), Concurrency(1),
+		DetectDuplicates(NewDuplicateDetector(3)), SkipDuplicateLinks())
+
+	root, _ := url.Parse("https://monzo.com")
+	sorted, _ := url.Parse("https://monzo.com/?sort=asc")
+	about, _ := url.Parse("https://monzo.com/about")
+
+	s.f.On("Fetch", root.String()).Return([]byte(article), nil)
+	s.f.On("Fetch", sorted.String()).Return([]byte(article), nil)
+	s.p.On("Parse", root, []byte(article)).Return([]*url.URL{sorted}, []*url.URL{}, nil)
+	// About is never crawled since it's only linked from the duplicate
+	s.p.On("Parse", sorted, []byte(article)).Return([]*url.URL{about}, []*url.URL{}, nil)
+
+	c.Enqueue(root)
+
+	p, _ := run(c, root, context.Background())
+
+	require.Len(t, p, 2)
+	assert.Nil(t, p[0].Duplicate)
+	require.NotNil(t, p[1].Duplicate)
+	assert.Equal(t, root, p[1].Duplicate.Of)
+
+	s.AssertExpectations(t)
+}
@@ -0,0 +1,59 @@
+package crawler
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Phase is the step of crawling a url in which an error occurred.
+type Phase string
+
+const (
+	PhaseEnqueue    Phase = "enqueue"
+	PhaseFetch      Phase = "fetch"
+	PhaseParse      Phase = "parse"
+	PhaseProcess    Phase = "process"
+	PhaseCheckpoint Phase = "checkpoint"
+)
+
+// CrawlError is the type of every error sent on the Run error channel. The
+// cause can be inspected with errors.Is and errors.As, e.g. to find the
+// *HTTPError of a failed fetch.
+type CrawlError struct {
+	URL *url.URL
+	// Page the url was found on, nil for seed urls
+	Referrer *url.URL
+	// Host of the seed url the url was reached from
+	Site  string
+	Depth int
+	Phase Phase
+	// Number of times the url has been tried, starting at 1
+	Attempt int
+	Err     error
+}
+
+func (e *CrawlError) Error() string {
+	if e.URL == nil {
+		return fmt.Sprintf("%s: %v", e.Phase, e.Err)
+	}
+
+	if e.Referrer == nil {
+		return fmt.Sprintf("%s %s: %v", e.Phase, e.URL, e.Err)
+	}
+
+	return fmt.Sprintf("%s %s (linked from %s): %v", e.Phase, e.URL, e.Referrer, e.Err)
+}
+
+func (e *CrawlError) Unwrap() error {
+	return e.Err
+}
+
+func newCrawlError(r *Request, phase Phase, err error) *CrawlError {
+	e := &CrawlError{Phase: phase, Attempt: 1, Err: err}
+	if r != nil {
+		e.URL, e.Referrer, e.Depth, e.Attempt = r.URL, r.Referrer, r.Depth, r.Attempts+1
+		e.Site = r.site()
+	}
+
+	return e
+}
@@ -3,6 +3,8 @@ package crawler
 import (
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 type Fetcher interface {
@@ -18,30 +20,159 @@ func (e HTTPError) Error() string {
 	return e.Message
 }
 
+type FetcherOption func(*fetcher)
+
+// InstrumentFetcher records requests, latency and downloaded bytes by host in the metrics.
+func InstrumentFetcher(m *Metrics) FetcherOption {
+	return func(f *fetcher) {
+		f.metrics = m
+	}
+}
+
 type fetcher struct {
 	httpClient *http.Client
+	metrics    *Metrics
+	archive    *WARCWriter
+	cache      *HTTPCache
 }
 
-func NewFetcher(c *http.Client) Fetcher {
-	return &fetcher{httpClient: c}
+func NewFetcher(c *http.Client, options ...FetcherOption) Fetcher {
+	f := &fetcher{httpClient: c}
+
+	for _, o := range options {
+		o(f)
+	}
+
+	// Archiving from the transport records the redirects the client follows
+	// as well, which the fetcher never sees
+	if f.archive != nil {
+		archiving := *c
+		archiving.Transport = &archivingTransport{next: c.Transport, archive: f.archive}
+		f.httpClient = &archiving
+	}
+
+	return f
 }
 
 func (f *fetcher) Fetch(url string) ([]byte, error) {
-	rsp, err := f.httpClient.Get(url)
+	b, _, err := f.fetchResponse(url)
 	if err != nil {
 		return nil, err
 	}
+
+	return b, nil
+}
+
+// responseFetcher is implemented by fetchers which can tell decorators about
+// the response a fetch was served from.
+type responseFetcher interface {
+	// The response is nil when no response was received, its body has
+	// already been read. Error responses come with their body, fresh cache
+	// hits with the stored Content-Type as their only header.
+	fetchResponse(url string) ([]byte, *http.Response, error)
+}
+
+// fetchContentType returns the Content-Type of the response along with its
+// body, it's empty when the fetcher can't tell.
+func fetchContentType(f Fetcher, url string) ([]byte, string, error) {
+	rf, ok := f.(responseFetcher)
+	if !ok {
+		b, err := f.Fetch(url)
+		return b, "", err
+	}
+
+	b, rsp, err := rf.fetchResponse(url)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if rsp == nil {
+		return b, "", nil
+	}
+
+	return b, rsp.Header.Get("Content-Type"), nil
+}
+
+func (f *fetcher) fetchResponse(url string) ([]byte, *http.Response, error) {
+	// Status stays 0 when there's no response
+	var status, size int
+	if f.metrics != nil {
+		start := time.Now()
+		defer func() {
+			f.metrics.observeFetch(hostOf(url), status, size, time.Since(start))
+		}()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Fresh responses are still observed as fetches, but they never reach
+	// the server, so there's no exchange to archive
+	var cached *cacheEntry
+	if f.cache != nil {
+		if cached = f.cache.get(url); cached != nil && !cached.matches(req) {
+			cached = nil
+		}
+
+		if cached != nil && f.cache.fresh(cached) {
+			f.cache.hit()
+			status, size = http.StatusOK, len(cached.body)
+			return cached.body, cached.response(), nil
+		}
+	}
+
+	if cached != nil {
+		cached.conditional(req)
+	}
+
+	rsp, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer rsp.Body.Close()
+	status = rsp.StatusCode
 
 	b, err := ioutil.ReadAll(rsp.Body)
+	size = len(b)
 	if err != nil {
-		return nil, err
+		return nil, rsp, err
+	}
+
+	if rsp.StatusCode == http.StatusNotModified && cached != nil {
+		if err := f.cache.revalidated(cached, rsp); err != nil {
+			return nil, rsp, err
+		}
+
+		// The 304 stands in for the stored response
+		if rsp.Header.Get("Content-Type") == "" && cached.ContentType != "" {
+			rsp.Header.Set("Content-Type", cached.ContentType)
+		}
+
+		return cached.body, rsp, nil
 	}
 
 	// 3XX's are handled by the http client
 	if rsp.StatusCode != 200 {
-		return nil, &HTTPError{StatusCode: rsp.StatusCode, Message: string(b)}
+		return b, rsp, &HTTPError{StatusCode: rsp.StatusCode, Message: rsp.Status}
 	}
 
-	return b, nil
+	if f.cache != nil {
+		f.cache.miss()
+		if err := f.cache.put(url, rsp, b); err != nil {
+			return nil, rsp, err
+		}
+	}
+
+	return b, rsp, nil
+}
+
+func hostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
 }
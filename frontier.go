@@ -0,0 +1,507 @@
+package crawler
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Frontier holds the urls waiting to be crawled and decides the order in which
+// they're crawled. Implementations don't need to be safe for concurrent use,
+// the crawler serialises access to the frontier.
+type Frontier interface {
+	Push(*Request) error
+	// Returns nil when the frontier is empty
+	Pop() (*Request, error)
+	Len() int
+	// Discards the urls left and releases any resources, such as files the
+	// frontier spilled to. The crawler closes the frontier once it stops.
+	Close() error
+}
+
+// Request is a url waiting to be crawled.
+type Request struct {
+	URL *url.URL
+	// Number of links followed from the seed url
+	Depth int
+	// Page the url was found on, nil for seed urls
+	Referrer *url.URL
+	// Number of failed attempts to crawl the url so far
+	Attempts int
+	// Host of the seed url, only links within it are followed
+	Site string
+}
+
+// site returns the request's site, falling back to the url's host for
+// requests pushed without one.
+func (r *Request) site() string {
+	if r.Site == "" {
+		return r.URL.Host
+	}
+
+	return r.Site
+}
+
+// MalformedRequestsError is returned by Pop when requests spilled to disk
+// can't be read back. The requests are lost, but the frontier carries on with
+// the others.
+type MalformedRequestsError struct {
+	Path string
+	// Lines of the segment which couldn't be parsed
+	Lines []int
+	// Why the first of them couldn't be parsed
+	Err error
+}
+
+func (e *MalformedRequestsError) Error() string {
+	return fmt.Sprintf("%d malformed requests in %s, first on line %d: %v", len(e.Lines), e.Path, e.Lines[0], e.Err)
+}
+
+func (e *MalformedRequestsError) Unwrap() error {
+	return e.Err
+}
+
+// NewSpillingFrontier creates a FIFO (breadth-first) frontier which keeps up to
+// hotLength urls in memory and spills the overflow to segment files in dir.
+// When dir is empty a temporary directory is created on the first spill.
+func NewSpillingFrontier(dir string, hotLength int) Frontier {
+	if hotLength < 1 {
+		hotLength = 1
+	}
+
+	return &spillingFrontier{dir: dir, hotLength: hotLength}
+}
+
+// spillingFrontier never drops a url, short of a segment getting corrupted
+// which Pop reports as a *MalformedRequestsError: urls are popped from head, spilled
+// segments are loaded into head in order once it's empty, and tail buffers the
+// newest urls until it's large enough to become a segment of its own.
+type spillingFrontier struct {
+	dir       string
+	ownsDir   bool
+	hotLength int
+
+	head     []*Request
+	tail     []*Request
+	segments []string
+	spilled  int
+	seq      int
+}
+
+func (f *spillingFrontier) Push(r *Request) error {
+	if len(f.segments) == 0 && len(f.tail) == 0 && len(f.head) < f.hotLength {
+		f.head = append(f.head, r)
+		return nil
+	}
+
+	f.tail = append(f.tail, r)
+	if len(f.tail) < f.hotLength {
+		return nil
+	}
+
+	return f.spill()
+}
+
+func (f *spillingFrontier) Pop() (*Request, error) {
+	if len(f.head) == 0 {
+		if len(f.segments) > 0 {
+			if err := f.load(); err != nil {
+				return nil, err
+			}
+		} else {
+			f.head, f.tail = f.tail, f.head[:0]
+		}
+	}
+
+	if len(f.head) == 0 {
+		return nil, nil
+	}
+
+	r := f.head[0]
+	f.head[0] = nil
+	f.head = f.head[1:]
+
+	return r, nil
+}
+
+func (f *spillingFrontier) Len() int {
+	return len(f.head) + len(f.tail) + f.spilled
+}
+
+// Close removes the spilled segments, and the directory they were in when
+// it's temporary.
+func (f *spillingFrontier) Close() error {
+	var err error
+	for _, path := range f.segments {
+		if removeErr := os.Remove(path); err == nil {
+			err = removeErr
+		}
+	}
+
+	if f.ownsDir {
+		if removeErr := os.Remove(f.dir); err == nil {
+			err = removeErr
+		}
+		f.dir, f.ownsDir = "", false
+	}
+
+	f.head, f.tail, f.segments, f.spilled = nil, nil, nil, 0
+
+	return err
+}
+
+func (f *spillingFrontier) spill() error {
+	if f.dir == "" {
+		dir, err := ioutil.TempDir("", "frontier")
+		if err != nil {
+			return err
+		}
+
+		f.dir, f.ownsDir = dir, true
+	}
+
+	f.seq++
+	path := filepath.Join(f.dir, fmt.Sprintf("segment-%08d", f.seq))
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, r := range f.tail {
+		fmt.Fprintln(w, formatRequest(r))
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	f.segments = append(f.segments, path)
+	f.spilled += len(f.tail)
+	f.tail = make([]*Request, 0, f.hotLength)
+
+	return nil
+}
+
+func (f *spillingFrontier) load() error {
+	path := f.segments[0]
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count := 0
+	var malformed *MalformedRequestsError
+	s := bufio.NewScanner(file)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		count++
+		r, err := parseRequest(s.Text())
+		if err != nil {
+			if malformed == nil {
+				malformed = &MalformedRequestsError{Path: path, Err: err}
+			}
+			malformed.Lines = append(malformed.Lines, count)
+			continue
+		}
+
+		f.head = append(f.head, r)
+	}
+
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	f.segments = f.segments[1:]
+	f.spilled -= count
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	// Not leaving empty temporary directories behind once everything is back in memory
+	if f.ownsDir && len(f.segments) == 0 {
+		f.dir, f.ownsDir = "", false
+		if err := os.Remove(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+
+	if malformed != nil {
+		return malformed
+	}
+
+	return nil
+}
+
+// NewDFSFrontier creates a LIFO (depth-first) in-memory frontier.
+func NewDFSFrontier() Frontier {
+	return &stackFrontier{}
+}
+
+type stackFrontier struct {
+	stack []*Request
+}
+
+func (f *stackFrontier) Push(r *Request) error {
+	f.stack = append(f.stack, r)
+	return nil
+}
+
+func (f *stackFrontier) Pop() (*Request, error) {
+	if len(f.stack) == 0 {
+		return nil, nil
+	}
+
+	r := f.stack[len(f.stack)-1]
+	f.stack[len(f.stack)-1] = nil
+	f.stack = f.stack[:len(f.stack)-1]
+
+	return r, nil
+}
+
+func (f *stackFrontier) Len() int {
+	return len(f.stack)
+}
+
+func (f *stackFrontier) Close() error {
+	f.stack = nil
+	return nil
+}
+
+// ScoreFunc rates how important a request is, higher scores are crawled first.
+type ScoreFunc func(*Request) float64
+
+// ShallowFirst prefers pages closer to the seed url.
+func ShallowFirst(r *Request) float64 {
+	return -float64(r.Depth)
+}
+
+// PatternWeights scores requests by the weights of the regular expressions
+// matching their url. Weights of all matching patterns are added up.
+func PatternWeights(weights map[string]float64) (ScoreFunc, error) {
+	patterns := make([]*regexp.Regexp, 0, len(weights))
+	values := make([]float64, 0, len(weights))
+
+	for p, w := range weights {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		patterns = append(patterns, re)
+		values = append(values, w)
+	}
+
+	return func(r *Request) float64 {
+		score := 0.0
+		s := r.URL.String()
+		for i, re := range patterns {
+			if re.MatchString(s) {
+				score += values[i]
+			}
+		}
+
+		return score
+	}, nil
+}
+
+// CombineScores adds up the scores of all the functions.
+func CombineScores(fns ...ScoreFunc) ScoreFunc {
+	return func(r *Request) float64 {
+		score := 0.0
+		for _, fn := range fns {
+			score += fn(r)
+		}
+
+		return score
+	}
+}
+
+// NewBestFirstFrontier creates an in-memory frontier which pops the request
+// with the highest score first. Requests with equal scores are popped in the
+// order they were pushed.
+func NewBestFirstFrontier(score ScoreFunc) Frontier {
+	return &bestFirstFrontier{score: score}
+}
+
+type scoredRequest struct {
+	*Request
+	score float64
+	seq   int
+}
+
+type bestFirstFrontier struct {
+	score ScoreFunc
+	heap  scoredHeap
+	seq   int
+}
+
+func (f *bestFirstFrontier) Push(r *Request) error {
+	f.seq++
+	heap.Push(&f.heap, &scoredRequest{Request: r, score: f.score(r), seq: f.seq})
+
+	return nil
+}
+
+func (f *bestFirstFrontier) Pop() (*Request, error) {
+	if f.heap.Len() == 0 {
+		return nil, nil
+	}
+
+	return heap.Pop(&f.heap).(*scoredRequest).Request, nil
+}
+
+func (f *bestFirstFrontier) Len() int {
+	return f.heap.Len()
+}
+
+func (f *bestFirstFrontier) Close() error {
+	f.heap = nil
+	return nil
+}
+
+type scoredHeap []*scoredRequest
+
+func (h scoredHeap) Len() int      { return len(h) }
+func (h scoredHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h scoredHeap) Less(i, j int) bool {
+	if h[i].score == h[j].score {
+		return h[i].seq < h[j].seq
+	}
+
+	return h[i].score > h[j].score
+}
+
+func (h *scoredHeap) Push(x interface{}) {
+	*h = append(*h, x.(*scoredRequest))
+}
+
+func (h *scoredHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return x
+}
+
+// NewRoundRobinFrontier creates an in-memory frontier which keeps a FIFO queue
+// per host and takes turns between hosts so that no single host can starve
+// the others.
+func NewRoundRobinFrontier() Frontier {
+	return &roundRobinFrontier{queues: make(map[string][]*Request)}
+}
+
+type roundRobinFrontier struct {
+	queues map[string][]*Request
+	// Hosts with a non-empty queue in the order they're served
+	hosts []string
+	len   int
+}
+
+func (f *roundRobinFrontier) Push(r *Request) error {
+	q, ok := f.queues[r.URL.Host]
+	if !ok || len(q) == 0 {
+		f.hosts = append(f.hosts, r.URL.Host)
+	}
+
+	f.queues[r.URL.Host] = append(q, r)
+	f.len++
+
+	return nil
+}
+
+func (f *roundRobinFrontier) Pop() (*Request, error) {
+	if len(f.hosts) == 0 {
+		return nil, nil
+	}
+
+	host := f.hosts[0]
+	f.hosts = f.hosts[1:]
+
+	q := f.queues[host]
+	r := q[0]
+	q[0] = nil
+	q = q[1:]
+
+	if len(q) == 0 {
+		delete(f.queues, host)
+	} else {
+		f.queues[host] = q
+		f.hosts = append(f.hosts, host)
+	}
+
+	f.len--
+
+	return r, nil
+}
+
+func (f *roundRobinFrontier) Len() int {
+	return f.len
+}
+
+func (f *roundRobinFrontier) Close() error {
+	f.queues, f.hosts, f.len = make(map[string][]*Request), nil, 0
+	return nil
+}
+
+// formatRequest serialises a request as tab separated fields: the depth, the
+// url, the referrer, which is empty for seed urls, the site and the attempts.
+// Urls can't contain tabs as url.Parse rejects control characters, while they
+// can contain spaces.
+func formatRequest(r *Request) string {
+	referrer := ""
+	if r.Referrer != nil {
+		referrer = r.Referrer.String()
+	}
+
+	return strings.Join([]string{strconv.Itoa(r.Depth), r.URL.String(), referrer, r.Site, strconv.Itoa(r.Attempts)}, "\t")
+}
+
+func parseRequest(s string) (*Request, error) {
+	fields := strings.Split(s, "\t")
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Malformed request %q", s)
+	}
+
+	depth, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	attempts, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Request{URL: u, Depth: depth, Site: fields[3], Attempts: attempts}
+	if fields[2] != "" {
+		if r.Referrer, err = url.Parse(fields[2]); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
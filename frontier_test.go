@@ -0,0 +1,354 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	stdmock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillingFrontierKeepsFIFOOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frontier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f := NewSpillingFrontier(dir, 2)
+
+	for i := 0; i < 7; i++ {
+		u, _ := url.Parse(fmt.Sprintf("https://google.com/%d", i))
+		require.NoError(t, f.Push(&Request{URL: u}))
+	}
+
+	assert.Equal(t, 7, f.Len())
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+
+	for i := 0; i < 7; i++ {
+		r, err := f.Pop()
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		assert.Equal(t, fmt.Sprintf("https://google.com/%d", i), r.URL.String())
+
+		// Interleaving pushes with pops
+		if i == 3 {
+			extra, _ := url.Parse("https://google.com/extra")
+			require.NoError(t, f.Push(&Request{URL: extra}))
+		}
+	}
+
+	r, err := f.Pop()
+	require.NoError(t, err)
+	assert.Equal(t, "https://google.com/extra", r.URL.String())
+
+	r, err = f.Pop()
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	assert.Equal(t, 0, f.Len())
+
+	files, _ = ioutil.ReadDir(dir)
+	assert.Len(t, files, 0)
+}
+
+func TestSpillingFrontierRemovesTemporaryDirectory(t *testing.T) {
+	f := NewSpillingFrontier("", 1).(*spillingFrontier)
+
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse(fmt.Sprintf("https://google.com/%d", i))
+		require.NoError(t, f.Push(&Request{URL: u}))
+	}
+
+	dir := f.dir
+	require.NotEmpty(t, dir)
+
+	for f.Len() > 0 {
+		_, err := f.Pop()
+		require.NoError(t, err)
+	}
+
+	_, err := os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCrawlerNeverDropsSpilledURLs(t *testing.T) {
+	s := setup(3, 0, 100)
+	c := NewCrawler(s.p, s.f, NewUniqueSet(), Concurrency(3), Queue(NewSpillingFrontier("", 2)))
+	pages := make([]*url.URL, 50)
+
+	for i := 0; i < len(pages); i++ {
+		pages[i], _ = url.Parse(fmt.Sprintf("https://google.com/page-%d", i))
+		s.f.On("Fetch", pages[i].String()).Once().Return([]byte("body"), nil)
+		s.p.On("Parse", pages[i], []byte("body")).Once().Return(pages, []*url.URL{}, nil)
+	}
+
+	c.Enqueue(pages[0])
+
+	p, e := run(c, pages[0], context.Background())
+
+	assert.Len(t, p, len(pages))
+	assert.Len(t, e, 0)
+
+	s.AssertExpectations(t)
+}
+
+func TestSpillingFrontierCloseRemovesSegments(t *testing.T) {
+	f := NewSpillingFrontier("", 1).(*spillingFrontier)
+
+	for i := 0; i < 5; i++ {
+		u, _ := url.Parse(fmt.Sprintf("https://google.com/%d", i))
+		require.NoError(t, f.Push(&Request{URL: u}))
+	}
+
+	dir := f.dir
+	require.NotEmpty(t, dir)
+
+	require.NoError(t, f.Close())
+	assert.Equal(t, 0, f.Len())
+
+	_, err := os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// failingFrontier fails every pop after the first.
+type failingFrontier struct {
+	Frontier
+	pops   int
+	closed bool
+}
+
+func (f *failingFrontier) Pop() (*Request, error) {
+	f.pops++
+	if f.pops > 1 {
+		return nil, fmt.Errorf("Disk on fire")
+	}
+
+	return f.Frontier.Pop()
+}
+
+func (f *failingFrontier) Close() error {
+	f.closed = true
+	return f.Frontier.Close()
+}
+
+func TestCrawlerStopsWhenTheFrontierFails(t *testing.T) {
+	s := setup(1, 0, 100)
+	f := &failingFrontier{Frontier: NewSpillingFrontier("", 10)}
+	c := NewCrawler(s.p, s.f, NewUniqueSet(), Concurrency(2), Queue(f))
+
+	root, _ := url.Parse("https://google.com")
+	about, _ := url.Parse("https://google.com/about")
+	s.f.On("Fetch", root.String()).Once().Return([]byte("body"), nil)
+	s.p.On("Parse", root, []byte("body")).Once().Return([]*url.URL{about}, []*url.URL{}, nil)
+
+	require.NoError(t, c.Enqueue(root))
+	p, e := run(c, root, context.Background())
+
+	assert.Len(t, p, 1)
+	require.NotEmpty(t, e)
+	assert.Contains(t, e[0].Error(), "Disk on fire")
+	assert.True(t, f.closed)
+
+	s.AssertExpectations(t)
+}
+
+func TestSpillingFrontierReportsMalformedRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frontier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f := NewSpillingFrontier(dir, 2).(*spillingFrontier)
+	pushAll(t, f, request("https://google.com/0", 0), request("https://google.com/1", 0), request("https://google.com/2", 0), request("https://google.com/3", 0))
+	require.Len(t, f.segments, 1)
+
+	segment := f.segments[0]
+	b, err := ioutil.ReadFile(segment)
+	require.NoError(t, err)
+	// Garbling the first of the two spilled requests
+	b = append([]byte("garbage"), b[bytes.IndexByte(b, '\n'):]...)
+	require.NoError(t, ioutil.WriteFile(segment, b, 0644))
+
+	assert.Equal(t, "https://google.com/0", mustPop(t, f).URL.String())
+	assert.Equal(t, "https://google.com/1", mustPop(t, f).URL.String())
+
+	_, err = f.Pop()
+	var malformed *MalformedRequestsError
+	require.True(t, errors.As(err, &malformed))
+	assert.Equal(t, segment, malformed.Path)
+	assert.Equal(t, []int{1}, malformed.Lines)
+
+	assert.Equal(t, []string{"https://google.com/3"}, popAll(t, f))
+}
+
+func mustPop(t *testing.T, f Frontier) *Request {
+	r, err := f.Pop()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+
+	return r
+}
+
+// lossyFrontier loses the second request popped, as if its segment was corrupted.
+type lossyFrontier struct {
+	Frontier
+	pops int
+}
+
+func (f *lossyFrontier) Pop() (*Request, error) {
+	r, err := f.Frontier.Pop()
+	f.pops++
+	if r != nil && f.pops == 2 {
+		return nil, &MalformedRequestsError{Path: "segment-00000001", Lines: []int{1}, Err: fmt.Errorf("Garbled")}
+	}
+
+	return r, err
+}
+
+func TestCrawlerCarriesOnAfterMalformedRequests(t *testing.T) {
+	s := setup(1, 0, 100)
+	c := NewCrawler(s.p, s.f, NewUniqueSet(), Concurrency(1), Queue(&lossyFrontier{Frontier: NewSpillingFrontier("", 10)}))
+
+	root, _ := url.Parse("https://google.com")
+	links := make([]*url.URL, 3)
+	for i := range links {
+		links[i], _ = url.Parse(fmt.Sprintf("https://google.com/%d", i))
+	}
+
+	s.f.On("Fetch", stdmock.Anything).Return([]byte("body"), nil)
+	s.p.On("Parse", root, []byte("body")).Return(links, []*url.URL{}, nil)
+	s.p.On("Parse", stdmock.Anything, []byte("body")).Return([]*url.URL{}, []*url.URL{}, nil)
+
+	require.NoError(t, c.Enqueue(root))
+	p, e := run(c, root, context.Background())
+
+	// The first link is lost, the crawl doesn't wait for it forever
+	assert.Len(t, p, 3)
+	require.Len(t, e, 1)
+	assert.Contains(t, e[0].Error(), "1 malformed requests in segment-00000001")
+}
+
+func TestRequestsRoundTrip(t *testing.T) {
+	spaced, _ := url.Parse("https://google.com/search?q=monzo bank")
+	referrer, _ := url.Parse("https://google.com/results?q=a b")
+	seed, _ := url.Parse("https://google.com")
+
+	for _, r := range []*Request{
+		{URL: seed, Site: "google.com"},
+		{URL: spaced, Depth: 2, Referrer: referrer, Site: "google.com", Attempts: 1},
+	} {
+		parsed, err := parseRequest(formatRequest(r))
+		require.NoError(t, err)
+		assert.Equal(t, r, parsed)
+	}
+}
+
+func popAll(t *testing.T, f Frontier) []string {
+	urls := make([]string, 0)
+	for f.Len() > 0 {
+		r, err := f.Pop()
+		require.NoError(t, err)
+		urls = append(urls, r.URL.String())
+	}
+
+	return urls
+}
+
+func pushAll(t *testing.T, f Frontier, requests ...*Request) {
+	for _, r := range requests {
+		require.NoError(t, f.Push(r))
+	}
+}
+
+func request(rawurl string, depth int) *Request {
+	u, _ := url.Parse(rawurl)
+	return &Request{URL: u, Depth: depth}
+}
+
+func TestDFSFrontier(t *testing.T) {
+	f := NewDFSFrontier()
+	pushAll(t, f, request("https://google.com/a", 0), request("https://google.com/b", 1))
+
+	assert.Equal(t, []string{"https://google.com/b", "https://google.com/a"}, popAll(t, f))
+}
+
+func TestBestFirstFrontier(t *testing.T) {
+	weights, err := PatternWeights(map[string]float64{"/docs/": 5, "/blog/": -5})
+	require.NoError(t, err)
+
+	f := NewBestFirstFrontier(CombineScores(ShallowFirst, weights))
+	pushAll(t, f,
+		request("https://google.com/blog/1", 1),
+		request("https://google.com/about", 2),
+		request("https://google.com/docs/1", 3),
+		request("https://google.com/tos", 2),
+		request("https://google.com", 0),
+	)
+
+	expected := []string{
+		"https://google.com/docs/1",
+		"https://google.com",
+		"https://google.com/about",
+		"https://google.com/tos",
+		"https://google.com/blog/1",
+	}
+	assert.Equal(t, expected, popAll(t, f))
+}
+
+func TestPatternWeightsRejectsInvalidPatterns(t *testing.T) {
+	_, err := PatternWeights(map[string]float64{"(": 1})
+	assert.Error(t, err)
+}
+
+func TestRoundRobinFrontier(t *testing.T) {
+	f := NewRoundRobinFrontier()
+	pushAll(t, f,
+		request("https://a.com/1", 0),
+		request("https://a.com/2", 0),
+		request("https://a.com/3", 0),
+		request("https://b.com/1", 0),
+		request("https://c.com/1", 0),
+		request("https://c.com/2", 0),
+	)
+
+	expected := []string{
+		"https://a.com/1",
+		"https://b.com/1",
+		"https://c.com/1",
+		"https://a.com/2",
+		"https://c.com/2",
+		"https://a.com/3",
+	}
+	assert.Equal(t, expected, popAll(t, f))
+}
+
+func TestCrawlerFollowsFrontierOrder(t *testing.T) {
+	s := setup(1, 0, 100)
+	c := NewCrawler(s.p, s.f, NewUniqueSet(), Concurrency(1), Queue(NewDFSFrontier()))
+
+	root, _ := url.Parse("https://google.com")
+	a, _ := url.Parse("https://google.com/a")
+	b, _ := url.Parse("https://google.com/b")
+	bb, _ := url.Parse("https://google.com/b/b")
+
+	s.f.On("Fetch", stdmock.Anything).Return([]byte("body"), nil)
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{a, b}, []*url.URL{}, nil)
+	s.p.On("Parse", b, []byte("body")).Return([]*url.URL{bb}, []*url.URL{}, nil)
+	s.p.On("Parse", bb, []byte("body")).Return([]*url.URL{}, []*url.URL{}, nil)
+	s.p.On("Parse", a, []byte("body")).Return([]*url.URL{}, []*url.URL{}, nil)
+
+	c.Enqueue(root)
+
+	p, _ := run(c, root, context.Background())
+
+	require.Len(t, p, 4)
+	assert.Equal(t, []string{root.String(), b.String(), bb.String(), a.String()},
+		[]string{p[0].String(), p[1].String(), p[2].String(), p[3].String()})
+	assert.Equal(t, []int{0, 1, 2, 1}, []int{p[0].Depth, p[1].Depth, p[2].Depth, p[3].Depth})
+}
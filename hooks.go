@@ -0,0 +1,84 @@
+package crawler
+
+import "time"
+
+// Hooks are notified of crawl events. They're called synchronously from the
+// crawler's workers, so they must be safe for concurrent use and a slow hook
+// slows the crawl down. Embed NoopHooks to only implement some of them.
+type Hooks interface {
+	// Called once for urls which haven't been seen before and which the frontier
+	// has room for, returning false drops the url. Not called for the urls
+	// restored from a journal with Resume
+	OnEnqueue(*Request) bool
+	// Called for urls which look like crawler traps
+	OnSkip(*Request, SkipReason)
+	OnFetchStart(*Request)
+	// Err is the fetch error, if any
+	OnFetchDone(r *Request, latency time.Duration, err error)
+	OnParsed(*Page)
+	// Called for every error sent on the Run error channel
+	OnError(error)
+	// Called once all workers have stopped, before the Run channels are closed
+	OnFinish(Stats)
+}
+
+// NoopHooks implements Hooks without doing anything.
+type NoopHooks struct{}
+
+func (NoopHooks) OnEnqueue(*Request) bool                    { return true }
+func (NoopHooks) OnSkip(*Request, SkipReason)                {}
+func (NoopHooks) OnFetchStart(*Request)                      {}
+func (NoopHooks) OnFetchDone(*Request, time.Duration, error) {}
+func (NoopHooks) OnParsed(*Page)                             {}
+func (NoopHooks) OnError(error)                              {}
+func (NoopHooks) OnFinish(Stats)                             {}
+
+// hookList calls hooks in the order they were registered. A url is dropped
+// as soon as one of the hooks rejects it.
+type hookList []Hooks
+
+func (l hookList) OnEnqueue(r *Request) bool {
+	for _, h := range l {
+		if !h.OnEnqueue(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (l hookList) OnSkip(r *Request, reason SkipReason) {
+	for _, h := range l {
+		h.OnSkip(r, reason)
+	}
+}
+
+func (l hookList) OnFetchStart(r *Request) {
+	for _, h := range l {
+		h.OnFetchStart(r)
+	}
+}
+
+func (l hookList) OnFetchDone(r *Request, latency time.Duration, err error) {
+	for _, h := range l {
+		h.OnFetchDone(r, latency, err)
+	}
+}
+
+func (l hookList) OnParsed(p *Page) {
+	for _, h := range l {
+		h.OnParsed(p)
+	}
+}
+
+func (l hookList) OnError(err error) {
+	for _, h := range l {
+		h.OnError(err)
+	}
+}
+
+func (l hookList) OnFinish(s Stats) {
+	for _, h := range l {
+		h.OnFinish(s)
+	}
+}
@@ -0,0 +1,127 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingHooks struct {
+	NoopHooks
+	mu     sync.Mutex
+	events []string
+	stats  *Stats
+}
+
+func (h *recordingHooks) record(event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.events = append(h.events, event)
+}
+
+func (h *recordingHooks) OnEnqueue(r *Request) bool {
+	h.record("enqueue " + r.URL.Path)
+	return !strings.HasPrefix(r.URL.Path, "/private")
+}
+
+func (h *recordingHooks) OnSkip(r *Request, reason SkipReason) {
+	h.record("skip " + r.URL.Path + " " + string(reason))
+}
+
+func (h *recordingHooks) OnFetchStart(r *Request) {
+	h.record("fetch " + r.URL.Path)
+}
+
+func (h *recordingHooks) OnFetchDone(r *Request, latency time.Duration, err error) {
+	h.record("fetched " + r.URL.Path)
+}
+
+func (h *recordingHooks) OnParsed(p *Page) {
+	h.record("parsed " + p.Path)
+}
+
+func (h *recordingHooks) OnError(err error) {
+	h.record("error")
+}
+
+func (h *recordingHooks) OnFinish(s Stats) {
+	h.record("finish")
+	h.stats = &s
+}
+
+func TestHooksAreCalledForCrawlEvents(t *testing.T) {
+	root, _ := url.Parse("https://google.com/")
+	private, _ := url.Parse("https://google.com/private")
+	deep, _ := url.Parse("https://google.com/a/b/c")
+
+	h := &recordingHooks{}
+	s := setup(1, 100, 100)
+	c := NewCrawler(s.p, s.f, NewUniqueSet(),
+		Concurrency(1),
+		DetectTraps(NewTrapDetector(TrapLimits{MaxPathDepth: 2})),
+		RegisterHooks(h),
+	)
+
+	s.f.On("Fetch", root.String()).Once().Return([]byte("body"), nil)
+	s.p.On("Parse", root, []byte("body")).Once().Return([]*url.URL{private, deep}, []*url.URL{}, nil)
+
+	require.NoError(t, c.Enqueue(root))
+	_, errs := run(c, root, context.Background())
+	require.Len(t, errs, 1)
+
+	assert.Equal(t, []string{
+		"enqueue /",
+		"fetch /",
+		"fetched /",
+		"parsed /",
+		"enqueue /private",
+		"skip /a/b/c path too deep",
+		"error",
+		"finish",
+	}, h.events)
+
+	require.NotNil(t, h.stats)
+	assert.Equal(t, 1, h.stats.Crawled)
+
+	s.AssertExpectations(t)
+}
+
+func TestHooksDontSeeUrlsTheFrontierHasNoRoomFor(t *testing.T) {
+	root, _ := url.Parse("https://google.com/")
+	about, _ := url.Parse("https://google.com/about")
+	tos, _ := url.Parse("https://google.com/tos")
+
+	h := &recordingHooks{}
+	s := setup(1, 1, 100, RegisterHooks(h))
+
+	s.f.On("Fetch", root.String()).Once().Return([]byte("root"), nil)
+	s.p.On("Parse", root, []byte("root")).Once().Return([]*url.URL{about, tos}, []*url.URL{}, nil)
+	s.f.On("Fetch", about.String()).Once().Return([]byte("about"), nil)
+	s.p.On("Parse", about, []byte("about")).Once().Return([]*url.URL{tos}, []*url.URL{}, nil)
+	s.f.On("Fetch", tos.String()).Once().Return([]byte("tos"), nil)
+	s.p.On("Parse", tos, []byte("tos")).Once().Return([]*url.URL{}, []*url.URL{}, nil)
+
+	require.NoError(t, s.c.Enqueue(root))
+	pages, errs := run(s.c, root, context.Background())
+	require.Len(t, pages, 3)
+	require.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], ErrQueueLimitReached))
+
+	var enqueued []string
+	for _, e := range h.events {
+		if strings.HasPrefix(e, "enqueue ") {
+			enqueued = append(enqueued, e)
+		}
+	}
+	assert.Equal(t, []string{"enqueue /", "enqueue /about", "enqueue /tos"}, enqueued)
+
+	s.AssertExpectations(t)
+}
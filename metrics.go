@@ -0,0 +1,152 @@
+package crawler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects fetch metrics and exposes them along with the crawl's stats
+// in the Prometheus text format. Attach it to the fetcher with InstrumentFetcher
+// and to the crawler with Instrument.
+type Metrics struct {
+	mu    sync.Mutex
+	hosts map[string]*hostMetrics
+	stats func() Stats
+}
+
+type hostMetrics struct {
+	// Responses by status code, "error" counts requests which failed without a response
+	requests map[string]int
+	bytes    int64
+	latency  latencyHistogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{hosts: make(map[string]*hostMetrics)}
+}
+
+func (m *Metrics) observeFetch(host string, status int, bytes int, latency time.Duration) {
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.hosts[host]
+	if !ok {
+		h = &hostMetrics{requests: make(map[string]int)}
+		m.hosts[host] = h
+	}
+
+	h.requests[code]++
+	h.bytes += int64(bytes)
+	h.latency.observe(latency)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	b := &bytes.Buffer{}
+
+	m.mu.Lock()
+	stats := m.stats
+	hosts := make([]string, 0, len(m.hosts))
+	for host := range m.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	writeHeader(b, "crawler_requests_total", "counter", "Fetched urls by host and response status.")
+	for _, host := range hosts {
+		h := m.hosts[host]
+		codes := make([]string, 0, len(h.requests))
+		for code := range h.requests {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+
+		for _, code := range codes {
+			fmt.Fprintf(b, "crawler_requests_total{host=%s,code=%s} %d\n", quoteLabel(host), quoteLabel(code), h.requests[code])
+		}
+	}
+
+	writeHeader(b, "crawler_downloaded_bytes_total", "counter", "Size of fetched bodies.")
+	for _, host := range hosts {
+		fmt.Fprintf(b, "crawler_downloaded_bytes_total{host=%s} %d\n", quoteLabel(host), m.hosts[host].bytes)
+	}
+
+	writeHeader(b, "crawler_fetch_duration_seconds", "histogram", "Time it took to fetch a url.")
+	for _, host := range hosts {
+		writeHistogram(b, "crawler_fetch_duration_seconds", "host="+quoteLabel(host), &m.hosts[host].latency)
+	}
+	m.mu.Unlock()
+
+	if stats != nil {
+		s := stats()
+
+		writeMetric(b, "crawler_queue_length", "gauge", "Urls waiting in the frontier.", s.Queued)
+		writeMetric(b, "crawler_in_flight_requests", "gauge", "Urls being crawled.", s.InFlight)
+		writeMetric(b, "crawler_enqueued_urls_total", "counter", "Urls accepted into the frontier.", s.Seen)
+		writeMetric(b, "crawler_skipped_urls_total", "counter", "Urls skipped as likely crawler traps.", s.Skipped)
+		writeMetric(b, "crawler_retries_total", "counter", "Congested urls put back into the frontier.", s.Retries)
+		writeMetric(b, "crawler_parse_errors_total", "counter", "Pages which couldn't be parsed.", s.ParseErrors)
+
+		names := make([]string, 0, len(s.Hosts))
+		for host := range s.Hosts {
+			names = append(names, host)
+		}
+		sort.Strings(names)
+
+		writeHeader(b, "crawler_pages_total", "counter", "Crawled urls by host and result.")
+		for _, host := range names {
+			fmt.Fprintf(b, "crawler_pages_total{host=%s,result=\"crawled\"} %d\n", quoteLabel(host), s.Hosts[host].Crawled)
+			fmt.Fprintf(b, "crawler_pages_total{host=%s,result=\"failed\"} %d\n", quoteLabel(host), s.Hosts[host].Failed)
+		}
+	}
+
+	return b.WriteTo(w)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value int) {
+	writeHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *latencyHistogram) {
+	cumulative := 0
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatSeconds(bound), cumulative)
+	}
+
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatSeconds(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
@@ -0,0 +1,77 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetcherMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	m := NewMetrics()
+	f := NewFetcher(srv.Client(), InstrumentFetcher(m))
+
+	_, err := f.Fetch(srv.URL)
+	require.NoError(t, err)
+	_, err = f.Fetch(srv.URL + "/missing")
+	require.Error(t, err)
+
+	b := &bytes.Buffer{}
+	_, err = m.WriteTo(b)
+	require.NoError(t, err)
+
+	host := quoteLabel(strings.TrimPrefix(srv.URL, "http://"))
+	out := b.String()
+	assert.Contains(t, out, "# TYPE crawler_requests_total counter\n")
+	assert.Contains(t, out, "crawler_requests_total{host="+host+",code=\"200\"} 1\n")
+	assert.Contains(t, out, "crawler_requests_total{host="+host+",code=\"404\"} 1\n")
+	assert.Contains(t, out, "crawler_fetch_duration_seconds_bucket{host="+host+",le=\"+Inf\"} 2\n")
+	assert.Contains(t, out, "crawler_fetch_duration_seconds_count{host="+host+"} 2\n")
+	// No crawler is attached
+	assert.NotContains(t, out, "crawler_queue_length")
+}
+
+func TestCrawlerMetrics(t *testing.T) {
+	m := NewMetrics()
+	s := setup(1, 100, 100)
+	c := NewCrawler(s.p, s.f, NewUniqueSet(), Instrument(m))
+	root, _ := url.Parse("https://google.com")
+
+	s.f.On("Fetch", root.String()).Once().Return([]byte("<html"), nil)
+	s.p.On("Parse", root, []byte("<html")).Once().Return([]*url.URL(nil), []*url.URL(nil), assert.AnError)
+
+	c.Enqueue(root)
+	run(c, root, context.Background())
+
+	b := &bytes.Buffer{}
+	_, err := m.WriteTo(b)
+	require.NoError(t, err)
+
+	out := b.String()
+	assert.Contains(t, out, "crawler_queue_length 0\n")
+	assert.Contains(t, out, "crawler_enqueued_urls_total 1\n")
+	assert.Contains(t, out, "crawler_parse_errors_total 1\n")
+	assert.Contains(t, out, "crawler_pages_total{host=\"google.com\",result=\"failed\"} 1\n")
+
+	s.AssertExpectations(t)
+}
+
+func TestQuoteLabel(t *testing.T) {
+	assert.Equal(t, `"a\"b\\c\nd"`, quoteLabel("a\"b\\c\nd"))
+}
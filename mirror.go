@@ -0,0 +1,513 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+)
+
+const mirrorManifest = ".mirror-manifest"
+
+// Mirror is a pipeline stage which saves crawled pages and the assets they
+// reference under a directory, rewriting links to relative local paths so the
+// copy can be browsed offline. Files are laid out as <host>/<path>.
+//
+// A manifest of content hashes is kept in the directory so that a refresh only
+// rewrites pages which changed and only fetches assets which are missing.
+type Mirror struct {
+	dir     string
+	fetcher Fetcher
+
+	mu sync.Mutex
+	// Content hash by url, loaded from the previous run
+	manifest map[string]string
+	// Assets already handled by one of the workers during this run
+	claimed map[string]bool
+	summary MirrorSummary
+}
+
+// MirrorSummary counts the files handled during a run.
+type MirrorSummary struct {
+	Pages     int
+	Assets    int
+	Unchanged int
+}
+
+// OpenMirror opens the mirror in dir, creating it if needed. Assets are
+// downloaded with the fetcher.
+func OpenMirror(dir string, f Fetcher) (*Mirror, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	m := &Mirror{
+		dir:      dir,
+		fetcher:  f,
+		manifest: make(map[string]string),
+		claimed:  make(map[string]bool),
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Process saves the page along with its assets. It fails when one of the
+// assets can't be saved, but the page and the remaining assets are still saved.
+func (m *Mirror) Process(p *Page) (Action, error) {
+	u := &p.URL
+	from := MirrorPath(u, true)
+
+	// Pages which aren't HTML are saved as they are
+	body, assets := p.Body, []*url.URL(nil)
+	if isHTML(p.ContentType) {
+		body, assets = rewriteHTML(u, from, p.Body)
+	}
+
+	if err := m.write(u, from, p.Body, body, true); err != nil {
+		return Continue, err
+	}
+
+	var failed error
+	for _, a := range assets {
+		if err := m.saveAsset(a); err != nil && failed == nil {
+			failed = err
+		}
+	}
+
+	return Continue, failed
+}
+
+// isHTML treats pages without a Content-Type as HTML, as the parser does.
+func isHTML(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+func (m *Mirror) Summary() MirrorSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.summary
+}
+
+// Close saves the manifest for the next refresh.
+func (m *Mirror) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tmp := filepath.Join(m.dir, mirrorManifest+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for u, hash := range m.manifest {
+		fmt.Fprintf(w, "%s %s\n", hash, u)
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(m.dir, mirrorManifest))
+}
+
+func (m *Mirror) load() error {
+	f, err := os.Open(filepath.Join(m.dir, mirrorManifest))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		if parts := strings.SplitN(s.Text(), " ", 2); len(parts) == 2 {
+			m.manifest[parts[1]] = parts[0]
+		}
+	}
+
+	return s.Err()
+}
+
+func (m *Mirror) saveAsset(u *url.URL) error {
+	k := mirrorKey(u)
+	p := MirrorPath(u, false)
+
+	m.mu.Lock()
+	if m.claimed[k] {
+		m.mu.Unlock()
+		return nil
+	}
+	m.claimed[k] = true
+	_, known := m.manifest[k]
+	m.mu.Unlock()
+
+	// Assets are usually fingerprinted, so ones saved by a previous run are kept
+	if known && m.exists(p) {
+		m.mu.Lock()
+		m.summary.Unchanged++
+		m.mu.Unlock()
+
+		return nil
+	}
+
+	b, err := m.fetcher.Fetch(u.String())
+	if err != nil {
+		return fmt.Errorf("Failed to mirror %s: %w", u, err)
+	}
+
+	content := b
+	var refs []*url.URL
+	if strings.HasSuffix(strings.ToLower(u.Path), ".css") {
+		content, refs = rewriteCSS(u, p, b)
+	}
+
+	if err := m.write(u, p, b, content, false); err != nil {
+		return err
+	}
+
+	for _, r := range refs {
+		if err := m.saveAsset(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write saves content to the local path unless the original body hasn't
+// changed since it was last saved.
+func (m *Mirror) write(u *url.URL, p string, original, content []byte, page bool) error {
+	k := mirrorKey(u)
+	sum := sha256.Sum256(original)
+	hash := hex.EncodeToString(sum[:])
+
+	m.mu.Lock()
+	unchanged := m.manifest[k] == hash
+	m.mu.Unlock()
+
+	if unchanged && m.exists(p) {
+		m.mu.Lock()
+		m.summary.Unchanged++
+		m.mu.Unlock()
+
+		return nil
+	}
+
+	file := filepath.Join(m.dir, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(file, content, 0644); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.manifest[k] = hash
+	if page {
+		m.summary.Pages++
+	} else {
+		m.summary.Assets++
+	}
+
+	return nil
+}
+
+func (m *Mirror) exists(p string) bool {
+	_, err := os.Stat(filepath.Join(m.dir, filepath.FromSlash(p)))
+	return err == nil
+}
+
+func mirrorKey(u *url.URL) string {
+	k := *u
+	k.Fragment = ""
+
+	return k.String()
+}
+
+// MirrorPath maps a url to a slash separated path relative to the mirror
+// directory. Directory urls are saved as index.html, pages without an
+// extension get .html so they open in a browser, query strings are hashed
+// into the file name and characters which aren't safe in file names are
+// replaced.
+func MirrorPath(u *url.URL, page bool) string {
+	segments := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if last := segments[len(segments)-1]; last == "" {
+		segments[len(segments)-1] = "index.html"
+	}
+
+	for i, s := range segments {
+		segments[i] = safeSegment(s)
+	}
+
+	name := segments[len(segments)-1]
+	ext := path.Ext(name)
+	name = strings.TrimSuffix(name, ext)
+	if page && ext == "" {
+		ext = ".html"
+	}
+
+	if u.RawQuery != "" {
+		name += "_" + shortHash(u.RawQuery)
+	}
+
+	segments[len(segments)-1] = name + ext
+
+	return safeSegment(strings.ToLower(u.Host)) + "/" + strings.Join(segments, "/")
+}
+
+const maxSegmentLength = 128
+
+func safeSegment(s string) string {
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.', r == '-', r == '_', r == '~':
+			return r
+		}
+
+		return '_'
+	}, s)
+
+	// Keeping the extension of long names
+	if len(safe) > maxSegmentLength {
+		ext := path.Ext(safe)
+		if len(ext) > 16 {
+			ext = ""
+		}
+
+		safe = safe[:maxSegmentLength-len(ext)-9] + "_" + shortHash(s) + ext
+	}
+
+	return safe
+}
+
+func shortHash(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:4])
+}
+
+// relativePath returns the path from the directory of the from file to the to file.
+func relativePath(from, to string) string {
+	fromDirs := strings.Split(path.Dir(from), "/")
+	toParts := strings.Split(to, "/")
+
+	common := 0
+	for common < len(fromDirs) && common < len(toParts)-1 && fromDirs[common] == toParts[common] {
+		common++
+	}
+
+	return strings.Repeat("../", len(fromDirs)-common) + strings.Join(toParts[common:], "/")
+}
+
+// localReference resolves ref against base and returns its path relative to
+// the from file, or false when the reference can't be mirrored. Pages are only
+// crawled on the same host, assets are mirrored from any host.
+func localReference(base *url.URL, from, ref string, page bool) (*url.URL, string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return nil, "", false
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, "", false
+	}
+
+	u = base.ResolveReference(u)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "", false
+	}
+
+	if page && u.Host != base.Host {
+		return nil, "", false
+	}
+
+	rel := relativePath(from, MirrorPath(u, page))
+	if u.Fragment != "" {
+		rel += "#" + u.EscapedFragment()
+	}
+
+	return u, rel, true
+}
+
+// rewriteHTML points references to pages and assets at their local copies and
+// returns the assets which need to be saved. Markup which doesn't need to
+// change is copied as is.
+func rewriteHTML(base *url.URL, from string, body []byte) ([]byte, []*url.URL) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	out := bytes.Buffer{}
+	var assets []*url.URL
+	inStyle := false
+
+	for {
+		tt := z.Next()
+
+		switch tt {
+		case html.ErrorToken:
+			return out.Bytes(), assets
+		case html.StartTagToken, html.SelfClosingTagToken:
+			raw := append([]byte(nil), z.Raw()...)
+			t := z.Token()
+			changed := false
+
+			for i, a := range t.Attr {
+				if a.Key == "style" {
+					css, refs := rewriteCSS(base, from, []byte(a.Val))
+					t.Attr[i].Val = string(css)
+					assets = append(assets, refs...)
+					changed = changed || len(refs) > 0
+					continue
+				}
+
+				page, ok := referenceKind(&t, a.Key)
+				if !ok {
+					continue
+				}
+
+				if u, rel, ok := localReference(base, from, a.Val, page); ok {
+					t.Attr[i].Val = rel
+					changed = true
+					if !page {
+						assets = append(assets, u)
+					}
+				}
+			}
+
+			if tt == html.StartTagToken && t.Data == "style" {
+				inStyle = true
+			}
+
+			if changed {
+				out.WriteString(t.String())
+			} else {
+				out.Write(raw)
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "style" {
+				inStyle = false
+			}
+			out.Write(z.Raw())
+		case html.TextToken:
+			if !inStyle {
+				out.Write(z.Raw())
+				break
+			}
+
+			css, refs := rewriteCSS(base, from, z.Raw())
+			out.Write(css)
+			assets = append(assets, refs...)
+		default:
+			out.Write(z.Raw())
+		}
+	}
+}
+
+// referenceKind reports whether the attribute references a page or an asset.
+func referenceKind(t *html.Token, attr string) (page bool, ok bool) {
+	switch {
+	case attr == "href" && (t.Data == "a" || t.Data == "area"):
+		return true, true
+	case attr == "href" && t.Data == "link":
+		rel := strings.ToLower(extractAttr("rel", t))
+		for _, r := range strings.Fields(rel) {
+			if r == "stylesheet" || r == "icon" || r == "preload" || r == "apple-touch-icon" {
+				return false, true
+			}
+		}
+
+		return true, true
+	case attr == "src" && (t.Data == "iframe" || t.Data == "frame"):
+		return true, true
+	case attr == "src":
+		switch t.Data {
+		case "img", "script", "source", "video", "audio", "embed", "track", "input":
+			return false, true
+		}
+	case attr == "poster" && t.Data == "video":
+		return false, true
+	}
+
+	return false, false
+}
+
+var cssReference = regexp.MustCompile(`url\(\s*(?:'([^']*)'|"([^"]*)"|([^'")\s]*))\s*\)|@import\s+(?:'([^']*)'|"([^"]*)")`)
+
+// rewriteCSS points url() and @import references at local copies and returns
+// the referenced assets.
+func rewriteCSS(base *url.URL, from string, css []byte) ([]byte, []*url.URL) {
+	var assets []*url.URL
+
+	out := cssReference.ReplaceAllFunc(css, func(match []byte) []byte {
+		groups := cssReference.FindSubmatch(match)
+
+		ref := ""
+		for _, g := range groups[1:] {
+			if len(g) > 0 {
+				ref = string(g)
+				break
+			}
+		}
+
+		if strings.HasPrefix(ref, "data:") {
+			return match
+		}
+
+		u, rel, ok := localReference(base, from, ref, false)
+		if !ok {
+			return match
+		}
+
+		assets = append(assets, u)
+		if bytes.HasPrefix(match, []byte("@import")) {
+			return []byte(fmt.Sprintf("@import %q", rel))
+		}
+
+		return []byte(fmt.Sprintf("url(%q)", rel))
+	})
+
+	return out, assets
+}
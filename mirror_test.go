@@ -0,0 +1,148 @@
+package crawler
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dovys/monzo-crawler/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorPath(t *testing.T) {
+	cases := []struct {
+		url  string
+		page bool
+		path string
+	}{
+		{"https://monzo.com", true, "monzo.com/index.html"},
+		{"https://monzo.com/", true, "monzo.com/index.html"},
+		{"https://monzo.com/docs/", true, "monzo.com/docs/index.html"},
+		{"https://monzo.com/about", true, "monzo.com/about.html"},
+		{"https://monzo.com/about.htm", true, "monzo.com/about.htm"},
+		{"https://monzo.com/logo", false, "monzo.com/logo"},
+		{"https://monzo.com/list?page=2", true, "monzo.com/list_" + shortHash("page=2") + ".html"},
+		{"https://monzo.com/app.js?v=1", false, "monzo.com/app_" + shortHash("v=1") + ".js"},
+		{"https://monzo.com/a%20b/c:d/../", true, "monzo.com/a_b/c_d/_/index.html"},
+		{"https://Monzo.com:8080/x", true, "monzo.com_8080/x.html"},
+	}
+
+	for _, c := range cases {
+		u, _ := url.Parse(c.url)
+		assert.Equal(t, c.path, MirrorPath(u, c.page), c.url)
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	assert.Equal(t, "docs/index.html", relativePath("monzo.com/index.html", "monzo.com/docs/index.html"))
+	assert.Equal(t, "../style.css", relativePath("monzo.com/docs/page.html", "monzo.com/style.css"))
+	assert.Equal(t, "page.html", relativePath("monzo.com/docs/page.html", "monzo.com/docs/page.html"))
+	assert.Equal(t, "../cdn.com/a.png", relativePath("monzo.com/a.html", "cdn.com/a.png"))
+}
+
+func TestRewriteHTML(t *testing.T) {
+	base, _ := url.Parse("https://monzo.com/docs/page")
+	body := `<html><head><link rel="stylesheet" href="/style.css"><link rel="canonical" href="/docs/page">` +
+		`<style>a > b { background: url('bg.png') }</style></head>` +
+		`<body><a href="/">Home</a><a href="#top">Top</a><a href="https://google.com/">Google</a>` +
+		`<a href="other#part">Other</a><a href="mailto:hi@monzo.com">Mail</a>` +
+		`<img src="https://cdn.monzo.com/logo.png"><div style="background: url(&quot;/bg.png&quot;)">x</div></body></html>`
+
+	out, assets := rewriteHTML(base, MirrorPath(base, true), []byte(body))
+
+	assert.Equal(t, `<html><head><link rel="stylesheet" href="../style.css"><link rel="canonical" href="page.html">`+
+		`<style>a > b { background: url("bg.png") }</style></head>`+
+		`<body><a href="../index.html">Home</a><a href="#top">Top</a><a href="https://google.com/">Google</a>`+
+		`<a href="other.html#part">Other</a><a href="mailto:hi@monzo.com">Mail</a>`+
+		`<img src="../../cdn.monzo.com/logo.png"><div style="background: url(&#34;../bg.png&#34;)">x</div></body></html>`, string(out))
+
+	var urls []string
+	for _, a := range assets {
+		urls = append(urls, a.String())
+	}
+	assert.Equal(t, []string{
+		"https://monzo.com/style.css",
+		"https://monzo.com/docs/bg.png",
+		"https://cdn.monzo.com/logo.png",
+		"https://monzo.com/bg.png",
+	}, urls)
+}
+
+func TestMirrorIsRefreshedIncrementally(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	root, _ := url.Parse("https://monzo.com/")
+	page := &Page{URL: *root, Body: []byte(`<link rel="stylesheet" href="/style.css"><a href="/about">About</a>`)}
+
+	f := &mock.FetcherMock{}
+	f.On("Fetch", "https://monzo.com/style.css").Once().Return([]byte(`@import "fonts.css"; body { color: red }`), nil)
+	f.On("Fetch", "https://monzo.com/fonts.css").Once().Return([]byte(`body { font: serif }`), nil)
+
+	m, err := OpenMirror(dir, f)
+	require.NoError(t, err)
+
+	action, err := m.Process(page)
+	require.NoError(t, err)
+	assert.Equal(t, Continue, action)
+	require.NoError(t, m.Close())
+	assert.Equal(t, MirrorSummary{Pages: 1, Assets: 2}, m.Summary())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "monzo.com", "index.html"))
+	require.NoError(t, err)
+	assert.Equal(t, `<link rel="stylesheet" href="style.css"><a href="about.html">About</a>`, string(b))
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "monzo.com", "style.css"))
+	require.NoError(t, err)
+	assert.Equal(t, `@import "fonts.css"; body { color: red }`, string(b))
+
+	// Assets which are already saved aren't fetched again
+	m, err = OpenMirror(dir, f)
+	require.NoError(t, err)
+
+	_, err = m.Process(page)
+	require.NoError(t, err)
+
+	_, err = m.Process(&Page{URL: *root, Body: []byte(`<a href="/about">About us</a>`)})
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	assert.Equal(t, MirrorSummary{Pages: 1, Unchanged: 2}, m.Summary())
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "monzo.com", "index.html"))
+	require.NoError(t, err)
+	assert.Equal(t, `<a href="about.html">About us</a>`, string(b))
+
+	f.AssertExpectations(t)
+}
+
+func TestMirrorSavesPagesWhichArentHTMLAsTheyAre(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := OpenMirror(dir, &mock.FetcherMock{})
+	require.NoError(t, err)
+
+	body := `{"html": "<img src=\"/logo.png\"><a href=\"/about\">"}`
+	u, _ := url.Parse("https://monzo.com/api")
+	_, err = m.Process(&Page{URL: *u, Body: []byte(body), ContentType: "application/json"})
+	require.NoError(t, err)
+
+	u, _ = url.Parse("https://monzo.com/about")
+	_, err = m.Process(&Page{URL: *u, Body: []byte(`<a href="/api">API</a>`), ContentType: "text/html; charset=utf-8"})
+	require.NoError(t, err)
+	assert.Equal(t, MirrorSummary{Pages: 2}, m.Summary())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "monzo.com", "api.html"))
+	require.NoError(t, err)
+	assert.Equal(t, body, string(b))
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "monzo.com", "about.html"))
+	require.NoError(t, err)
+	assert.Equal(t, `<a href="api.html">API</a>`, string(b))
+}
@@ -10,8 +10,8 @@ type ParserMock struct {
 	mock.Mock
 }
 
-func (p *ParserMock) Parse(root *url.URL, body []byte) (links, assets []*url.URL) {
+func (p *ParserMock) Parse(root *url.URL, body []byte) (links, assets []*url.URL, err error) {
 	args := p.Called(root, body)
 
-	return args.Get(0).([]*url.URL), args.Get(1).([]*url.URL)
+	return args.Get(0).([]*url.URL), args.Get(1).([]*url.URL), args.Error(2)
 }
@@ -2,13 +2,16 @@ package crawler
 
 import (
 	"bytes"
+	"io"
 	"net/url"
+	"strings"
 
 	"golang.org/x/net/html"
 )
 
 type Parser interface {
-	Parse(root *url.URL, body []byte) (links, assets []*url.URL)
+	// Returns the links and assets found before an error for malformed documents
+	Parse(root *url.URL, body []byte) (links, assets []*url.URL, err error)
 }
 
 func NewParser() Parser {
@@ -17,7 +20,7 @@ func NewParser() Parser {
 
 type htmlParser struct{}
 
-func (p *htmlParser) Parse(root *url.URL, body []byte) (links, assets []*url.URL) {
+func (p *htmlParser) Parse(root *url.URL, body []byte) (links, assets []*url.URL, err error) {
 	t := html.NewTokenizer(bytes.NewReader(body))
 
 	for {
@@ -25,6 +28,9 @@ func (p *htmlParser) Parse(root *url.URL, body []byte) (links, assets []*url.URL
 
 		switch {
 		case tp == html.ErrorToken:
+			if t.Err() != io.EOF {
+				err = t.Err()
+			}
 			return
 		case tp == html.StartTagToken:
 			token := t.Token()
@@ -87,3 +93,66 @@ func extractAttr(key string, t *html.Token) string {
 
 	return ""
 }
+
+// ExtractText returns the visible text of an html document with all the
+// markup, scripts and styles stripped out.
+func ExtractText(body []byte) string {
+	t := html.NewTokenizer(bytes.NewReader(body))
+	var b strings.Builder
+	skip := 0
+
+	for {
+		switch t.Next() {
+		case html.ErrorToken:
+			return b.String()
+		case html.StartTagToken:
+			if name, _ := t.TagName(); isInvisible(name) {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := t.TagName(); isInvisible(name) && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(t.Text())
+				b.WriteByte(' ')
+			}
+		}
+	}
+}
+
+func isInvisible(tag []byte) bool {
+	switch string(tag) {
+	case "script", "style", "noscript", "template":
+		return true
+	}
+
+	return false
+}
+
+// ExtractTitle returns the text of the document's first title element with whitespace collapsed.
+func ExtractTitle(body []byte) string {
+	t := html.NewTokenizer(bytes.NewReader(body))
+	inTitle := false
+	var b strings.Builder
+
+	for {
+		switch t.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(b.String()), " ")
+		case html.StartTagToken:
+			if name, _ := t.TagName(); string(name) == "title" {
+				inTitle = true
+			}
+		case html.EndTagToken:
+			if name, _ := t.TagName(); string(name) == "title" && inTitle {
+				return strings.Join(strings.Fields(b.String()), " ")
+			}
+		case html.TextToken:
+			if inTitle {
+				b.Write(t.Text())
+			}
+		}
+	}
+}
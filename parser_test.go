@@ -34,7 +34,8 @@ func TestParseLinks(t *testing.T) {
 	p := NewParser()
 
 	root, _ := url.Parse("https://mydomain.com/page/1")
-	links, _ := p.Parse(root, []byte(body))
+	links, _, err := p.Parse(root, []byte(body))
+	require.NoError(t, err)
 
 	expected := []string{
 		"https://mydomain.com/articles/1",
@@ -53,7 +54,8 @@ func TestParseAssets(t *testing.T) {
 	p := NewParser()
 
 	root, _ := url.Parse("https://mydomain.com/page/1")
-	_, assets := p.Parse(root, []byte(body))
+	_, assets, err := p.Parse(root, []byte(body))
+	require.NoError(t, err)
 
 	require.Len(t, assets, 5)
 	expected := []string{
@@ -75,7 +77,8 @@ func TestParseRelativeURLs(t *testing.T) {
 	body := `<html><body><a href="issues/351">351</a></body></html>`
 
 	uri, _ := url.Parse("https://mydomain.com/issues")
-	links, _ := p.Parse(uri, []byte(body))
+	links, _, err := p.Parse(uri, []byte(body))
+	require.NoError(t, err)
 
 	require.Len(t, links, 1)
 	assert.Equal(t, "https://mydomain.com/issues/351", links[0].String())
@@ -99,7 +102,22 @@ func TestParseEmptyURLsAreIgnored(t *testing.T) {
 	</html>`
 
 	uri, _ := url.Parse("https://mydomain.com/issues")
-	links, _ := p.Parse(uri, []byte(body))
+	links, _, err := p.Parse(uri, []byte(body))
+	require.NoError(t, err)
 
 	require.Len(t, links, 0)
 }
+
+func TestExtractText(t *testing.T) {
+	text := ExtractText([]byte(`<html><head><style>body { color: red; }</style></head><body>
+		<p>Monzo is a bank</p><script>var session = "1";</script></body></html>`))
+
+	assert.Contains(t, text, "Monzo is a bank")
+	assert.NotContains(t, text, "color: red")
+	assert.NotContains(t, text, "session")
+}
+
+func TestExtractTitle(t *testing.T) {
+	assert.Equal(t, "Monzo - Banking made easy", ExtractTitle([]byte("<html><head><title>\n  Monzo -\n Banking made easy </title><title>Other</title></head></html>")))
+	assert.Equal(t, "", ExtractTitle([]byte("<html><body>No title</body></html>")))
+}
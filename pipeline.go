@@ -0,0 +1,91 @@
+package crawler
+
+import (
+	"fmt"
+	"time"
+)
+
+// Action tells the crawler what to do with a page after a processing stage.
+// Actions can be combined, e.g. DropPage | SkipLinks.
+type Action uint8
+
+const (
+	Continue Action = 0
+	// The page's links aren't enqueued, it's still sent to the results
+	SkipLinks Action = 1 << 0
+	// The page isn't sent to the results and later stages don't see it, its links are still enqueued
+	DropPage Action = 1 << 1
+)
+
+// PageProcessor is a stage of the pipeline which crawled pages pass through
+// before they're sent to the results. Processors run inside the crawler's
+// workers, so they must be safe for concurrent use, and may mutate the page.
+type PageProcessor interface {
+	Process(*Page) (Action, error)
+}
+
+// ProcessorFunc adapts a function to a PageProcessor.
+type ProcessorFunc func(*Page) (Action, error)
+
+func (f ProcessorFunc) Process(p *Page) (Action, error) {
+	return f(p)
+}
+
+// Stage is a named PageProcessor. A failing stage is reported on the Run
+// error channel as a *StageError and the page moves on to the next stage,
+// unless DropOnError is set.
+type Stage struct {
+	Name        string
+	Processor   PageProcessor
+	DropOnError bool
+}
+
+// StageError is the cause of a CrawlError with PhaseProcess.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// StageStats counts the pages a stage has processed and the time it spent on them.
+type StageStats struct {
+	Processed int
+	Errors    int
+	Dropped   int
+	Duration  time.Duration
+}
+
+// pipeline runs the page through the stages until one of them drops it and
+// returns the combined action of all stages which ran.
+func (c *crawler) pipeline(r *Request, page *Page, errs chan<- error) Action {
+	action := Continue
+
+	for _, s := range c.stages {
+		start := time.Now()
+		a, err := s.Processor.Process(page)
+		elapsed := time.Since(start)
+
+		if err != nil {
+			c.report(errs, newCrawlError(r, PhaseProcess, &StageError{Stage: s.Name, Err: err}))
+			if s.DropOnError {
+				a |= DropPage
+			}
+		}
+
+		c.stats.processed(s.Name, elapsed, a, err)
+
+		action |= a
+		if action&DropPage != 0 {
+			return action
+		}
+	}
+
+	return action
+}
@@ -0,0 +1,90 @@
+package crawler
+
+import (
+	"context"
+	stderrors "errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineStages(t *testing.T) {
+	root, _ := url.Parse("https://google.com/")
+	about, _ := url.Parse("https://google.com/about")
+	drafts, _ := url.Parse("https://google.com/drafts")
+	draft, _ := url.Parse("https://google.com/drafts/1")
+	broken, _ := url.Parse("https://google.com/broken")
+
+	failure := stderrors.New("no title")
+
+	var titles []string
+	title := ProcessorFunc(func(p *Page) (Action, error) {
+		if p.Path == "/broken" {
+			return Continue, failure
+		}
+
+		titles = append(titles, string(p.Body))
+		return Continue, nil
+	})
+
+	// Drafts aren't published, but the pages they link to might be
+	unpublished := ProcessorFunc(func(p *Page) (Action, error) {
+		if strings.HasPrefix(p.Path, "/drafts") {
+			return DropPage, nil
+		}
+
+		if p.Path == "/about" {
+			return SkipLinks, nil
+		}
+
+		return Continue, nil
+	})
+
+	s := setup(1, 100, 100)
+	c := NewCrawler(s.p, s.f, NewUniqueSet(),
+		Concurrency(1),
+		Pipeline(Stage{Name: "title", Processor: title, DropOnError: true}),
+		Pipeline(Stage{Name: "unpublished", Processor: unpublished}),
+	)
+
+	s.f.On("Fetch", root.String()).Once().Return([]byte("root"), nil)
+	s.f.On("Fetch", about.String()).Once().Return([]byte("about"), nil)
+	s.f.On("Fetch", drafts.String()).Once().Return([]byte("drafts"), nil)
+	s.f.On("Fetch", draft.String()).Once().Return([]byte("draft"), nil)
+	s.f.On("Fetch", broken.String()).Once().Return([]byte("broken"), nil)
+	s.p.On("Parse", root, []byte("root")).Once().Return([]*url.URL{about, drafts, broken}, []*url.URL{}, nil)
+	s.p.On("Parse", about, []byte("about")).Once().Return([]*url.URL{root, draft}, []*url.URL{}, nil)
+	s.p.On("Parse", drafts, []byte("drafts")).Once().Return([]*url.URL{draft}, []*url.URL{}, nil)
+	s.p.On("Parse", draft, []byte("draft")).Once().Return([]*url.URL{}, []*url.URL{}, nil)
+	s.p.On("Parse", broken, []byte("broken")).Once().Return([]*url.URL{}, []*url.URL{}, nil)
+
+	require.NoError(t, c.Enqueue(root))
+	pages, errs := run(c, root, context.Background())
+
+	require.Len(t, pages, 2)
+	assert.Equal(t, root.String(), pages[0].String())
+	assert.Equal(t, about.String(), pages[1].String())
+	assert.Equal(t, []string{"root", "about", "drafts", "draft"}, titles)
+
+	require.Len(t, errs, 1)
+	assert.Equal(t, &CrawlError{
+		URL:      broken,
+		Referrer: root,
+		Site:     "google.com",
+		Depth:    1,
+		Phase:    PhaseProcess,
+		Attempt:  1,
+		Err:      &StageError{Stage: "title", Err: failure},
+	}, errs[0])
+	assert.True(t, stderrors.Is(errs[0], failure))
+
+	stats := c.Stats().Stages
+	assert.Equal(t, StageStats{Processed: 5, Errors: 1, Dropped: 1, Duration: stats["title"].Duration}, stats["title"])
+	assert.Equal(t, 4, stats["unpublished"].Processed)
+	assert.Equal(t, 2, stats["unpublished"].Dropped)
+
+	s.AssertExpectations(t)
+}
@@ -0,0 +1,600 @@
+package crawler
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// QueryResult holds the rows selected by a query, with their values in the
+// order of the columns.
+type QueryResult struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// Query runs an SQL-like query against the tables:
+//
+//	[select <columns> | count(*) from] <table> [where <condition>]
+//	[order by <column> [asc | desc]] [limit <n>]
+//
+// Conditions compare a column with a number or a quoted string using =, !=,
+// <, <=, >, >=, like (with % and _ wildcards) or ~ (a regular expression),
+// test it with "is empty" or "is not empty", and are combined with and, or,
+// not and parentheses. On the pages table, linked_from(<condition>) and
+// links_to(<condition>) hold when any page linking to or linked from the page
+// meets the condition. For example, broken pages linked from near the top of
+// the site:
+//
+//	pages where status = 404 and linked_from(depth <= 2)
+func (t *Tables) Query(q string) (*QueryResult, error) {
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens, tables: t}
+	query, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return query.run(t), nil
+}
+
+type query struct {
+	table   string
+	columns []string
+	count   bool
+	where   condition
+	orderBy string
+	desc    bool
+	// Negative when there's no limit
+	limit int
+}
+
+func (q *query) run(t *Tables) *QueryResult {
+	var rows []Row
+	for _, r := range t.rows[q.table] {
+		if q.where == nil || q.where.match(t, r) {
+			rows = append(rows, r)
+		}
+	}
+
+	if q.count {
+		return &QueryResult{Columns: []string{"count"}, Rows: [][]interface{}{{float64(len(rows))}}}
+	}
+
+	if q.orderBy != "" {
+		numeric := t.schema[q.table].Numeric[q.orderBy]
+		sort.SliceStable(rows, func(i, j int) bool {
+			a, b := rows[i], rows[j]
+			if q.desc {
+				a, b = b, a
+			}
+
+			if numeric {
+				return a.num(q.orderBy) < b.num(q.orderBy)
+			}
+
+			return a.str(q.orderBy) < b.str(q.orderBy)
+		})
+	}
+
+	if q.limit >= 0 && len(rows) > q.limit {
+		rows = rows[:q.limit]
+	}
+
+	result := &QueryResult{Columns: q.columns, Rows: make([][]interface{}, len(rows))}
+	for i, r := range rows {
+		values := make([]interface{}, len(q.columns))
+		for j, c := range q.columns {
+			values[j] = r[c]
+		}
+		result.Rows[i] = values
+	}
+
+	return result
+}
+
+func (r Row) num(column string) float64 {
+	f, _ := r[column].(float64)
+
+	return f
+}
+
+type condition interface {
+	match(t *Tables, r Row) bool
+}
+
+type andCondition struct{ left, right condition }
+
+func (c *andCondition) match(t *Tables, r Row) bool { return c.left.match(t, r) && c.right.match(t, r) }
+
+type orCondition struct{ left, right condition }
+
+func (c *orCondition) match(t *Tables, r Row) bool { return c.left.match(t, r) || c.right.match(t, r) }
+
+type notCondition struct{ c condition }
+
+func (c *notCondition) match(t *Tables, r Row) bool { return !c.c.match(t, r) }
+
+type comparison struct {
+	column  string
+	op      string
+	numeric bool
+	num     float64
+	str     string
+	re      *regexp.Regexp
+}
+
+func (c *comparison) match(t *Tables, r Row) bool {
+	if c.re != nil {
+		return c.re.MatchString(r.str(c.column))
+	}
+
+	var cmp int
+	if c.numeric {
+		switch v := r.num(c.column); {
+		case v < c.num:
+			cmp = -1
+		case v > c.num:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(r.str(c.column), c.str)
+	}
+
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+
+	return cmp >= 0
+}
+
+// emptyCondition holds for empty strings and zeros.
+type emptyCondition struct {
+	column  string
+	numeric bool
+}
+
+func (c *emptyCondition) match(t *Tables, r Row) bool {
+	if c.numeric {
+		return r.num(c.column) == 0
+	}
+
+	return r.str(c.column) == ""
+}
+
+// linkCondition holds when any page linking to, or linked from, the page
+// meets the condition.
+type linkCondition struct {
+	from bool
+	c    condition
+}
+
+func (c *linkCondition) match(t *Tables, r Row) bool {
+	links := t.linksTo
+	if c.from {
+		links = t.linkedFrom
+	}
+
+	for _, u := range links[canonicalString(r.str("url"))] {
+		if p, ok := t.pages[u]; ok && c.c.match(t, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// Unicode spellings of the operators are accepted too
+var querySymbols = []struct{ text, op string }{
+	{"<=", "<="}, {">=", ">="}, {"!=", "!="}, {"<>", "!="},
+	{"≤", "<="}, {"≥", ">="}, {"≠", "!="},
+	{"=", "="}, {"<", "<"}, {">", ">"}, {"~", "~"},
+	{"(", "("}, {")", ")"}, {",", ","}, {"*", "*"},
+}
+
+func lexQuery(q string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(q); {
+		r, size := utf8.DecodeRuneInString(q[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(q) {
+				r, size := utf8.DecodeRuneInString(q[i:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, token{tokenIdent, strings.ToLower(q[start:i]), start})
+		case r == '-' || r == '.' || unicode.IsDigit(r):
+			start := i
+			i++
+			for i < len(q) && (q[i] == '.' || q[i] >= '0' && q[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, q[start:i], start})
+		case r == '\'' || r == '"':
+			start := i
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(q) {
+					return nil, fmt.Errorf("Unterminated string at %d", start)
+				}
+				// Quotes are escaped by doubling them, as in SQL
+				if q[i] == byte(r) {
+					if i+1 < len(q) && q[i+1] == byte(r) {
+						b.WriteByte(q[i])
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(q[i])
+			}
+			tokens = append(tokens, token{tokenString, b.String(), start})
+		default:
+			matched := false
+			for _, s := range querySymbols {
+				if strings.HasPrefix(q[i:], s.text) {
+					tokens = append(tokens, token{tokenSymbol, s.op, i})
+					i += len(s.text)
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return nil, fmt.Errorf("Unexpected %q at %d", r, i)
+			}
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(q)}), nil
+}
+
+type queryParser struct {
+	tokens []token
+	i      int
+	tables *Tables
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.i]
+}
+
+// accept consumes the next token if it's the keyword or symbol.
+func (p *queryParser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokenIdent || t.kind == tokenSymbol) && t.text == text {
+		p.i++
+		return true
+	}
+
+	return false
+}
+
+func (p *queryParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected("expected " + text)
+	}
+
+	return nil
+}
+
+func (p *queryParser) unexpected(want string) error {
+	t := p.peek()
+	if t.kind == tokenEOF {
+		return fmt.Errorf("Unexpected end of query, %s", want)
+	}
+
+	return fmt.Errorf("Unexpected %q at %d, %s", t.text, t.pos, want)
+}
+
+func (p *queryParser) parse() (*query, error) {
+	q := &query{limit: -1}
+
+	var columns []string
+	if p.accept("select") {
+		switch {
+		case p.accept("*"):
+		case p.accept("count"):
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			if err := p.expect("*"); err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			q.count = true
+		default:
+			for {
+				t := p.peek()
+				if t.kind != tokenIdent {
+					return nil, p.unexpected("expected a column")
+				}
+				p.i++
+				columns = append(columns, t.text)
+
+				if !p.accept(",") {
+					break
+				}
+			}
+		}
+
+		if err := p.expect("from"); err != nil {
+			return nil, err
+		}
+	}
+
+	t := p.peek()
+	schema, ok := p.tables.schema[t.text]
+	if t.kind != tokenIdent || !ok {
+		return nil, p.unexpected("expected a table: " + strings.Join(p.tableNames(), ", "))
+	}
+	p.i++
+	q.table = t.text
+
+	q.columns = schema.Columns
+	if columns != nil {
+		for _, c := range columns {
+			if err := p.checkColumn(q.table, c); err != nil {
+				return nil, err
+			}
+		}
+		q.columns = columns
+	}
+
+	if p.accept("where") {
+		var err error
+		if q.where, err = p.parseOr(q.table); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.accept("order") {
+		if err := p.expect("by"); err != nil {
+			return nil, err
+		}
+
+		c := p.peek()
+		if c.kind != tokenIdent {
+			return nil, p.unexpected("expected a column")
+		}
+		p.i++
+		if err := p.checkColumn(q.table, c.text); err != nil {
+			return nil, err
+		}
+		q.orderBy = c.text
+
+		if !p.accept("asc") {
+			q.desc = p.accept("desc")
+		}
+	}
+
+	if p.accept("limit") {
+		n := p.peek()
+		limit, err := strconv.Atoi(n.text)
+		if n.kind != tokenNumber || err != nil || limit < 0 {
+			return nil, p.unexpected("expected the number of rows")
+		}
+		p.i++
+		q.limit = limit
+	}
+
+	if p.peek().kind != tokenEOF {
+		return nil, p.unexpected("expected the end of the query")
+	}
+
+	return q, nil
+}
+
+func (p *queryParser) tableNames() []string {
+	var names []string
+	for _, s := range StoreSchema() {
+		names = append(names, s.Name)
+	}
+
+	return names
+}
+
+func (p *queryParser) checkColumn(table, column string) error {
+	for _, c := range p.tables.schema[table].Columns {
+		if c == column {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unknown column %s of %s, expected one of: %s", column, table, strings.Join(p.tables.schema[table].Columns, ", "))
+}
+
+func (p *queryParser) parseOr(table string) (condition, error) {
+	left, err := p.parseAnd(table)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("or") {
+		right, err := p.parseAnd(table)
+		if err != nil {
+			return nil, err
+		}
+		left = &orCondition{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseAnd(table string) (condition, error) {
+	left, err := p.parseUnary(table)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("and") {
+		right, err := p.parseUnary(table)
+		if err != nil {
+			return nil, err
+		}
+		left = &andCondition{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseUnary(table string) (condition, error) {
+	if p.accept("not") {
+		c, err := p.parseUnary(table)
+		if err != nil {
+			return nil, err
+		}
+
+		return &notCondition{c}, nil
+	}
+
+	if p.accept("(") {
+		c, err := p.parseOr(table)
+		if err != nil {
+			return nil, err
+		}
+
+		return c, p.expect(")")
+	}
+
+	t := p.peek()
+	if t.kind != tokenIdent {
+		return nil, p.unexpected("expected a condition")
+	}
+	p.i++
+
+	if t.text == "linked_from" || t.text == "links_to" {
+		if table != "pages" {
+			return nil, fmt.Errorf("%s can only be used on pages", t.text)
+		}
+
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+
+		c, err := p.parseOr("pages")
+		if err != nil {
+			return nil, err
+		}
+
+		return &linkCondition{from: t.text == "linked_from", c: c}, p.expect(")")
+	}
+
+	if err := p.checkColumn(table, t.text); err != nil {
+		return nil, err
+	}
+	numeric := p.tables.schema[table].Numeric[t.text]
+
+	if p.accept("is") {
+		not := p.accept("not")
+		if err := p.expect("empty"); err != nil {
+			return nil, err
+		}
+
+		var c condition = &emptyCondition{column: t.text, numeric: numeric}
+		if not {
+			c = &notCondition{c}
+		}
+
+		return c, nil
+	}
+
+	op := p.peek()
+	switch {
+	case op.kind == tokenSymbol && strings.Contains("= != < <= > >= ~", op.text):
+	case op.kind == tokenIdent && op.text == "like":
+	default:
+		return nil, p.unexpected("expected an operator")
+	}
+	p.i++
+
+	v := p.peek()
+	if v.kind != tokenNumber && v.kind != tokenString {
+		return nil, p.unexpected("expected a number or a string")
+	}
+	p.i++
+
+	c := &comparison{column: t.text, op: op.text, str: v.text}
+	switch {
+	case op.text == "~" || op.text == "like":
+		pattern := v.text
+		if op.text == "like" {
+			pattern = likePattern(v.text)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		c.re = re
+	case numeric:
+		f, err := strconv.ParseFloat(v.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is a number, got %q", t.text, v.text)
+		}
+		c.numeric, c.num = true, f
+	}
+
+	return c, nil
+}
+
+// likePattern turns an SQL LIKE pattern into a regular expression.
+func likePattern(like string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range like {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	return b.String()
+}
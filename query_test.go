@@ -0,0 +1,83 @@
+package crawler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func queryURLs(t *testing.T, tables *Tables, q string) []interface{} {
+	r, err := tables.Query(q)
+	require.NoError(t, err)
+
+	urls := []interface{}{}
+	for _, row := range r.Rows {
+		urls = append(urls, row[0])
+	}
+
+	return urls
+}
+
+func TestQueryFilters(t *testing.T) {
+	tables := crawlToStore(t, storeSite)
+
+	cases := []struct {
+		query string
+		urls  []interface{}
+	}{
+		{
+			"select url from pages where status = 404 and linked_from(depth ≤ 2) order by url",
+			[]interface{}{"https://monzo.com/gone", "https://monzo.com/missing"},
+		},
+		{
+			"select url from pages where status = 200 and title is empty",
+			[]interface{}{"https://monzo.com/about/team"},
+		},
+		{
+			"select url from pages where links_to(status >= 400) and not (depth > 2 or url like '%/')",
+			[]interface{}{"https://monzo.com/about/team"},
+		},
+		{
+			"select url from pages where url ~ 'about/.+' order by depth desc",
+			[]interface{}{"https://monzo.com/about/team/jobs", "https://monzo.com/about/team"},
+		},
+		{
+			"SELECT url FROM pages WHERE title = 'About' OR title = \"Jobs\" ORDER BY url LIMIT 1",
+			[]interface{}{"https://monzo.com/about"},
+		},
+		{
+			"select page from assets where url like '%.png'",
+			[]interface{}{"https://monzo.com/"},
+		},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.urls, queryURLs(t, tables, c.query), c.query)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	tables := crawlToStore(t, storeSite)
+
+	cases := map[string]string{
+		"":                                     "Unexpected end of query, expected a table: pages, links, assets, errors, redirects",
+		"users":                                `Unexpected "users" at 0, expected a table: pages, links, assets, errors, redirects`,
+		"pages where colour = 'red'":           "Unknown column colour of pages, expected one of: url, status, depth, title, size, hash, fetch_ms, duplicate_of, crawled, inlinks, outlinks, assets",
+		"pages where depth = 'top'":            `depth is a number, got "top"`,
+		"pages where title = 'Monzo":           "Unterminated string at 20",
+		"links where linked_from(depth = 0)":   "linked_from can only be used on pages",
+		"pages where depth <= 2 limit":         "Unexpected end of query, expected the number of rows",
+		"pages where (depth <= 2":              "Unexpected end of query, expected )",
+		"pages where url ~ '['":                "error parsing regexp: missing closing ]: `[`",
+		"pages where depth between 1 and 2":    `Unexpected "between" at 18, expected an operator`,
+		"pages order by inlinks desc, limit 1": `Unexpected "," at 27, expected the end of the query`,
+	}
+
+	for q, msg := range cases {
+		_, err := tables.Query(q)
+		if assert.Error(t, err, q) {
+			assert.Equal(t, msg, err.Error(), q)
+		}
+	}
+}
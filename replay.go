@@ -0,0 +1,469 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrNotRecorded is returned by the replay fetcher for urls missing from the recording.
+var ErrNotRecorded = errors.New("Not recorded")
+
+// ErrReplayOption is returned when the replay fetcher is given a fetcher
+// option which needs the network.
+var ErrReplayOption = errors.New("Archiving and caching can't be used when replaying")
+
+// The recording is a HAR 1.2 archive. Entries hold the headers of the
+// request and response when the fetcher makes them known, fields prefixed with
+// an underscore hold errors which happened before a response was received.
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Error           string      `json:"_error,omitempty"`
+	Timeout         bool        `json:"_timeout,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	// -1 as the size of the headers isn't known
+	HeadersSize int `json:"headersSize"`
+	BodySize    int `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// The fetch isn't broken down any further, it's all spent waiting.
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harHeader starts a recording, the entries follow as they're fetched.
+const harHeader = `{
+  "log": {
+    "version": "1.2",
+    "creator": {
+      "name": "monzo-crawler",
+      "version": "1"
+    },
+    "entries": [`
+
+// RecordingFetcher records every fetch of the fetcher it decorates so the
+// crawl can be replayed with a ReplayFetcher. Entries are written as they
+// arrive rather than kept in memory, and the recording is only complete
+// once the fetcher is closed.
+type RecordingFetcher struct {
+	fetcher Fetcher
+
+	mu sync.Mutex
+	w  *bufio.Writer
+	// Closes the file created by CreateRecordingFetcher
+	closer  io.Closer
+	entries int
+	closed  bool
+	// First error writing the recording, returned by Close
+	err error
+}
+
+// NewRecordingFetcher writes the recording to w.
+func NewRecordingFetcher(f Fetcher, w io.Writer) *RecordingFetcher {
+	r := &RecordingFetcher{fetcher: f, w: bufio.NewWriter(w)}
+	_, r.err = r.w.WriteString(harHeader)
+
+	return r
+}
+
+// CreateRecordingFetcher writes the recording to a file at path.
+func CreateRecordingFetcher(f Fetcher, path string) (*RecordingFetcher, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewRecordingFetcher(f, file)
+	r.closer = file
+
+	return r, nil
+}
+
+func (r *RecordingFetcher) Fetch(url string) ([]byte, error) {
+	b, _, err := r.fetchResponse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (r *RecordingFetcher) fetchResponse(url string) ([]byte, *http.Response, error) {
+	start := time.Now()
+
+	var b []byte
+	var rsp *http.Response
+	var err error
+	if f, ok := r.fetcher.(responseFetcher); ok {
+		b, rsp, err = f.fetchResponse(url)
+	} else {
+		b, err = r.fetcher.Fetch(url)
+	}
+	elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+
+	e := harEntry{
+		StartedDateTime: start.UTC(),
+		Time:            elapsed,
+		Request:         newHarRequest(url, rsp),
+		Response:        newHarResponse(http.StatusOK, "OK", rsp, b),
+		Timings:         harTimings{Wait: elapsed},
+	}
+
+	if err != nil {
+		var httpErr *HTTPError
+		var netErr net.Error
+
+		if errors.As(err, &httpErr) {
+			e.Response.Status, e.Response.StatusText = httpErr.StatusCode, httpErr.Message
+		} else {
+			e.Response = newHarResponse(0, "", nil, nil)
+			e.Error = err.Error()
+			e.Timeout = errors.As(err, &netErr) && netErr.Timeout()
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.write(e)
+
+	return b, rsp, err
+}
+
+// newHarRequest records the request which led to the response, when there's one.
+func newHarRequest(rawurl string, rsp *http.Response) harRequest {
+	req := harRequest{
+		Method:      http.MethodGet,
+		URL:         rawurl,
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harCookie{},
+		Headers:     []harNameValue{},
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+	}
+
+	if u, err := url.Parse(rawurl); err == nil {
+		req.QueryString = harValues(u.Query())
+	}
+
+	if rsp != nil && rsp.Request != nil {
+		req.HTTPVersion = rsp.Proto
+		req.Headers = harValues(rsp.Request.Header)
+		for _, c := range rsp.Request.Cookies() {
+			req.Cookies = append(req.Cookies, harCookie{Name: c.Name, Value: c.Value})
+		}
+	}
+
+	return req
+}
+
+// newHarResponse records the status and body of a fetch, with the headers of
+// the response when there's one.
+func newHarResponse(status int, statusText string, rsp *http.Response, b []byte) harResponse {
+	res := harResponse{
+		Status:      status,
+		StatusText:  statusText,
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harCookie{},
+		Headers:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(b),
+	}
+
+	mimeType := http.DetectContentType(b)
+	if rsp != nil {
+		res.HTTPVersion = rsp.Proto
+		res.Headers = harValues(rsp.Header)
+		res.RedirectURL = rsp.Header.Get("Location")
+		for _, c := range rsp.Cookies() {
+			res.Cookies = append(res.Cookies, harCookie{Name: c.Name, Value: c.Value})
+		}
+
+		if ct := rsp.Header.Get("Content-Type"); ct != "" {
+			mimeType = ct
+		}
+	}
+	res.Content = encodeContent(b, mimeType)
+
+	return res
+}
+
+// harValues lists headers or query parameters sorted by name.
+func harValues(values map[string][]string) []harNameValue {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := []harNameValue{}
+	for _, name := range names {
+		for _, v := range values[name] {
+			list = append(list, harNameValue{Name: name, Value: v})
+		}
+	}
+
+	return list
+}
+
+// write expects the lock to be held.
+func (r *RecordingFetcher) write(e harEntry) {
+	if r.err != nil || r.closed {
+		return
+	}
+
+	entry := &bytes.Buffer{}
+	enc := json.NewEncoder(entry)
+	enc.SetIndent("      ", "  ")
+	enc.SetEscapeHTML(false)
+	if r.err = enc.Encode(e); r.err != nil {
+		return
+	}
+
+	sep := ",\n      "
+	if r.entries == 0 {
+		sep = "\n      "
+	}
+	r.entries++
+
+	if _, r.err = r.w.WriteString(sep); r.err != nil {
+		return
+	}
+	_, r.err = r.w.Write(bytes.TrimSuffix(entry.Bytes(), []byte("\n")))
+}
+
+// Close completes the recording. Fetches made afterwards aren't recorded.
+func (r *RecordingFetcher) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return r.err
+	}
+	r.closed = true
+
+	if r.err == nil {
+		end := "\n    ]\n  }\n}\n"
+		if r.entries == 0 {
+			end = "]\n  }\n}\n"
+		}
+
+		if _, r.err = r.w.WriteString(end); r.err == nil {
+			r.err = r.w.Flush()
+		}
+	}
+
+	if r.closer != nil {
+		if err := r.closer.Close(); r.err == nil {
+			r.err = err
+		}
+	}
+
+	return r.err
+}
+
+// ReplayFetcher serves fetches from a recording without touching the network.
+// A url fetched several times during the recording is replayed in the same
+// order and its last response is repeated once they run out.
+type ReplayFetcher struct {
+	metrics *Metrics
+
+	mu      sync.Mutex
+	entries map[string][]harEntry
+}
+
+// NewReplayFetcher reads a recording written by a RecordingFetcher. Of the
+// fetcher options only InstrumentFetcher applies, the replayed fetches are
+// observed with their recorded status, size and latency. Archiving and
+// caching need the network's responses, so they're refused.
+func NewReplayFetcher(r io.Reader, options ...FetcherOption) (*ReplayFetcher, error) {
+	opts := &fetcher{}
+	for _, o := range options {
+		o(opts)
+	}
+
+	if opts.archive != nil || opts.cache != nil {
+		return nil, ErrReplayOption
+	}
+
+	var h har
+	if err := json.NewDecoder(r).Decode(&h); err != nil {
+		return nil, err
+	}
+
+	f := &ReplayFetcher{metrics: opts.metrics, entries: make(map[string][]harEntry)}
+	for _, e := range h.Log.Entries {
+		f.entries[e.Request.URL] = append(f.entries[e.Request.URL], e)
+	}
+
+	return f, nil
+}
+
+// OpenReplayFetcher reads the recording at path.
+func OpenReplayFetcher(path string, options ...FetcherOption) (*ReplayFetcher, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return NewReplayFetcher(file, options...)
+}
+
+func (f *ReplayFetcher) Fetch(url string) ([]byte, error) {
+	b, _, err := f.fetchResponse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// fetchResponse stands in the recorded status and headers for the response.
+func (f *ReplayFetcher) fetchResponse(url string) ([]byte, *http.Response, error) {
+	f.mu.Lock()
+	entries, ok := f.entries[url]
+	if !ok {
+		f.mu.Unlock()
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotRecorded, url)
+	}
+
+	e := entries[0]
+	if len(entries) > 1 {
+		f.entries[url] = entries[1:]
+	}
+	f.mu.Unlock()
+
+	if f.metrics != nil {
+		f.metrics.observeFetch(hostOf(url), e.Response.Status, e.Response.Content.Size, time.Duration(e.Time*float64(time.Millisecond)))
+	}
+
+	if e.Error != "" {
+		return nil, nil, &replayedError{msg: e.Error, timeout: e.Timeout}
+	}
+
+	b, err := decodeContent(e.Response.Content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rsp := &http.Response{
+		StatusCode: e.Response.Status,
+		Proto:      e.Response.HTTPVersion,
+		Header:     http.Header{},
+	}
+	for _, h := range e.Response.Headers {
+		rsp.Header.Add(h.Name, h.Value)
+	}
+
+	if e.Response.Status != 200 {
+		return b, rsp, &HTTPError{StatusCode: e.Response.Status, Message: e.Response.StatusText}
+	}
+
+	return b, rsp, nil
+}
+
+// encodeContent keeps text readable in the recording so it can be edited by
+// hand when it's used as a fixture.
+func encodeContent(b []byte, mimeType string) harContent {
+	if utf8.Valid(b) {
+		return harContent{Size: len(b), MimeType: mimeType, Text: string(b)}
+	}
+
+	return harContent{
+		Size:     len(b),
+		MimeType: mimeType,
+		Text:     base64.StdEncoding.EncodeToString(b),
+		Encoding: "base64",
+	}
+}
+
+func decodeContent(c harContent) ([]byte, error) {
+	if c.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(c.Text)
+	}
+
+	return []byte(c.Text), nil
+}
+
+// replayedError stands in for a recorded network error, keeping whether it
+// was a timeout so the adaptive controller treats it the same way.
+type replayedError struct {
+	msg     string
+	timeout bool
+}
+
+func (e *replayedError) Error() string   { return e.msg }
+func (e *replayedError) Timeout() bool   { return e.timeout }
+func (e *replayedError) Temporary() bool { return e.timeout }
@@ -0,0 +1,160 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dovys/monzo-crawler/mock"
+	"github.com/stretchr/testify/assert"
+	stdmock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	f := &mock.FetcherMock{}
+	f.On("Fetch", "https://monzo.com/").Once().Return([]byte("<html>"), nil)
+	f.On("Fetch", "https://monzo.com/").Once().Return([]byte("<html>v2"), nil)
+	f.On("Fetch", "https://monzo.com/logo.png").Once().Return([]byte{0xff, 0xd8, 0xff}, nil)
+	f.On("Fetch", "https://monzo.com/missing").Once().Return([]byte(nil), &HTTPError{StatusCode: 404, Message: "404 Not Found"})
+	f.On("Fetch", "https://monzo.com/slow").Once().Return([]byte(nil), timeoutError{})
+	f.On("Fetch", "https://monzo.com/down").Once().Return([]byte(nil), stderrors.New("connection refused"))
+
+	b := &bytes.Buffer{}
+	r := NewRecordingFetcher(f, b)
+	for _, u := range []string{"/", "/", "/logo.png", "/missing", "/slow", "/down"} {
+		r.Fetch("https://monzo.com" + u)
+	}
+	require.NoError(t, r.Close())
+
+	m := NewMetrics()
+	replay, err := NewReplayFetcher(b, InstrumentFetcher(m))
+	require.NoError(t, err)
+
+	body, err := replay.Fetch("https://monzo.com/")
+	require.NoError(t, err)
+	assert.Equal(t, "<html>", string(body))
+
+	// The last response is repeated
+	for i := 0; i < 2; i++ {
+		body, err = replay.Fetch("https://monzo.com/")
+		require.NoError(t, err)
+		assert.Equal(t, "<html>v2", string(body))
+	}
+
+	body, err = replay.Fetch("https://monzo.com/logo.png")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0xd8, 0xff}, body)
+
+	_, err = replay.Fetch("https://monzo.com/missing")
+	assert.Equal(t, &HTTPError{StatusCode: 404, Message: "404 Not Found"}, err)
+
+	_, err = replay.Fetch("https://monzo.com/slow")
+	var netErr net.Error
+	require.True(t, stderrors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+	assert.Equal(t, outcomeCongested, classify(err))
+
+	_, err = replay.Fetch("https://monzo.com/down")
+	assert.EqualError(t, err, "connection refused")
+
+	_, err = replay.Fetch("https://monzo.com/new")
+	assert.True(t, stderrors.Is(err, ErrNotRecorded))
+
+	metrics := &bytes.Buffer{}
+	m.WriteTo(metrics)
+	assert.Contains(t, metrics.String(), `crawler_requests_total{host="monzo.com",code="404"} 1`)
+
+	f.AssertExpectations(t)
+}
+
+func TestRecordingHoldsTheFieldsHARRequires(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	b := &bytes.Buffer{}
+	r := NewRecordingFetcher(NewFetcher(srv.Client()), b)
+	r.Fetch(srv.URL + "/api?page=2")
+	require.NoError(t, r.Close())
+
+	var h struct {
+		Log struct {
+			Entries []map[string]interface{} `json:"entries"`
+		} `json:"log"`
+	}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &h))
+	require.Len(t, h.Log.Entries, 1)
+
+	e := h.Log.Entries[0]
+	for _, field := range []string{"startedDateTime", "time", "request", "response", "cache", "timings"} {
+		assert.Contains(t, e, field)
+	}
+
+	req := e["request"].(map[string]interface{})
+	for _, field := range []string{"method", "url", "httpVersion", "cookies", "headers", "queryString", "headersSize", "bodySize"} {
+		assert.Contains(t, req, field)
+	}
+	assert.Equal(t, "HTTP/1.1", req["httpVersion"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"name": "page", "value": "2"}}, req["queryString"])
+
+	rsp := e["response"].(map[string]interface{})
+	for _, field := range []string{"status", "statusText", "httpVersion", "cookies", "headers", "content", "redirectURL", "headersSize", "bodySize"} {
+		assert.Contains(t, rsp, field)
+	}
+	assert.Equal(t, "HTTP/1.1", rsp["httpVersion"])
+	assert.Contains(t, rsp["headers"], map[string]interface{}{"name": "Content-Type", "value": "application/json"})
+	assert.Equal(t, []interface{}{map[string]interface{}{"name": "session", "value": "1"}}, rsp["cookies"])
+	assert.Equal(t, float64(len(`{"ok":true}`)), rsp["bodySize"])
+
+	content := rsp["content"].(map[string]interface{})
+	assert.Equal(t, "application/json", content["mimeType"])
+	assert.Equal(t, `{"ok":true}`, content["text"])
+
+	// The recorded headers are replayed
+	replay, err := NewReplayFetcher(b)
+	require.NoError(t, err)
+	_, contentType, err := fetchContentType(replay, srv.URL+"/api?page=2")
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", contentType)
+}
+
+func TestRecordingIsWrittenAsFetchesArrive(t *testing.T) {
+	f := &mock.FetcherMock{}
+	f.On("Fetch", stdmock.Anything).Return([]byte("<html>"), nil)
+
+	// The entries outgrow the write buffer long before the recording is closed
+	b := &bytes.Buffer{}
+	r := NewRecordingFetcher(f, b)
+	for i := 0; i < 100; i++ {
+		r.Fetch(fmt.Sprintf("https://monzo.com/%d", i))
+	}
+	assert.True(t, b.Len() > 0)
+	require.NoError(t, r.Close())
+
+	replay, err := NewReplayFetcher(b)
+	require.NoError(t, err)
+	assert.Len(t, replay.entries, 100)
+}
+
+func TestEmptyRecordingCanBeReplayed(t *testing.T) {
+	b := &bytes.Buffer{}
+	require.NoError(t, NewRecordingFetcher(&mock.FetcherMock{}, b).Close())
+
+	replay, err := NewReplayFetcher(b)
+	require.NoError(t, err)
+	assert.Empty(t, replay.entries)
+}
+
+func TestReplayRefusesNetworkOptions(t *testing.T) {
+	_, err := NewReplayFetcher(&bytes.Buffer{}, Archive(&WARCWriter{}))
+	assert.Equal(t, ErrReplayOption, err)
+}
@@ -0,0 +1,569 @@
+package crawler
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rows listed by the report's tables of slowest pages and largest assets
+const reportTopN = 25
+
+// CrawlReport summarises a crawl recorded by a Store for people who'd rather
+// not read JSON, see WriteHTML.
+type CrawlReport struct {
+	Generated     time.Time
+	Summary       ReportSummary
+	Statuses      []StatusCount
+	BrokenLinks   []BrokenLink
+	Redirects     []RedirectChain
+	SlowestPages  []PageTiming
+	LargestAssets []AssetSize
+	// Asset sizes aren't recorded by the crawl since assets aren't fetched,
+	// they're only listed when measured separately
+	AssetSizesMeasured bool
+	Tree               []*SiteNode
+}
+
+type ReportSummary struct {
+	Pages      int
+	OK         int
+	Broken     int
+	Redirects  int
+	Errors     int
+	Links      int
+	Assets     int
+	Duplicates int
+	MaxDepth   int
+	Bytes      int64
+	AvgFetchMS float64
+}
+
+type StatusCount struct {
+	Status  int
+	Count   int
+	Percent float64
+}
+
+// BrokenLink is a page which couldn't be fetched along with the pages linking to it.
+type BrokenLink struct {
+	URL       string
+	Status    int
+	Error     string
+	Referrers []string
+}
+
+// RedirectChain is a sequence of redirects, from the first url requested to
+// the url it ended up at. Loop is set when the chain redirects back to a url
+// it went through.
+type RedirectChain struct {
+	Hops  []RedirectHop
+	Final string
+	Loop  bool
+}
+
+type RedirectHop struct {
+	URL    string
+	Status int
+}
+
+type PageTiming struct {
+	URL     string
+	FetchMS float64
+	Size    int64
+}
+
+type AssetSize struct {
+	URL  string
+	Size int64
+	// Number of pages using the asset
+	Pages int
+}
+
+// SiteNode is a path segment of the site tree. URL is empty for segments
+// which weren't crawled themselves.
+type SiteNode struct {
+	Name     string
+	URL      string
+	Status   int
+	Pages    int
+	Children []*SiteNode
+}
+
+// NewCrawlReport builds the report of the crawl in the tables. assetSizes
+// holds the size in bytes of assets by url, it can be nil when they weren't
+// measured.
+func NewCrawlReport(t *Tables, assetSizes map[string]int64) *CrawlReport {
+	r := &CrawlReport{
+		Generated:          time.Now().UTC(),
+		AssetSizesMeasured: assetSizes != nil,
+	}
+
+	r.summarise(t)
+	r.brokenLinks(t)
+	r.redirectChains(t)
+	r.slowestPages(t)
+	r.largestAssets(t, assetSizes)
+	r.siteTree(t)
+
+	return r
+}
+
+func (r *CrawlReport) summarise(t *Tables) {
+	s := &r.Summary
+	statuses := make(map[int]int)
+
+	var fetchMS float64
+	var fetched int
+	for _, p := range t.rows["pages"] {
+		status := int(p.num("status"))
+		statuses[status]++
+
+		s.Pages++
+		switch {
+		case status >= 200 && status < 300:
+			s.OK++
+		case status == 0 || status >= 400:
+			s.Broken++
+		}
+
+		if p.str("duplicate_of") != "" {
+			s.Duplicates++
+		}
+		if d := int(p.num("depth")); d > s.MaxDepth {
+			s.MaxDepth = d
+		}
+		if ms := p.num("fetch_ms"); ms > 0 {
+			fetchMS += ms
+			fetched++
+		}
+		s.Bytes += int64(p.num("size"))
+	}
+
+	if fetched > 0 {
+		s.AvgFetchMS = fetchMS / float64(fetched)
+	}
+
+	assets := make(map[string]bool)
+	for _, a := range t.rows["assets"] {
+		assets[a.str("url")] = true
+	}
+
+	s.Assets = len(assets)
+	s.Links = len(t.rows["links"])
+	s.Errors = len(t.rows["errors"])
+	s.Redirects = len(t.rows["redirects"])
+
+	for status, n := range statuses {
+		r.Statuses = append(r.Statuses, StatusCount{
+			Status:  status,
+			Count:   n,
+			Percent: 100 * float64(n) / float64(s.Pages),
+		})
+	}
+	sort.Slice(r.Statuses, func(i, j int) bool { return r.Statuses[i].Status < r.Statuses[j].Status })
+}
+
+func (r *CrawlReport) brokenLinks(t *Tables) {
+	// The error of the last attempt at fetching each url
+	fetchErrors := make(map[string]Row)
+	for _, e := range t.rows["errors"] {
+		if e.str("phase") == string(PhaseFetch) {
+			fetchErrors[canonicalString(e.str("url"))] = e
+		}
+	}
+
+	for _, p := range t.rows["pages"] {
+		status := int(p.num("status"))
+		if status > 0 && status < 400 {
+			continue
+		}
+
+		k := canonicalString(p.str("url"))
+		referrers := make(map[string]bool)
+		for _, from := range t.linkedFrom[k] {
+			referrers[from] = true
+		}
+
+		b := BrokenLink{URL: p.str("url"), Status: status}
+		if e, ok := fetchErrors[k]; ok {
+			b.Error = e.str("error")
+			if ref := e.str("referrer"); ref != "" {
+				referrers[canonicalString(ref)] = true
+			}
+		}
+
+		for ref := range referrers {
+			b.Referrers = append(b.Referrers, ref)
+		}
+		sort.Strings(b.Referrers)
+
+		r.BrokenLinks = append(r.BrokenLinks, b)
+	}
+
+	sort.Slice(r.BrokenLinks, func(i, j int) bool { return r.BrokenLinks[i].URL < r.BrokenLinks[j].URL })
+}
+
+func (r *CrawlReport) redirectChains(t *Tables) {
+	next := make(map[string]Row)
+	targets := make(map[string]bool)
+	for _, row := range t.rows["redirects"] {
+		next[row.str("from")] = row
+		targets[row.str("to")] = true
+	}
+
+	var starts []string
+	for from := range next {
+		if !targets[from] {
+			starts = append(starts, from)
+		}
+	}
+	sort.Strings(starts)
+
+	visited := make(map[string]bool)
+	follow := func(u string) {
+		c := RedirectChain{}
+		seen := make(map[string]bool)
+		for {
+			row, ok := next[u]
+			if !ok {
+				break
+			}
+			if seen[u] {
+				c.Loop = true
+				break
+			}
+			seen[u], visited[u] = true, true
+
+			c.Hops = append(c.Hops, RedirectHop{URL: u, Status: int(row.num("status"))})
+			u = row.str("to")
+		}
+		c.Final = u
+
+		r.Redirects = append(r.Redirects, c)
+	}
+
+	for _, u := range starts {
+		follow(u)
+	}
+
+	// Whatever is left redirects in a circle, with no url leading into it
+	var loops []string
+	for from := range next {
+		loops = append(loops, from)
+	}
+	sort.Strings(loops)
+
+	for _, u := range loops {
+		if !visited[u] {
+			follow(u)
+		}
+	}
+}
+
+func (r *CrawlReport) slowestPages(t *Tables) {
+	for _, p := range t.rows["pages"] {
+		if ms := p.num("fetch_ms"); ms > 0 {
+			r.SlowestPages = append(r.SlowestPages, PageTiming{URL: p.str("url"), FetchMS: ms, Size: int64(p.num("size"))})
+		}
+	}
+
+	sort.SliceStable(r.SlowestPages, func(i, j int) bool { return r.SlowestPages[i].FetchMS > r.SlowestPages[j].FetchMS })
+	if len(r.SlowestPages) > reportTopN {
+		r.SlowestPages = r.SlowestPages[:reportTopN]
+	}
+}
+
+func (r *CrawlReport) largestAssets(t *Tables, sizes map[string]int64) {
+	if sizes == nil {
+		return
+	}
+
+	pages := make(map[string]map[string]bool)
+	for _, a := range t.rows["assets"] {
+		u := a.str("url")
+		if pages[u] == nil {
+			pages[u] = make(map[string]bool)
+		}
+		pages[u][a.str("page")] = true
+	}
+
+	for u, p := range pages {
+		if size, ok := sizes[u]; ok {
+			r.LargestAssets = append(r.LargestAssets, AssetSize{URL: u, Size: size, Pages: len(p)})
+		}
+	}
+
+	sort.Slice(r.LargestAssets, func(i, j int) bool {
+		a, b := r.LargestAssets[i], r.LargestAssets[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+
+		return a.URL < b.URL
+	})
+	if len(r.LargestAssets) > reportTopN {
+		r.LargestAssets = r.LargestAssets[:reportTopN]
+	}
+}
+
+// siteTree arranges the pages by host and then by the segments of their path.
+func (r *CrawlReport) siteTree(t *Tables) {
+	hosts := make(map[string]*SiteNode)
+	for _, p := range t.rows["pages"] {
+		u, err := url.Parse(p.str("url"))
+		if err != nil {
+			continue
+		}
+
+		root := u.Scheme + "://" + u.Host
+		n, ok := hosts[root]
+		if !ok {
+			n = &SiteNode{Name: root}
+			hosts[root] = n
+			r.Tree = append(r.Tree, n)
+		}
+
+		path := strings.Trim(u.EscapedPath(), "/")
+		var segments []string
+		if path != "" {
+			segments = strings.Split(path, "/")
+		}
+		if u.RawQuery != "" {
+			if len(segments) == 0 {
+				segments = []string{""}
+			}
+			segments[len(segments)-1] += "?" + u.RawQuery
+		}
+
+		n.Pages++
+		for _, s := range segments {
+			n = n.child(s)
+			n.Pages++
+		}
+
+		n.URL, n.Status = p.str("url"), int(p.num("status"))
+	}
+
+	sort.Slice(r.Tree, func(i, j int) bool { return r.Tree[i].Name < r.Tree[j].Name })
+	for _, n := range r.Tree {
+		n.sort()
+	}
+}
+
+func (n *SiteNode) child(name string) *SiteNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+
+	c := &SiteNode{Name: name}
+	n.Children = append(n.Children, c)
+
+	return c
+}
+
+func (n *SiteNode) sort() {
+	sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+	for _, c := range n.Children {
+		c.sort()
+	}
+}
+
+// WriteHTML writes the report as a single HTML page with no external assets,
+// so that it can be attached to an email or opened from disk.
+func (r *CrawlReport) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, r)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes":       formatBytes,
+	"ms":          func(ms float64) string { return fmt.Sprintf("%.0f ms", ms) },
+	"percent":     func(p float64) string { return fmt.Sprintf("%.1f", p) },
+	"status":      statusText,
+	"statusClass": statusClass,
+}).Parse(reportHTML))
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func statusClass(status int) string {
+	switch {
+	case status == 0:
+		return "none"
+	case status < 300:
+		return "ok"
+	case status < 400:
+		return "redirect"
+	case status < 500:
+		return "client"
+	}
+
+	return "server"
+}
+
+const reportHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Crawl report</title>
+<style>
+body { font: 14px/1.5 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #222; margin: 0 auto; max-width: 1100px; padding: 1em 2em 4em; }
+h1 { margin-bottom: 0; }
+h2 { margin-top: 2em; border-bottom: 1px solid #ddd; padding-bottom: .2em; }
+.muted { color: #777; }
+nav a { margin-right: 1em; }
+.cards { display: flex; flex-wrap: wrap; gap: .8em; }
+.card { border: 1px solid #ddd; border-radius: 6px; padding: .6em 1em; min-width: 7em; }
+.card b { display: block; font-size: 1.6em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .3em .6em; border-bottom: 1px solid #eee; vertical-align: top; }
+td.num, th.num { text-align: right; white-space: nowrap; }
+td a, li a { word-break: break-all; }
+.bar { background: #eee; height: .8em; min-width: 10em; }
+.bar span { display: block; height: 100%; }
+.status { font-weight: bold; }
+.ok { color: #1a7f37; } .bar .ok { background: #1a7f37; }
+.redirect { color: #9a6700; } .bar .redirect { background: #d4a72c; }
+.client, .none { color: #cf222e; } .bar .client, .bar .none { background: #cf222e; }
+.server { color: #8250df; } .bar .server { background: #8250df; }
+ul.referrers { margin: 0; padding-left: 1.2em; }
+.tree ul { list-style: none; padding-left: 1.2em; margin: 0; }
+.tree > ul { padding-left: 0; }
+summary { cursor: pointer; }
+</style>
+</head>
+<body>
+<h1>Crawl report</h1>
+<p class="muted">Generated {{.Generated.Format "2 January 2006 15:04 MST"}}</p>
+<nav>
+<a href="#summary">Summary</a>
+<a href="#statuses">Status codes</a>
+<a href="#broken">Broken links</a>
+<a href="#redirects">Redirects</a>
+<a href="#slowest">Slowest pages</a>
+<a href="#assets">Largest assets</a>
+<a href="#tree">Site tree</a>
+</nav>
+
+<h2 id="summary">Summary</h2>
+{{with .Summary}}
+<div class="cards">
+<div class="card"><b>{{.Pages}}</b>pages</div>
+<div class="card"><b class="ok">{{.OK}}</b>successful</div>
+<div class="card"><b class="client">{{.Broken}}</b>broken</div>
+<div class="card"><b>{{.Redirects}}</b>redirects</div>
+<div class="card"><b>{{.Errors}}</b>errors</div>
+<div class="card"><b>{{.Links}}</b>links</div>
+<div class="card"><b>{{.Assets}}</b>assets</div>
+<div class="card"><b>{{.Duplicates}}</b>duplicates</div>
+<div class="card"><b>{{.MaxDepth}}</b>deepest level</div>
+<div class="card"><b>{{bytes .Bytes}}</b>downloaded</div>
+<div class="card"><b>{{ms .AvgFetchMS}}</b>average fetch</div>
+</div>
+{{end}}
+
+<h2 id="statuses">Status codes</h2>
+{{if .Statuses}}
+<table>
+<tr><th>Status</th><th class="num">Pages</th><th class="num">Share</th><th></th></tr>
+{{range .Statuses}}
+<tr>
+<td class="status {{statusClass .Status}}">{{status .Status}}</td>
+<td class="num">{{.Count}}</td>
+<td class="num">{{percent .Percent}}%</td>
+<td><div class="bar"><span class="{{statusClass .Status}}" style="width: {{percent .Percent}}%"></span></div></td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">No pages were crawled.</p>
+{{end}}
+
+<h2 id="broken">Broken links</h2>
+{{if .BrokenLinks}}
+<table>
+<tr><th>Page</th><th>Status</th><th>Linked from</th></tr>
+{{range .BrokenLinks}}
+<tr>
+<td><a href="{{.URL}}">{{.URL}}</a>{{if .Error}}<br><span class="muted">{{.Error}}</span>{{end}}</td>
+<td class="status {{statusClass .Status}}">{{status .Status}}</td>
+<td>{{if .Referrers}}<ul class="referrers">{{range .Referrers}}<li><a href="{{.}}">{{.}}</a></li>{{end}}</ul>{{else}}<span class="muted">seed</span>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">No broken links.</p>
+{{end}}
+
+<h2 id="redirects">Redirect chains</h2>
+{{if .Redirects}}
+<table>
+<tr><th>Chain</th><th class="num">Hops</th></tr>
+{{range .Redirects}}
+<tr>
+<td>{{range .Hops}}<a href="{{.URL}}">{{.URL}}</a> <span class="status redirect">{{.Status}}</span> &rarr; {{end}}{{if .Loop}}<span class="status client">loop back to</span> {{end}}<a href="{{.Final}}">{{.Final}}</a></td>
+<td class="num">{{len .Hops}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">No redirects were followed.</p>
+{{end}}
+
+<h2 id="slowest">Slowest pages</h2>
+{{if .SlowestPages}}
+<table>
+<tr><th>Page</th><th class="num">Fetch time</th><th class="num">Size</th></tr>
+{{range .SlowestPages}}
+<tr><td><a href="{{.URL}}">{{.URL}}</a></td><td class="num">{{ms .FetchMS}}</td><td class="num">{{bytes .Size}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">No pages were fetched.</p>
+{{end}}
+
+<h2 id="assets">Largest assets</h2>
+{{if not .AssetSizesMeasured}}
+<p class="muted">Asset sizes weren't measured. The crawler doesn't download assets, generate the report with -asset-sizes to measure them.</p>
+{{else if .LargestAssets}}
+<table>
+<tr><th>Asset</th><th class="num">Size</th><th class="num">Pages using it</th></tr>
+{{range .LargestAssets}}
+<tr><td><a href="{{.URL}}">{{.URL}}</a></td><td class="num">{{bytes .Size}}</td><td class="num">{{.Pages}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">No asset sizes could be measured.</p>
+{{end}}
+
+<h2 id="tree">Site tree</h2>
+{{if .Tree}}
+<div class="tree"><ul>{{range .Tree}}<li><details open><summary>{{template "nodeName" .}} <span class="muted">({{.Pages}} pages)</span></summary><ul>{{range .Children}}{{template "node" .}}{{end}}</ul></details></li>{{end}}</ul></div>
+{{else}}
+<p class="muted">No pages were crawled.</p>
+{{end}}
+</body>
+</html>
+
+{{define "node"}}<li>{{if .Children}}<details><summary>{{template "nodeName" .}} <span class="muted">({{.Pages}})</span></summary><ul>{{range .Children}}{{template "node" .}}{{end}}</ul></details>{{else}}{{template "nodeName" .}}{{end}}</li>{{end}}
+{{define "nodeName"}}{{if .URL}}<a href="{{.URL}}">{{if .Name}}{{.Name}}{{else}}/{{end}}</a> <span class="status {{statusClass .Status}}">{{status .Status}}</span>{{else}}<span class="muted">{{.Name}}</span>{{end}}{{end}}
+`
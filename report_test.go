@@ -0,0 +1,116 @@
+package crawler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrawlReport(t *testing.T) {
+	tables := crawlToStore(t, storeSite)
+
+	r := NewCrawlReport(tables, map[string]int64{"https://monzo.com/logo.png": 2048})
+
+	assert.Equal(t, 7, r.Summary.Pages)
+	assert.Equal(t, 4, r.Summary.OK)
+	assert.Equal(t, 3, r.Summary.Broken)
+	assert.Equal(t, 1, r.Summary.Redirects)
+	assert.Equal(t, 4, r.Summary.MaxDepth)
+	assert.Equal(t, []StatusCount{
+		{Status: 200, Count: 4, Percent: 100 * 4 / 7.0},
+		{Status: 404, Count: 3, Percent: 100 * 3 / 7.0},
+	}, r.Statuses)
+
+	require.Len(t, r.BrokenLinks, 3)
+	assert.Equal(t, BrokenLink{
+		URL:       "https://monzo.com/gone",
+		Status:    404,
+		Error:     "404 Not Found",
+		Referrers: []string{"https://monzo.com/about/team"},
+	}, r.BrokenLinks[0])
+
+	assert.Equal(t, []RedirectChain{{
+		Hops:  []RedirectHop{{URL: "https://monzo.com/old", Status: 301}},
+		Final: "https://monzo.com/",
+	}}, r.Redirects)
+
+	assert.Len(t, r.SlowestPages, 4)
+	assert.Equal(t, []AssetSize{{URL: "https://monzo.com/logo.png", Size: 2048, Pages: 1}}, r.LargestAssets)
+
+	require.Len(t, r.Tree, 1)
+	root := r.Tree[0]
+	assert.Equal(t, "https://monzo.com", root.Name)
+	assert.Equal(t, "https://monzo.com/", root.URL)
+	assert.Equal(t, 7, root.Pages)
+
+	require.Len(t, root.Children, 4)
+	about := root.Children[0]
+	assert.Equal(t, "about", about.Name)
+	assert.Equal(t, 3, about.Pages)
+	assert.Equal(t, "team", about.Children[0].Name)
+	assert.Equal(t, "jobs", about.Children[0].Children[0].Name)
+
+	b := &bytes.Buffer{}
+	require.NoError(t, r.WriteHTML(b))
+	html := b.String()
+	assert.Contains(t, html, `<div class="card"><b class="client">3</b>broken</div>`)
+	assert.Contains(t, html, `<a href="https://monzo.com/gone">https://monzo.com/gone</a><br><span class="muted">404 Not Found</span>`)
+	assert.Contains(t, html, `<td class="num">2.0 KiB</td>`)
+	assert.NotContains(t, html, "<script")
+}
+
+func TestCrawlReportWithoutAssetSizes(t *testing.T) {
+	r := NewCrawlReport(crawlToStore(t, storeSite), nil)
+	assert.False(t, r.AssetSizesMeasured)
+	assert.Empty(t, r.LargestAssets)
+
+	b := &bytes.Buffer{}
+	require.NoError(t, r.WriteHTML(b))
+	assert.Contains(t, b.String(), "Asset sizes weren't measured")
+}
+
+func TestCrawlReportRedirectChains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := OpenStore(dir, false)
+	require.NoError(t, err)
+
+	redirect := func(from, to string, status int) {
+		f, _ := url.Parse(from)
+		t, _ := url.Parse(to)
+		store.RecordRedirect(f, t, status)
+	}
+	redirect("http://monzo.com/", "https://monzo.com/", 301)
+	redirect("https://monzo.com/", "https://monzo.com/home", 302)
+	redirect("https://monzo.com/a", "https://monzo.com/b", 307)
+	redirect("https://monzo.com/b", "https://monzo.com/a", 307)
+	require.NoError(t, store.Close())
+
+	tables, err := ReadStore(dir)
+	require.NoError(t, err)
+
+	assert.Equal(t, []RedirectChain{
+		{
+			Hops:  []RedirectHop{{"http://monzo.com/", 301}, {"https://monzo.com/", 302}},
+			Final: "https://monzo.com/home",
+		},
+		{
+			Hops:  []RedirectHop{{"https://monzo.com/a", 307}, {"https://monzo.com/b", 307}},
+			Final: "https://monzo.com/a",
+			Loop:  true,
+		},
+	}, NewCrawlReport(tables, nil).Redirects)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "3.0 MiB", formatBytes(3*1024*1024))
+}
@@ -0,0 +1,307 @@
+package crawler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Journal checkpoints crawl progress so that an interrupted crawl can be
+// resumed without starting from scratch.
+type Journal interface {
+	// Records a request which was accepted into the frontier, or a pending
+	// one which is retried with its attempts so far
+	Enqueued(*Request) error
+	// Records a url which has been crawled and no longer needs to be visited
+	Crawled(*url.URL) error
+}
+
+const (
+	journalEnqueued = '+'
+	journalCrawled  = '-'
+	// Written during compaction for urls which were both enqueued and crawled
+	journalVisited = '*'
+
+	defaultCompactAfter = 100000
+)
+
+type journalEntry struct {
+	seq     int
+	request *Request
+}
+
+// FileJournal is an append-only Journal backed by a local file. Every record is
+// written straight to the file so progress survives a crash. The log is
+// periodically compacted down to the current frontier and seen-set.
+type FileJournal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+
+	// Sequence numbers keep the resumed frontier in the original order
+	seq     int
+	pending map[string]*journalEntry
+	visited map[string]struct{}
+
+	records      int
+	compactAfter int
+}
+
+// OpenFileJournal opens the journal at path. When resume is false any previous
+// state is discarded, otherwise the existing log is replayed.
+func OpenFileJournal(path string, resume bool) (*FileJournal, error) {
+	j := &FileJournal{
+		path:         path,
+		pending:      make(map[string]*journalEntry),
+		visited:      make(map[string]struct{}),
+		compactAfter: defaultCompactAfter,
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		if err := j.replay(); err != nil {
+			return nil, err
+		}
+
+		// Rewriting the log drops a possibly torn last record
+		if err := j.compact(); err != nil {
+			return nil, err
+		}
+
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j.file = f
+
+	return j, nil
+}
+
+// CompactAfter sets the number of appended records after which the log is rewritten.
+func (j *FileJournal) CompactAfter(records int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.compactAfter = records
+}
+
+// Pending returns requests which were enqueued but never crawled in the order they were enqueued.
+func (j *FileJournal) Pending() []*Request {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	requests := make([]*Request, 0, len(j.pending))
+	for _, k := range j.pendingKeys() {
+		requests = append(requests, j.pending[k].request)
+	}
+
+	return requests
+}
+
+// Visited returns urls which have already been crawled.
+func (j *FileJournal) Visited() []*url.URL {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	keys := make([]string, 0, len(j.visited))
+	for k := range j.visited {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	urls := make([]*url.URL, 0, len(keys))
+	for _, k := range keys {
+		if u, err := url.Parse(k); err == nil {
+			urls = append(urls, u)
+		}
+	}
+
+	return urls
+}
+
+func (j *FileJournal) Enqueued(r *Request) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	k := r.URL.String()
+	if e, ok := j.pending[k]; ok {
+		if e.request.Attempts == r.Attempts {
+			return nil
+		}
+
+		e.request = r
+	} else {
+		j.seq++
+		j.pending[k] = &journalEntry{seq: j.seq, request: r}
+	}
+
+	return j.append(journalEnqueued, formatRequest(r))
+}
+
+func (j *FileJournal) Crawled(u *url.URL) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	k := u.String()
+	delete(j.pending, k)
+	j.visited[k] = struct{}{}
+
+	return j.append(journalCrawled, k)
+}
+
+// Compact rewrites the log so it only contains the current state.
+func (j *FileJournal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.rewrite()
+}
+
+// Close compacts the log and releases the underlying file.
+func (j *FileJournal) Close() error {
+	if err := j.Compact(); err != nil {
+		return err
+	}
+
+	return j.file.Close()
+}
+
+func (j *FileJournal) append(op byte, record string) error {
+	if _, err := fmt.Fprintf(j.file, "%c %s\n", op, record); err != nil {
+		return err
+	}
+
+	j.records++
+	if j.compactAfter <= 0 || j.records < j.compactAfter {
+		return nil
+	}
+
+	return j.rewrite()
+}
+
+func (j *FileJournal) rewrite() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+
+	if err := j.compact(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.file = f
+
+	return nil
+}
+
+func (j *FileJournal) replay() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		// A record without a trailing newline was only partially written before a crash
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) < 3 || line[1] != ' ' {
+			return fmt.Errorf("%s:%d: Malformed record %q", j.path, n, line)
+		}
+
+		switch line[0] {
+		case journalEnqueued:
+			r, err := parseRequest(line[2:])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", j.path, n, err)
+			}
+
+			k := r.URL.String()
+			if _, ok := j.visited[k]; ok {
+				break
+			}
+			// Retries are recorded again with their attempts, keeping
+			// their place in the queue
+			if e, ok := j.pending[k]; ok {
+				e.request = r
+			} else {
+				j.seq++
+				j.pending[k] = &journalEntry{seq: j.seq, request: r}
+			}
+		case journalCrawled, journalVisited:
+			k := line[2:]
+			delete(j.pending, k)
+			j.visited[k] = struct{}{}
+		default:
+			return fmt.Errorf("%s:%d: Unknown record %q", j.path, n, line)
+		}
+	}
+}
+
+// compact expects the journal file to be closed.
+func (j *FileJournal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for k := range j.visited {
+		fmt.Fprintf(w, "%c %s\n", journalVisited, k)
+	}
+
+	for _, k := range j.pendingKeys() {
+		fmt.Fprintf(w, "%c %s\n", journalEnqueued, formatRequest(j.pending[k].request))
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	j.records = 0
+
+	return os.Rename(tmp, j.path)
+}
+
+func (j *FileJournal) pendingKeys() []string {
+	keys := make([]string, 0, len(j.pending))
+	for k := range j.pending {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(a, b int) bool { return j.pending[keys[a]].seq < j.pending[keys[b]].seq })
+
+	return keys
+}
@@ -0,0 +1,189 @@
+package crawler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	stdmock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func tempJournalPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+
+	return filepath.Join(dir, "state"), func() { os.RemoveAll(dir) }
+}
+
+func TestJournalResumesPendingAndVisited(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+
+	root, _ := url.Parse("https://google.com")
+	about, _ := url.Parse("https://google.com/about")
+	tos, _ := url.Parse("https://google.com/tos")
+
+	j, err := OpenFileJournal(path, false)
+	require.NoError(t, err)
+
+	require.NoError(t, j.Enqueued(&Request{URL: root}))
+	require.NoError(t, j.Enqueued(&Request{URL: about, Depth: 1}))
+	require.NoError(t, j.Enqueued(&Request{URL: tos, Depth: 1}))
+	require.NoError(t, j.Crawled(root))
+	// Simulating a crash: the file is never closed or compacted
+	j.file.Close()
+
+	j, err = OpenFileJournal(path, true)
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.Equal(t, []*Request{{URL: about, Depth: 1}, {URL: tos, Depth: 1}}, j.Pending())
+	assert.Equal(t, []*url.URL{root}, j.Visited())
+}
+
+func TestJournalKeepsRetryAttempts(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+
+	about, _ := url.Parse("https://google.com/about")
+	tos, _ := url.Parse("https://google.com/tos")
+
+	j, err := OpenFileJournal(path, false)
+	require.NoError(t, err)
+
+	require.NoError(t, j.Enqueued(&Request{URL: about, Depth: 1}))
+	require.NoError(t, j.Enqueued(&Request{URL: tos, Depth: 1}))
+	require.NoError(t, j.Enqueued(&Request{URL: about, Depth: 1, Attempts: 2}))
+	j.file.Close()
+
+	j, err = OpenFileJournal(path, true)
+	require.NoError(t, err)
+	defer j.Close()
+
+	// The retry keeps its place in the queue
+	assert.Equal(t, []*Request{{URL: about, Depth: 1, Attempts: 2}, {URL: tos, Depth: 1}}, j.Pending())
+}
+
+func TestJournalIgnoresTornRecord(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+
+	torn := "+ " + formatRequest(request("https://google.com/about", 1))
+	records := "+ " + formatRequest(request("https://google.com", 0)) + "\n- https://google.com\n" + torn[:len(torn)/2]
+	err := ioutil.WriteFile(path, []byte(records), 0644)
+	require.NoError(t, err)
+
+	j, err := OpenFileJournal(path, true)
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.Len(t, j.Pending(), 0)
+	assert.Len(t, j.Visited(), 1)
+}
+
+func TestJournalRefusesMalformedRecords(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+
+	err := ioutil.WriteFile(path, []byte("+ "+formatRequest(request("https://google.com", 0))+"\n+ deep\thttps://google.com/about\n- https://google.com\n"), 0644)
+	require.NoError(t, err)
+
+	_, err = OpenFileJournal(path, true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), path+":2: ")
+}
+
+func TestJournalWithoutResumeDiscardsState(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+
+	err := ioutil.WriteFile(path, []byte("+ "+formatRequest(request("https://google.com", 0))+"\n"), 0644)
+	require.NoError(t, err)
+
+	j, err := OpenFileJournal(path, false)
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.Len(t, j.Pending(), 0)
+	assert.Len(t, j.Visited(), 0)
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+
+	j, err := OpenFileJournal(path, false)
+	require.NoError(t, err)
+	j.CompactAfter(4)
+
+	for _, p := range []string{"a", "b", "c"} {
+		u, _ := url.Parse("https://google.com/" + p)
+		require.NoError(t, j.Enqueued(&Request{URL: u}))
+		require.NoError(t, j.Crawled(u))
+	}
+	require.NoError(t, j.Close())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 3)
+	for _, l := range lines {
+		assert.True(t, strings.HasPrefix(l, "* "))
+	}
+}
+
+func TestCrawlResumesFromJournal(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+
+	root, _ := url.Parse("https://google.com")
+	about, _ := url.Parse("https://google.com/about")
+	tos, _ := url.Parse("https://google.com/tos")
+
+	j, err := OpenFileJournal(path, false)
+	require.NoError(t, err)
+
+	s := setup(1, 100, 100)
+	c := NewCrawler(s.p, s.f, NewUniqueSet(), Concurrency(1), Checkpoints(j))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.f.On("Fetch", root.String()).Once().Run(func(a stdmock.Arguments) {
+		cancel()
+	}).Return([]byte("body"), nil)
+	s.p.On("Parse", root, []byte("body")).Once().Return([]*url.URL{about, tos}, []*url.URL{}, nil)
+
+	c.Enqueue(root)
+	p, _ := run(c, root, ctx)
+	require.Len(t, p, 1)
+	require.NoError(t, j.Close())
+
+	j, err = OpenFileJournal(path, true)
+	require.NoError(t, err)
+	defer j.Close()
+
+	s = setup(1, 100, 100)
+	c = NewCrawler(s.p, s.f, NewUniqueSet(), Concurrency(1), Resume(j))
+
+	s.f.On("Fetch", about.String()).Once().Return([]byte("about"), nil)
+	s.f.On("Fetch", tos.String()).Once().Return([]byte("tos"), nil)
+	s.p.On("Parse", about, []byte("about")).Once().Return([]*url.URL{root}, []*url.URL{}, nil)
+	s.p.On("Parse", tos, []byte("tos")).Once().Return([]*url.URL{root}, []*url.URL{}, nil)
+
+	p, _ = run(c, root, context.Background())
+
+	require.Len(t, p, 2)
+	assert.Equal(t, about.String(), p[0].String())
+	assert.Equal(t, tos.String(), p[1].String())
+	assert.Equal(t, 1, p[1].Depth)
+	assert.Len(t, j.Pending(), 0)
+
+	s.AssertExpectations(t)
+}
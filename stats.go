@@ -0,0 +1,327 @@
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Stats is a snapshot of a crawl's progress.
+type Stats struct {
+	// Urls waiting in the frontier
+	Queued   int
+	InFlight int
+	// Urls accepted into the frontier since the crawler was created
+	Seen    int
+	Crawled int
+	Failed  int
+	Skipped int
+	// Congested urls put back into the frontier
+	Retries     int
+	ParseErrors int
+	// Size of all fetched bodies
+	Bytes int64
+
+	Elapsed        time.Duration
+	PagesPerSecond float64
+
+	// Responses by status code, 0 counts requests which failed without a response
+	StatusCodes map[int]int
+	Latency     LatencyPercentiles
+
+	Hosts map[string]HostStats
+	// Pipeline stages by name
+	Stages map[string]StageStats
+}
+
+type HostStats struct {
+	Crawled     int
+	Failed      int
+	Bytes       int64
+	StatusCodes map[int]int
+	Latency     LatencyPercentiles
+}
+
+type LatencyPercentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets. It's
+// an array so the histogram's size follows from it.
+var latencyBuckets = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// overflowBucket catches every latency above the largest bound.
+const overflowBucket = len(latencyBuckets)
+
+// latencyHistogram counts latencies in fixed buckets, so it uses constant
+// memory no matter how many pages are crawled.
+type latencyHistogram struct {
+	counts [overflowBucket + 1]int
+	count  int
+	sum    time.Duration
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < overflowBucket && d > latencyBuckets[i] {
+		i++
+	}
+
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// percentile estimates the q-th quantile by interpolating inside the bucket it falls into.
+func (h *latencyHistogram) percentile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := q * float64(h.count)
+	cumulative := 0
+	for i, c := range h.counts {
+		if c == 0 || float64(cumulative+c) < rank {
+			cumulative += c
+			continue
+		}
+
+		lower := time.Duration(0)
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+
+		// Nothing better to report for the overflow bucket than its lower bound
+		if i == overflowBucket {
+			return lower
+		}
+
+		fraction := (rank - float64(cumulative)) / float64(c)
+		return lower + time.Duration(fraction*float64(latencyBuckets[i]-lower))
+	}
+
+	return latencyBuckets[overflowBucket-1]
+}
+
+func (h *latencyHistogram) percentiles() LatencyPercentiles {
+	return LatencyPercentiles{P50: h.percentile(0.5), P90: h.percentile(0.9), P99: h.percentile(0.99)}
+}
+
+type hostCounters struct {
+	crawled     int
+	failed      int
+	bytes       int64
+	statusCodes map[int]int
+	latency     latencyHistogram
+}
+
+// statsCollector aggregates crawl events. It's safe for concurrent use.
+type statsCollector struct {
+	mu          sync.Mutex
+	started     time.Time
+	inFlight    int
+	seen        int
+	skipped     int
+	retries     int
+	parseErrors int
+	hosts       map[string]*hostCounters
+	stages      map[string]*StageStats
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{hosts: make(map[string]*hostCounters), stages: make(map[string]*StageStats)}
+}
+
+func (s *statsCollector) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+}
+
+func (s *statsCollector) enqueued() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seen++
+}
+
+func (s *statsCollector) rejected(err error) {
+	var skipped *SkippedError
+	if !errors.As(err, &skipped) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.skipped++
+}
+
+func (s *statsCollector) retried() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retries++
+}
+
+func (s *statsCollector) parseFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.parseErrors++
+}
+
+func (s *statsCollector) processed(stage string, d time.Duration, a Action, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.stages[stage]
+	if !ok {
+		st = &StageStats{}
+		s.stages[stage] = st
+	}
+
+	st.Processed++
+	st.Duration += d
+	if err != nil {
+		st.Errors++
+	}
+	if a&DropPage != 0 {
+		st.Dropped++
+	}
+}
+
+func (s *statsCollector) fetchStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight++
+}
+
+// fetched records a response, status is 0 when there was none.
+func (s *statsCollector) fetched(host string, status int, bytes int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight--
+
+	h := s.host(host)
+	h.statusCodes[status]++
+	h.bytes += int64(bytes)
+	h.latency.observe(latency)
+}
+
+// finished records the outcome of crawling a url.
+func (s *statsCollector) finished(host string, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.host(host)
+	if failed {
+		h.failed++
+	} else {
+		h.crawled++
+	}
+}
+
+func (s *statsCollector) host(host string) *hostCounters {
+	h, ok := s.hosts[host]
+	if !ok {
+		h = &hostCounters{statusCodes: make(map[int]int)}
+		s.hosts[host] = h
+	}
+
+	return h
+}
+
+func (s *statsCollector) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := Stats{
+		InFlight:    s.inFlight,
+		Seen:        s.seen,
+		Skipped:     s.skipped,
+		Retries:     s.retries,
+		ParseErrors: s.parseErrors,
+		StatusCodes: make(map[int]int),
+		Hosts:       make(map[string]HostStats, len(s.hosts)),
+		Stages:      make(map[string]StageStats, len(s.stages)),
+	}
+
+	for name, stage := range s.stages {
+		st.Stages[name] = *stage
+	}
+
+	var latency latencyHistogram
+	for name, h := range s.hosts {
+		hs := HostStats{
+			Crawled:     h.crawled,
+			Failed:      h.failed,
+			Bytes:       h.bytes,
+			StatusCodes: make(map[int]int, len(h.statusCodes)),
+			Latency:     h.latency.percentiles(),
+		}
+
+		for code, n := range h.statusCodes {
+			hs.StatusCodes[code] = n
+			st.StatusCodes[code] += n
+		}
+
+		for i, n := range h.latency.counts {
+			latency.counts[i] += n
+		}
+		latency.count += h.latency.count
+		latency.sum += h.latency.sum
+
+		st.Crawled += h.crawled
+		st.Failed += h.failed
+		st.Bytes += h.bytes
+		st.Hosts[name] = hs
+	}
+
+	st.Latency = latency.percentiles()
+
+	if !s.started.IsZero() {
+		st.Elapsed = time.Since(s.started)
+		if st.Elapsed > 0 {
+			st.PagesPerSecond = float64(st.Crawled) / st.Elapsed.Seconds()
+		}
+	}
+
+	return st
+}
+
+// statusCode returns the status of the response a fetch error was caused by,
+// 200 for successful fetches and 0 when no response was received.
+func statusCode(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode
+	}
+
+	return 0
+}
@@ -0,0 +1,67 @@
+package crawler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	h := latencyHistogram{}
+	assert.Equal(t, time.Duration(0), h.percentile(0.5))
+
+	for i := 0; i < 90; i++ {
+		h.observe(20 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(2 * time.Second)
+	}
+
+	p := h.percentiles()
+	assert.True(t, p.P50 > 10*time.Millisecond && p.P50 <= 25*time.Millisecond, p.P50)
+	assert.True(t, p.P90 <= 25*time.Millisecond, p.P90)
+	assert.True(t, p.P99 > time.Second && p.P99 <= 2500*time.Millisecond, p.P99)
+
+	h.observe(time.Minute)
+	assert.Equal(t, 1, h.counts[overflowBucket])
+	assert.Equal(t, 30*time.Second, h.percentile(1))
+}
+
+func TestCrawlStats(t *testing.T) {
+	s := setup(1, 100, 100)
+	root, _ := url.Parse("https://google.com")
+	about, _ := url.Parse("https://google.com/about")
+	missing, _ := url.Parse("https://google.com/missing")
+
+	s.f.On("Fetch", root.String()).Once().Return([]byte("body"), nil)
+	s.f.On("Fetch", about.String()).Once().Return([]byte("about"), nil)
+	s.f.On("Fetch", missing.String()).Once().Return([]byte(nil), &HTTPError{StatusCode: http.StatusNotFound})
+	s.p.On("Parse", root, []byte("body")).Once().Return([]*url.URL{about, missing}, []*url.URL{}, nil)
+	s.p.On("Parse", about, []byte("about")).Once().Return([]*url.URL{root}, []*url.URL{}, nil)
+
+	require.NoError(t, s.c.Enqueue(root))
+	assert.Equal(t, 1, s.c.Stats().Queued)
+
+	run(s.c, root, context.Background())
+
+	st := s.c.Stats()
+	assert.Equal(t, 0, st.Queued)
+	assert.Equal(t, 0, st.InFlight)
+	assert.Equal(t, 3, st.Seen)
+	assert.Equal(t, 2, st.Crawled)
+	assert.Equal(t, 1, st.Failed)
+	assert.Equal(t, int64(9), st.Bytes)
+	assert.Equal(t, map[int]int{http.StatusOK: 2, http.StatusNotFound: 1}, st.StatusCodes)
+	assert.True(t, st.PagesPerSecond > 0)
+
+	require.Contains(t, st.Hosts, "google.com")
+	assert.Equal(t, 2, st.Hosts["google.com"].Crawled)
+	assert.Equal(t, 1, st.Hosts["google.com"].Failed)
+
+	s.AssertExpectations(t)
+}
@@ -0,0 +1,428 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PageRow is a url which was fetched, successfully or not.
+type PageRow struct {
+	URL string `json:"url"`
+	// Zero when the fetch failed without a response
+	Status      int       `json:"status"`
+	Depth       int       `json:"depth"`
+	Title       string    `json:"title,omitempty"`
+	Size        int       `json:"size"`
+	Hash        string    `json:"hash,omitempty"`
+	FetchMS     float64   `json:"fetch_ms"`
+	DuplicateOf string    `json:"duplicate_of,omitempty"`
+	Crawled     time.Time `json:"crawled"`
+}
+
+// LinkRow is a link between two pages on the same host.
+type LinkRow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// AssetRow is a script, stylesheet or image used by a page.
+type AssetRow struct {
+	Page string `json:"page"`
+	URL  string `json:"url"`
+}
+
+type ErrorRow struct {
+	URL      string `json:"url"`
+	Referrer string `json:"referrer,omitempty"`
+	Depth    int    `json:"depth"`
+	Phase    string `json:"phase"`
+	Attempt  int    `json:"attempt"`
+	Status   int    `json:"status"`
+	Error    string `json:"error"`
+}
+
+type RedirectRow struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Status int    `json:"status"`
+}
+
+var storeTables = []struct {
+	name string
+	row  interface{}
+}{
+	{"pages", PageRow{}},
+	{"links", LinkRow{}},
+	{"assets", AssetRow{}},
+	{"errors", ErrorRow{}},
+	{"redirects", RedirectRow{}},
+}
+
+// Store records a crawl as tables which can be queried once it's over, see
+// ReadStore. Register it with RegisterHooks. Redirects aren't visible to
+// the crawler, they're recorded by the http.Client's CheckRedirect with
+// RecordRedirect.
+//
+// The store is a directory with a file of JSON lines per table, so it can
+// also be read with standard tools.
+type Store struct {
+	NoopHooks
+
+	mu     sync.Mutex
+	files  []*os.File
+	tables map[string]*json.Encoder
+	bufs   []*bufio.Writer
+	// Hooks can't fail, so the first error is returned by Close
+	err error
+}
+
+// CreateStore creates the store in dir, replacing the tables of a previous crawl.
+func CreateStore(dir string) (*Store, error) {
+	return OpenStore(dir, false)
+}
+
+// OpenStore opens the store in dir. When resume is false the tables of a
+// previous crawl are replaced, otherwise the rows of the resumed crawl are
+// appended to them. Pages which were being crawled when it was interrupted
+// are crawled again, so they may be recorded twice.
+func OpenStore(dir string, resume bool) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	s := &Store{tables: make(map[string]*json.Encoder)}
+	for _, t := range storeTables {
+		path := filepath.Join(dir, t.name+".jsonl")
+		if resume {
+			if err := dropTornRow(path); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+
+		f, err := os.OpenFile(path, flags, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		w := bufio.NewWriter(f)
+		e := json.NewEncoder(w)
+		e.SetEscapeHTML(false)
+
+		s.files, s.bufs = append(s.files, f), append(s.bufs, w)
+		s.tables[t.name] = e
+	}
+
+	return s, nil
+}
+
+// dropTornRow truncates a table after its last complete row, as an
+// interrupted crawl may have written only part of the last one.
+func dropTornRow(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	end := fi.Size()
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return err
+		}
+
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+
+	if end == fi.Size() {
+		return nil
+	}
+
+	return f.Truncate(end)
+}
+
+func (s *Store) insert(table string, rows ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range rows {
+		if err := s.tables[table].Encode(r); err != nil && s.err == nil {
+			s.err = err
+		}
+	}
+}
+
+func (s *Store) OnParsed(p *Page) {
+	sum := sha256.Sum256(p.Body)
+	page := &PageRow{
+		URL:     p.String(),
+		Status:  200,
+		Depth:   p.Depth,
+		Title:   ExtractTitle(p.Body),
+		Size:    len(p.Body),
+		Hash:    hex.EncodeToString(sum[:]),
+		FetchMS: float64(p.FetchDuration) / float64(time.Millisecond),
+		Crawled: time.Now().UTC(),
+	}
+
+	if p.Duplicate != nil {
+		page.DuplicateOf = p.Duplicate.Of.String()
+	}
+
+	s.insert("pages", page)
+
+	links := make([]interface{}, len(p.Links))
+	for i, l := range p.Links {
+		links[i] = &LinkRow{From: page.URL, To: l.String()}
+	}
+	s.insert("links", links...)
+
+	assets := make([]interface{}, len(p.Assets))
+	for i, a := range p.Assets {
+		assets[i] = &AssetRow{Page: page.URL, URL: a.String()}
+	}
+	s.insert("assets", assets...)
+}
+
+// OnError records every crawl error, and the pages which couldn't be fetched.
+func (s *Store) OnError(err error) {
+	var crawlErr *CrawlError
+	if !errors.As(err, &crawlErr) || crawlErr.URL == nil {
+		return
+	}
+
+	row := &ErrorRow{
+		URL:     crawlErr.URL.String(),
+		Depth:   crawlErr.Depth,
+		Phase:   string(crawlErr.Phase),
+		Attempt: crawlErr.Attempt,
+		Status:  statusCode(crawlErr.Err),
+		Error:   crawlErr.Err.Error(),
+	}
+	if crawlErr.Referrer != nil {
+		row.Referrer = crawlErr.Referrer.String()
+	}
+
+	s.insert("errors", row)
+
+	if crawlErr.Phase == PhaseFetch {
+		s.insert("pages", &PageRow{
+			URL:     row.URL,
+			Status:  row.Status,
+			Depth:   row.Depth,
+			Crawled: time.Now().UTC(),
+		})
+	}
+}
+
+// RecordRedirect records a response redirecting from one url to another.
+func (s *Store) RecordRedirect(from, to *url.URL, status int) {
+	s.insert("redirects", &RedirectRow{From: from.String(), To: to.String(), Status: status})
+}
+
+// Close flushes the tables and returns the first error the store ran into.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.err
+	for i, f := range s.files {
+		if flushErr := s.bufs[i].Flush(); err == nil {
+			err = flushErr
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	s.files, s.bufs = nil, nil
+
+	return err
+}
+
+// Row is a record of a table. Values are strings or float64s.
+type Row map[string]interface{}
+
+func (r Row) str(column string) string {
+	s, _ := r[column].(string)
+
+	return s
+}
+
+// TableSchema lists the columns of a table of the store.
+type TableSchema struct {
+	Name    string
+	Columns []string
+	// Whether each column holds numbers
+	Numeric map[string]bool
+}
+
+// Columns of the pages table computed from the links and assets tables
+var pageCountColumns = []string{"inlinks", "outlinks", "assets"}
+
+// StoreSchema returns the tables of the store along with their columns.
+func StoreSchema() []TableSchema {
+	schema := make([]TableSchema, 0, len(storeTables))
+	for _, t := range storeTables {
+		s := TableSchema{Name: t.name, Numeric: make(map[string]bool)}
+
+		rt := reflect.TypeOf(t.row)
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+
+			s.Columns = append(s.Columns, name)
+			switch f.Type.Kind() {
+			case reflect.Int, reflect.Float64:
+				s.Numeric[name] = true
+			}
+		}
+
+		if t.name == "pages" {
+			for _, c := range pageCountColumns {
+				s.Columns = append(s.Columns, c)
+				s.Numeric[c] = true
+			}
+		}
+
+		schema = append(schema, s)
+	}
+
+	return schema
+}
+
+// Tables holds the tables of a store in memory for querying.
+type Tables struct {
+	schema map[string]TableSchema
+	rows   map[string][]Row
+
+	// Pages by canonical url, and the canonical urls of the pages linking to
+	// and linked from each page
+	pages      map[string]Row
+	linkedFrom map[string][]string
+	linksTo    map[string][]string
+}
+
+// ReadStore loads the tables of the store in dir.
+func ReadStore(dir string) (*Tables, error) {
+	t := &Tables{
+		schema:     make(map[string]TableSchema),
+		rows:       make(map[string][]Row),
+		pages:      make(map[string]Row),
+		linkedFrom: make(map[string][]string),
+		linksTo:    make(map[string][]string),
+	}
+
+	for _, s := range StoreSchema() {
+		t.schema[s.Name] = s
+
+		rows, err := readTable(filepath.Join(dir, s.Name+".jsonl"), s)
+		if err != nil {
+			return nil, err
+		}
+		t.rows[s.Name] = rows
+	}
+
+	inlinks, outlinks, assets := make(map[string]int), make(map[string]int), make(map[string]int)
+	for _, l := range t.rows["links"] {
+		from, to := canonicalString(l.str("from")), canonicalString(l.str("to"))
+		t.linkedFrom[to] = append(t.linkedFrom[to], from)
+		t.linksTo[from] = append(t.linksTo[from], to)
+		inlinks[to]++
+		outlinks[from]++
+	}
+
+	for _, a := range t.rows["assets"] {
+		assets[canonicalString(a.str("page"))]++
+	}
+
+	for _, p := range t.rows["pages"] {
+		k := canonicalString(p.str("url"))
+		p["inlinks"] = float64(inlinks[k])
+		p["outlinks"] = float64(outlinks[k])
+		p["assets"] = float64(assets[k])
+		t.pages[k] = p
+	}
+
+	return t, nil
+}
+
+// readTable reads the rows of a table, filling in the columns left out.
+func readTable(path string, schema TableSchema) ([]Row, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []Row
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; s.Scan(); n++ {
+		r := Row{}
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+
+		for _, c := range schema.Columns {
+			if _, ok := r[c]; ok {
+				continue
+			}
+
+			if schema.Numeric[c] {
+				r[c] = float64(0)
+			} else {
+				r[c] = ""
+			}
+		}
+
+		rows = append(rows, r)
+	}
+
+	return rows, s.Err()
+}
+
+func canonicalString(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	return CanonicalURL(u)
+}
@@ -0,0 +1,127 @@
+package crawler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func crawlToStore(t *testing.T, site siteFetcher) *Tables {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := OpenStore(dir, false)
+	require.NoError(t, err)
+
+	root, _ := url.Parse("https://monzo.com/")
+	c := NewCrawler(NewParser(), site, NewUniqueSet(), Concurrency(1), RegisterHooks(store))
+	require.NoError(t, c.Enqueue(root))
+	run(c, root, context.Background())
+
+	from, _ := url.Parse("https://monzo.com/old")
+	store.RecordRedirect(from, root, 301)
+	require.NoError(t, store.Close())
+
+	tables, err := ReadStore(dir)
+	require.NoError(t, err)
+
+	return tables
+}
+
+var storeSite = siteFetcher{
+	"https://monzo.com/":                `<title>Monzo</title><a href="/about">About</a><a href="/missing">Missing</a><img src="/logo.png" />`,
+	"https://monzo.com/about":           `<title>About</title><a href="/about/team">Team</a>`,
+	"https://monzo.com/about/team":      `<a href="/about/team/jobs">Jobs</a><a href="/gone">Gone</a>`,
+	"https://monzo.com/about/team/jobs": `<title>Jobs</title><a href="/removed">Removed</a>`,
+}
+
+func TestStoreRecordsTheCrawl(t *testing.T) {
+	tables := crawlToStore(t, storeSite)
+
+	r, err := tables.Query("select url, status, depth, title, inlinks, outlinks, assets from pages where url = 'https://monzo.com/'")
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{"https://monzo.com/", float64(200), float64(0), "Monzo", float64(0), float64(2), float64(1)}}, r.Rows)
+
+	r, err = tables.Query("select count(*) from links")
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{float64(6)}}, r.Rows)
+
+	r, err = tables.Query("select url, referrer, status from errors order by url")
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{
+		{"https://monzo.com/gone", "https://monzo.com/about/team", float64(404)},
+		{"https://monzo.com/missing", "https://monzo.com/", float64(404)},
+		{"https://monzo.com/removed", "https://monzo.com/about/team/jobs", float64(404)},
+	}, r.Rows)
+
+	r, err = tables.Query("redirects")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"from", "to", "status"}, r.Columns)
+	assert.Equal(t, [][]interface{}{{"https://monzo.com/old", "https://monzo.com/", float64(301)}}, r.Rows)
+}
+
+func TestStoreSchema(t *testing.T) {
+	schema := StoreSchema()
+	require.Len(t, schema, 5)
+
+	assert.Equal(t, "pages", schema[0].Name)
+	assert.Equal(t, []string{
+		"url", "status", "depth", "title", "size", "hash", "fetch_ms", "duplicate_of", "crawled",
+		"inlinks", "outlinks", "assets",
+	}, schema[0].Columns)
+	assert.True(t, schema[0].Numeric["depth"])
+	assert.False(t, schema[0].Numeric["title"])
+}
+
+func TestResumedStoreAppendsToTheTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old, _ := url.Parse("https://monzo.com/old")
+	root, _ := url.Parse("https://monzo.com/")
+	about, _ := url.Parse("https://monzo.com/about")
+
+	store, err := OpenStore(dir, false)
+	require.NoError(t, err)
+	store.RecordRedirect(old, root, 301)
+	require.NoError(t, store.Close())
+
+	// The crawl was killed while writing a row
+	f, err := os.OpenFile(filepath.Join(dir, "redirects.jsonl"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"from":"https://monzo.com/torn","to":`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	store, err = OpenStore(dir, true)
+	require.NoError(t, err)
+	store.RecordRedirect(about, root, 302)
+	require.NoError(t, store.Close())
+
+	tables, err := ReadStore(dir)
+	require.NoError(t, err)
+	r, err := tables.Query("redirects")
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{
+		{"https://monzo.com/old", "https://monzo.com/", float64(301)},
+		{"https://monzo.com/about", "https://monzo.com/", float64(302)},
+	}, r.Rows)
+
+	store, err = OpenStore(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	tables, err = ReadStore(dir)
+	require.NoError(t, err)
+	r, err = tables.Query("redirects")
+	require.NoError(t, err)
+	assert.Empty(t, r.Rows)
+}
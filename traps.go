@@ -0,0 +1,214 @@
+package crawler
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SkipReason explains why a discovered url wasn't enqueued.
+type SkipReason string
+
+const (
+	SkipURLTooLong        SkipReason = "url too long"
+	SkipPathTooDeep       SkipReason = "path too deep"
+	SkipRepeatedSegments  SkipReason = "repeated path segments"
+	SkipPatternLimit      SkipReason = "too many urls matching the same pattern"
+	SkipTooManyParameters SkipReason = "too many query parameters"
+	SkipQueryVariants     SkipReason = "too many query parameter combinations"
+)
+
+// SkippedError is reported for urls which weren't enqueued.
+type SkippedError struct {
+	URL    *url.URL
+	Reason SkipReason
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("Skipped %s: %s", e.URL, e.Reason)
+}
+
+// TrapLimits configures the crawler trap heuristics. A zero value disables a limit.
+type TrapLimits struct {
+	MaxURLLength int
+	// Number of path segments
+	MaxPathDepth int
+	// Number of times a single segment may appear in a path, e.g. /a/b/a/b/a/b
+	MaxSegmentRepeats int
+	// Number of urls sharing a pattern where numeric and id-like segments and
+	// query values are replaced with placeholders, e.g. /calendar/{n}/{n}
+	MaxURLsPerPattern int
+	// Number of parameters in a single query string
+	MaxQueryParams int
+	// Number of distinct query strings per path, e.g. faceted search filters
+	MaxQueryVariants int
+}
+
+func DefaultTrapLimits() TrapLimits {
+	return TrapLimits{
+		MaxURLLength:      2048,
+		MaxPathDepth:      16,
+		MaxSegmentRepeats: 3,
+		MaxURLsPerPattern: 1000,
+		MaxQueryParams:    10,
+		MaxQueryVariants:  100,
+	}
+}
+
+// TrapDetector recognises urls leading into infinite url spaces like
+// calendars, faceted search or ever growing pagination. It's safe for
+// concurrent use.
+type TrapDetector struct {
+	limits TrapLimits
+
+	mu       sync.Mutex
+	patterns map[string]int
+	variants map[string]map[string]struct{}
+}
+
+func NewTrapDetector(limits TrapLimits) *TrapDetector {
+	return &TrapDetector{
+		limits:   limits,
+		patterns: make(map[string]int),
+		variants: make(map[string]map[string]struct{}),
+	}
+}
+
+// Check returns the reason the url should be skipped, or an empty reason when
+// it can be crawled. Allowed urls count towards the pattern and query limits
+// until they're released.
+func (d *TrapDetector) Check(u *url.URL) SkipReason {
+	l := d.limits
+
+	if l.MaxURLLength > 0 && len(u.String()) > l.MaxURLLength {
+		return SkipURLTooLong
+	}
+
+	segments := pathSegments(u)
+	if l.MaxPathDepth > 0 && len(segments) > l.MaxPathDepth {
+		return SkipPathTooDeep
+	}
+
+	if l.MaxSegmentRepeats > 0 {
+		counts := make(map[string]int, len(segments))
+		for _, s := range segments {
+			counts[s]++
+			if counts[s] > l.MaxSegmentRepeats {
+				return SkipRepeatedSegments
+			}
+		}
+	}
+
+	query := u.Query()
+	params := 0
+	for _, v := range query {
+		params += len(v)
+	}
+
+	if l.MaxQueryParams > 0 && params > l.MaxQueryParams {
+		return SkipTooManyParameters
+	}
+
+	pattern, path, variant := d.keys(u, segments, query)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if l.MaxURLsPerPattern > 0 && d.patterns[pattern] >= l.MaxURLsPerPattern {
+		return SkipPatternLimit
+	}
+
+	variants := d.variants[path]
+	if _, seen := variants[variant]; l.MaxQueryVariants > 0 && !seen && len(variants) >= l.MaxQueryVariants {
+		return SkipQueryVariants
+	}
+
+	d.patterns[pattern]++
+	if variants == nil {
+		variants = make(map[string]struct{})
+		d.variants[path] = variants
+	}
+	variants[variant] = struct{}{}
+
+	return ""
+}
+
+// Release stops an allowed url from counting towards the limits, used when
+// its enqueue is rolled back.
+func (d *TrapDetector) Release(u *url.URL) {
+	pattern, path, variant := d.keys(u, pathSegments(u), u.Query())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.patterns[pattern]--; d.patterns[pattern] <= 0 {
+		delete(d.patterns, pattern)
+	}
+
+	delete(d.variants[path], variant)
+}
+
+// keys builds the url's pattern, the path its query variants are counted
+// under and the normalised query variant.
+func (d *TrapDetector) keys(u *url.URL, segments []string, query url.Values) (string, string, string) {
+	names := make([]string, 0, len(query))
+	for k := range query {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	templated := make([]string, len(segments))
+	for i, s := range segments {
+		templated[i] = templateSegment(s)
+	}
+
+	path := u.Host + "/" + strings.Join(segments, "/")
+	pattern := u.Host + "/" + strings.Join(templated, "/") + "?" + strings.Join(names, "&")
+
+	return pattern, path, query.Encode()
+}
+
+func pathSegments(u *url.URL) []string {
+	segments := make([]string, 0)
+	for _, s := range strings.Split(u.Path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+
+	return segments
+}
+
+// templateSegment replaces segments which look like numbers, dates or ids
+// with placeholders.
+func templateSegment(s string) string {
+	digits, letters, hex := 0, 0, 0
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+			hex++
+		case r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F':
+			letters++
+			hex++
+		case r >= 'g' && r <= 'z' || r >= 'G' && r <= 'Z':
+			letters++
+		}
+	}
+
+	switch {
+	// Numbers, dates and versions such as 2018-01-31 or 1.2.3
+	case digits > 0 && letters == 0:
+		return "{n}"
+	// Hashes and uuids
+	case len(s) >= 8 && hex+strings.Count(s, "-") == len(s) && digits > 0:
+		return "{id}"
+	// Slugs ending with an id, e.g. article-12345
+	case digits >= 4:
+		return "{id}"
+	}
+
+	return s
+}
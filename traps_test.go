@@ -0,0 +1,109 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrapDetectorStaticLimits(t *testing.T) {
+	d := NewTrapDetector(DefaultTrapLimits())
+
+	cases := map[string]SkipReason{
+		"https://monzo.com/blog/2018/01/31/hello":                                "",
+		"https://monzo.com/" + strings.Repeat("a", 2048):                         SkipURLTooLong,
+		"https://monzo.com" + strings.Repeat("/a", 17):                           SkipPathTooDeep,
+		"https://monzo.com/a/b/a/b/a/b/a/b":                                      SkipRepeatedSegments,
+		"https://monzo.com/search?a=1&b=2&c=3&d=4&e=5&f=6&g=7&h=8&i=9&j=10&k=11": SkipTooManyParameters,
+	}
+
+	for raw, reason := range cases {
+		u, _ := url.Parse(raw)
+		assert.Equal(t, reason, d.Check(u), raw)
+	}
+}
+
+func TestTrapDetectorPatternLimit(t *testing.T) {
+	d := NewTrapDetector(TrapLimits{MaxURLsPerPattern: 3})
+
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse(fmt.Sprintf("https://monzo.com/calendar/2018-%02d/events", i+1))
+		assert.Equal(t, SkipReason(""), d.Check(u))
+	}
+
+	u, _ := url.Parse("https://monzo.com/calendar/2018-04/events")
+	assert.Equal(t, SkipPatternLimit, d.Check(u))
+
+	// Other patterns aren't affected
+	u, _ = url.Parse("https://monzo.com/calendar/today/events")
+	assert.Equal(t, SkipReason(""), d.Check(u))
+
+	// Releasing makes room for another url
+	released, _ := url.Parse("https://monzo.com/calendar/2018-01/events")
+	d.Release(released)
+	u, _ = url.Parse("https://monzo.com/calendar/2018-05/events")
+	assert.Equal(t, SkipReason(""), d.Check(u))
+}
+
+func TestTrapDetectorQueryVariants(t *testing.T) {
+	d := NewTrapDetector(TrapLimits{MaxQueryVariants: 2})
+
+	a, _ := url.Parse("https://monzo.com/search?colour=red&size=m")
+	b, _ := url.Parse("https://monzo.com/search?size=s")
+	c, _ := url.Parse("https://monzo.com/search?colour=blue")
+	// Same combination as a in a different order
+	reordered, _ := url.Parse("https://monzo.com/search?size=m&colour=red")
+
+	assert.Equal(t, SkipReason(""), d.Check(a))
+	assert.Equal(t, SkipReason(""), d.Check(b))
+	assert.Equal(t, SkipQueryVariants, d.Check(c))
+	assert.Equal(t, SkipReason(""), d.Check(reordered))
+}
+
+func TestTemplateSegment(t *testing.T) {
+	cases := map[string]string{
+		"123":                                  "{n}",
+		"2018-01-31":                           "{n}",
+		"1.2.3":                                "{n}",
+		"3f2504e0-4f89-11d3-9a0c-0305e82c3301": "{id}",
+		"article-12345":                        "{id}",
+		"about":                                "about",
+		"page2":                                "page2",
+	}
+
+	for segment, expected := range cases {
+		assert.Equal(t, expected, templateSegment(segment), segment)
+	}
+}
+
+func TestCrawlerReportsSkippedTraps(t *testing.T) {
+	s := setup(1, 100, 100)
+	c := NewCrawler(s.p, s.f, NewUniqueSet(), Concurrency(1), DetectTraps(NewTrapDetector(TrapLimits{MaxPathDepth: 2})))
+
+	root, _ := url.Parse("https://monzo.com")
+	shallow, _ := url.Parse("https://monzo.com/a/b")
+	deep, _ := url.Parse("https://monzo.com/a/b/c")
+
+	s.f.On("Fetch", root.String()).Return([]byte("body"), nil)
+	s.f.On("Fetch", shallow.String()).Return([]byte("body"), nil)
+	s.p.On("Parse", root, []byte("body")).Return([]*url.URL{shallow, deep}, []*url.URL{}, nil)
+	s.p.On("Parse", shallow, []byte("body")).Return([]*url.URL{deep}, []*url.URL{}, nil)
+
+	c.Enqueue(root)
+
+	p, e := run(c, root, context.Background())
+
+	assert.Len(t, p, 2)
+	// Reported once even though it's linked from both pages
+	require.Len(t, e, 1)
+	expected := &CrawlError{URL: deep, Referrer: root, Site: "monzo.com", Depth: 1, Phase: PhaseEnqueue, Attempt: 1,
+		Err: &SkippedError{URL: deep, Reason: SkipPathTooDeep}}
+	assert.Equal(t, expected, e[0])
+
+	s.AssertExpectations(t)
+}
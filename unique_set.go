@@ -2,42 +2,165 @@ package crawler
 
 import (
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/OneOfOne/xxhash"
 )
 
-// UniqueSet is a thread safe add-only hashSet which helps to make sure
-// we don't process the same url more than once. It assumes urls
-// with the same host, path & query, but different #fragment are identical.
+// UniqueSet is a thread safe hashSet which helps to make sure
+// we don't process the same url more than once. By default it assumes urls
+// with the same host, path & query, but different scheme or #fragment are identical.
 type UniqueSet interface {
 	// Returns false if the url already exists in the set
 	AddIfNotExists(*url.URL) bool
+	// Removes the url so it can be added again, used to roll back a reservation
+	Remove(*url.URL)
 }
 
-func NewUniqueSet() UniqueSet {
+type UniqueSetOption func(*urlKey)
+
+// DistinctSchemes treats urls which only differ by scheme as different urls.
+func DistinctSchemes() UniqueSetOption {
+	return func(k *urlKey) {
+		k.scheme = true
+	}
+}
+
+// DistinctFragments treats urls which only differ by #fragment as different urls.
+func DistinctFragments() UniqueSetOption {
+	return func(k *urlKey) {
+		k.fragment = true
+	}
+}
+
+// urlKey builds the canonical form urls are compared by. Every component is
+// length prefixed, so no two different sets of components can produce the
+// same key, no matter which characters they contain.
+type urlKey struct {
+	scheme   bool
+	fragment bool
+}
+
+func newURLKey(options []UniqueSetOption) urlKey {
+	k := urlKey{}
+	for _, f := range options {
+		f(&k)
+	}
+
+	return k
+}
+
+func (k urlKey) key(u *url.URL) string {
+	var b strings.Builder
+
+	if k.scheme {
+		writeComponent(&b, strings.ToLower(u.Scheme))
+	}
+
+	// Host names are case insensitive
+	writeComponent(&b, strings.ToLower(u.Host))
+	writeComponent(&b, u.EscapedPath())
+	writeComponent(&b, u.RawQuery)
+
+	if k.fragment {
+		writeComponent(&b, u.EscapedFragment())
+	}
+
+	return b.String()
+}
+
+func (k urlKey) checksum(u *url.URL) uint64 {
+	return xxhash.ChecksumString64(k.key(u))
+}
+
+func writeComponent(b *strings.Builder, s string) {
+	b.WriteString(strconv.Itoa(len(s)))
+	b.WriteByte(':')
+	b.WriteString(s)
+}
+
+func NewUniqueSet(options ...UniqueSetOption) UniqueSet {
 	return &syncUniqueSet{
-		log: make(map[uint64]struct{}, 0),
+		log: make(map[string]struct{}, 0),
 		mu:  sync.Mutex{},
+		key: newURLKey(options),
 	}
 }
 
 type syncUniqueSet struct {
-	log map[uint64]struct{}
+	log map[string]struct{}
 	mu  sync.Mutex
+	key urlKey
 }
 
 func (s *syncUniqueSet) AddIfNotExists(u *url.URL) bool {
+	return s.add(s.key.key(u))
+}
+
+func (s *syncUniqueSet) Remove(u *url.URL) {
+	s.remove(s.key.key(u))
+}
+
+func (s *syncUniqueSet) add(k string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	chsum := xxhash.ChecksumString64(u.Host + u.Path + u.RawQuery)
-
-	if _, exists := s.log[chsum]; exists {
+	if _, exists := s.log[k]; exists {
 		return false
 	}
 
-	s.log[chsum] = struct{}{}
+	s.log[k] = struct{}{}
 
 	return true
 }
+
+func (s *syncUniqueSet) remove(k string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.log, k)
+}
+
+// NewShardedUniqueSet creates a UniqueSet striped across shards, each with its
+// own lock, to reduce contention between workers. The number of shards is
+// rounded up to a power of two.
+func NewShardedUniqueSet(shards int, options ...UniqueSetOption) UniqueSet {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+
+	s := &shardedUniqueSet{
+		shards: make([]syncUniqueSet, n),
+		mask:   uint64(n - 1),
+		key:    newURLKey(options),
+	}
+
+	for i := range s.shards {
+		s.shards[i].log = make(map[string]struct{})
+	}
+
+	return s
+}
+
+type shardedUniqueSet struct {
+	shards []syncUniqueSet
+	mask   uint64
+	key    urlKey
+}
+
+func (s *shardedUniqueSet) AddIfNotExists(u *url.URL) bool {
+	k := s.key.key(u)
+	return s.shard(k).add(k)
+}
+
+func (s *shardedUniqueSet) Remove(u *url.URL) {
+	k := s.key.key(u)
+	s.shard(k).remove(k)
+}
+
+func (s *shardedUniqueSet) shard(k string) *syncUniqueSet {
+	return &s.shards[xxhash.ChecksumString64(k)&s.mask]
+}
@@ -2,7 +2,9 @@ package crawler
 
 import (
 	"net/url"
+	"sync/atomic"
 	"testing"
+	"testing/quick"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,3 +26,128 @@ func TestURLFragmentsAreIgnored(t *testing.T) {
 	anchored, _ := url.Parse("https://www.facebook.com/home#jump-to-headline")
 	assert.False(t, s.AddIfNotExists(anchored))
 }
+
+func TestRemove(t *testing.T) {
+	s := NewUniqueSet()
+
+	u, _ := url.Parse("https://www.facebook.com/home")
+	assert.True(t, s.AddIfNotExists(u))
+
+	s.Remove(u)
+	assert.True(t, s.AddIfNotExists(u))
+	assert.False(t, s.AddIfNotExists(u))
+}
+
+func TestShardedSet(t *testing.T) {
+	s := NewShardedUniqueSet(16)
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, s.AddIfNotExists(numberedURL(i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		assert.False(t, s.AddIfNotExists(numberedURL(i)))
+	}
+
+	s.Remove(numberedURL(1))
+	assert.True(t, s.AddIfNotExists(numberedURL(1)))
+}
+
+func BenchmarkUniqueSets(b *testing.B) {
+	sets := []struct {
+		name string
+		new  func() UniqueSet
+	}{
+		{"map", func() UniqueSet { return NewUniqueSet() }},
+		{"sharded", func() UniqueSet { return NewShardedUniqueSet(64) }},
+		{"cuckoo", func() UniqueSet { return NewCuckooUniqueSet(1000000, 0.001) }},
+	}
+
+	for _, set := range sets {
+		b.Run(set.name, func(b *testing.B) {
+			s := set.new()
+			var counter int64
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&counter, 1)
+					// Every other url is a duplicate, as is usual when crawling
+					s.AddIfNotExists(numberedURL(int(i / 2)))
+				}
+			})
+		})
+	}
+}
+
+func TestComponentBoundariesDontCollide(t *testing.T) {
+	s := NewUniqueSet()
+
+	// These used to hash identically as the components were concatenated without a separator
+	assert.True(t, s.AddIfNotExists(&url.URL{Host: "a.com", Path: "/bc"}))
+	assert.True(t, s.AddIfNotExists(&url.URL{Host: "a.com/b", Path: "c"}))
+	assert.True(t, s.AddIfNotExists(&url.URL{Host: "a.com", Path: "/b", RawQuery: "c"}))
+	assert.True(t, s.AddIfNotExists(&url.URL{Host: "a.com", Path: "/b?c"}))
+}
+
+// Shifting characters across component boundaries must always produce a
+// new url as far as the set is concerned.
+func TestAdversarialURLsHaveNoFalsePositives(t *testing.T) {
+	sets := map[string]UniqueSet{
+		"map":     NewUniqueSet(DistinctSchemes(), DistinctFragments()),
+		"sharded": NewShardedUniqueSet(8, DistinctSchemes(), DistinctFragments()),
+	}
+
+	for name, s := range sets {
+		property := func(scheme, host, path, query, fragment string, cut uint8) bool {
+			original := url.URL{Scheme: scheme, Host: host, Path: path, RawQuery: query, Fragment: fragment}
+			s.AddIfNotExists(&original)
+
+			parts := []*string{&scheme, &host, &path, &query, &fragment}
+			for i := 0; i < len(parts)-1; i++ {
+				left, right := parts[i], parts[i+1]
+				if len(*right) == 0 {
+					continue
+				}
+
+				// Moving a prefix of the right component to the end of the left one
+				k := 1 + int(cut)%len(*right)
+				l, r := *left, *right
+				*left, *right = l+r[:k], r[k:]
+
+				shifted := url.URL{Scheme: scheme, Host: host, Path: path, RawQuery: query, Fragment: fragment}
+				*left, *right = l, r
+
+				if !s.AddIfNotExists(&shifted) {
+					t.Logf("%s: %#v collides with %#v", name, shifted, original)
+					return false
+				}
+			}
+
+			return true
+		}
+
+		assert.NoError(t, quick.Check(property, &quick.Config{MaxCount: 2000}), name)
+	}
+}
+
+func TestDistinctSchemesAndFragments(t *testing.T) {
+	http, _ := url.Parse("http://google.com/home#top")
+	https, _ := url.Parse("https://google.com/home#top")
+	bottom, _ := url.Parse("https://google.com/home#bottom")
+
+	s := NewUniqueSet()
+	assert.True(t, s.AddIfNotExists(http))
+	assert.False(t, s.AddIfNotExists(https))
+	assert.False(t, s.AddIfNotExists(bottom))
+
+	s = NewUniqueSet(DistinctSchemes())
+	assert.True(t, s.AddIfNotExists(http))
+	assert.True(t, s.AddIfNotExists(https))
+	assert.False(t, s.AddIfNotExists(bottom))
+
+	s = NewUniqueSet(DistinctFragments())
+	assert.True(t, s.AddIfNotExists(http))
+	assert.False(t, s.AddIfNotExists(https))
+	assert.True(t, s.AddIfNotExists(bottom))
+}
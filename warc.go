@@ -0,0 +1,351 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const warcVersion = "WARC/1.1"
+
+// WARCWriter archives fetched urls as WARC 1.1 files. Every record is
+// compressed as its own gzip member, so the files can be read by standard
+// tools and records can be accessed by offset.
+//
+// Attach it to the fetcher with Archive to record the request and response of
+// every fetch, and add it as a pipeline Stage to record the links extracted
+// from every page as a metadata record. Registering it as Hooks as well lets
+// the metadata records refer to the response of their page, the stage goes
+// before any stage which drops pages so every response is looked up.
+type WARCWriter struct {
+	NoopHooks
+
+	dir     string
+	prefix  string
+	maxSize int64
+
+	mu    sync.Mutex
+	file  *os.File
+	size  int64
+	files int
+	// Response record ids of the pages being crawled by url, so metadata
+	// records can refer to them. Urls are added when the crawler starts
+	// fetching them and removed once they're done, whatever the outcome.
+	responses map[string]string
+}
+
+// NewWARCWriter writes files named <prefix>-<timestamp>-<serial>.warc.gz to
+// dir. A new file is started once a file grows beyond maxSize bytes, zero
+// means files are never rotated.
+func NewWARCWriter(dir, prefix string, maxSize int64) (*WARCWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &WARCWriter{dir: dir, prefix: prefix, maxSize: maxSize, responses: make(map[string]string)}, nil
+}
+
+// Archive records every request and response of the fetcher in the WARC writer,
+// including error responses and every redirect followed on the way to the
+// page. Fetches served from the Cache without revalidation make no request,
+// so they aren't archived.
+func Archive(w *WARCWriter) FetcherOption {
+	return func(f *fetcher) {
+		f.archive = w
+	}
+}
+
+// WriteExchange writes a request record and the response record it led to.
+// The body is the response's payload as read by the client.
+func (w *WARCWriter) WriteExchange(req *http.Request, rsp *http.Response, body []byte) error {
+	reqBlock, err := httputil.DumpRequestOut(req, false)
+	if err != nil {
+		return err
+	}
+
+	rspBlock := &bytes.Buffer{}
+	fmt.Fprintf(rspBlock, "%s %s\r\n", rsp.Proto, rsp.Status)
+	if err := rsp.Header.Write(rspBlock); err != nil {
+		return err
+	}
+	rspBlock.WriteString("\r\n")
+	rspBlock.Write(body)
+
+	target := req.URL.String()
+	page := originalURL(req)
+	now := time.Now()
+	reqID, rspID := newRecordID(), newRecordID()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err = w.write(warcHeader{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", rspID},
+		{"WARC-Date", warcDate(now)},
+		{"WARC-Target-URI", target},
+		{"Content-Type", "application/http;msgtype=response"},
+		{"WARC-Payload-Digest", digest(body)},
+	}, rspBlock.Bytes())
+	if err != nil {
+		return err
+	}
+
+	err = w.write(warcHeader{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", reqID},
+		{"WARC-Date", warcDate(now)},
+		{"WARC-Target-URI", target},
+		{"WARC-Concurrent-To", rspID},
+		{"Content-Type", "application/http;msgtype=request"},
+	}, reqBlock)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := w.responses[page]; ok {
+		w.responses[page] = rspID
+	}
+
+	return nil
+}
+
+// archivingTransport archives every exchange of an http.Client as it's made.
+type archivingTransport struct {
+	// http.DefaultTransport when nil, like http.Client's
+	next    http.RoundTripper
+	archive *WARCWriter
+}
+
+func (t *archivingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	rsp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading the body to archive it, the client gets a copy
+	b, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	if err := t.archive.WriteExchange(req, rsp, b); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+// originalURL returns the url a request was made for before it was redirected.
+func originalURL(req *http.Request) string {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+
+	return req.URL.String()
+}
+
+// OnFetchStart remembers the response of the page once it's archived.
+func (w *WARCWriter) OnFetchStart(r *Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.responses[r.URL.String()] = ""
+}
+
+// OnFetchDone forgets failed fetches as there won't be a page to process.
+func (w *WARCWriter) OnFetchDone(r *Request, _ time.Duration, err error) {
+	if err != nil {
+		w.forget(r.URL)
+	}
+}
+
+// OnError forgets pages which couldn't be parsed or failed an earlier stage.
+func (w *WARCWriter) OnError(err error) {
+	var crawlErr *CrawlError
+	if errors.As(err, &crawlErr) && crawlErr.URL != nil {
+		w.forget(crawlErr.URL)
+	}
+}
+
+func (w *WARCWriter) forget(u *url.URL) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.responses, u.String())
+}
+
+// Process writes a metadata record listing the page's links and assets.
+func (w *WARCWriter) Process(p *Page) (Action, error) {
+	block := &bytes.Buffer{}
+	for _, l := range p.Links {
+		fmt.Fprintf(block, "outlink: %s L a/@href\r\n", l)
+	}
+	for _, a := range p.Assets {
+		fmt.Fprintf(block, "outlink: %s E =EMBED_MISC\r\n", a)
+	}
+
+	target := p.String()
+	header := warcHeader{
+		{"WARC-Type", "metadata"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", warcDate(time.Now())},
+		{"WARC-Target-URI", target},
+		{"Content-Type", "application/warc-fields"},
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if id := w.responses[target]; id != "" {
+		header = append(header, warcField{"WARC-Concurrent-To", id})
+	}
+	delete(w.responses, target)
+
+	return Continue, w.write(header, block.Bytes())
+}
+
+func (w *WARCWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+type warcField struct {
+	name  string
+	value string
+}
+
+type warcHeader []warcField
+
+// write expects the lock to be held.
+func (w *WARCWriter) write(header warcHeader, block []byte) error {
+	if w.file == nil {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writeRecord(header, block); err != nil {
+		return err
+	}
+
+	if w.maxSize > 0 && w.size >= w.maxSize {
+		err := w.file.Close()
+		w.file = nil
+
+		return err
+	}
+
+	return nil
+}
+
+// rotate starts a new file with a warcinfo record describing it.
+func (w *WARCWriter) rotate() error {
+	w.files++
+	name := fmt.Sprintf("%s-%s-%05d.warc.gz", w.prefix, time.Now().UTC().Format("20060102150405"), w.files)
+
+	f, err := os.Create(filepath.Join(w.dir, name))
+	if err != nil {
+		return err
+	}
+	w.file, w.size = f, 0
+
+	info := "software: monzo-crawler\r\n" +
+		"format: WARC File Format 1.1\r\n" +
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n"
+
+	return w.writeRecord(warcHeader{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", warcDate(time.Now())},
+		{"WARC-Filename", name},
+		{"Content-Type", "application/warc-fields"},
+	}, []byte(info))
+}
+
+// writeRecord writes the record as a gzip member of its own.
+func (w *WARCWriter) writeRecord(header warcHeader, block []byte) error {
+	counter := &countingWriter{w: w.file}
+	buf := bufio.NewWriter(counter)
+	z := gzip.NewWriter(buf)
+
+	fmt.Fprintf(z, "%s\r\n", warcVersion)
+	for _, f := range header {
+		fmt.Fprintf(z, "%s: %s\r\n", f.name, f.value)
+	}
+	fmt.Fprintf(z, "WARC-Block-Digest: %s\r\n", digest(block))
+	fmt.Fprintf(z, "Content-Length: %d\r\n\r\n", len(block))
+	z.Write(block)
+	z.Write([]byte("\r\n\r\n"))
+
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	err := buf.Flush()
+	w.size += counter.n
+
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+
+	return n, err
+}
+
+func digest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func warcDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+func newRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	// Version 4, variant 1 uuid
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,255 @@
+package crawler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type warcRecord struct {
+	header map[string]string
+	block  []byte
+}
+
+func readWARC(t *testing.T, path string) []warcRecord {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	z, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	r := bufio.NewReader(z)
+
+	var records []warcRecord
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return records
+		}
+		require.NoError(t, err)
+		require.Equal(t, "WARC/1.1\r\n", line)
+
+		rec := warcRecord{header: make(map[string]string)}
+		for {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\r\n" {
+				break
+			}
+
+			parts := strings.SplitN(strings.TrimSuffix(line, "\r\n"), ": ", 2)
+			rec.header[parts[0]] = parts[1]
+		}
+
+		length, err := strconv.Atoi(rec.header["Content-Length"])
+		require.NoError(t, err)
+
+		rec.block = make([]byte, length+4)
+		_, err = io.ReadFull(r, rec.block)
+		require.NoError(t, err)
+		require.Equal(t, "\r\n\r\n", string(rec.block[length:]))
+		rec.block = rec.block[:length]
+
+		assert.Equal(t, digest(rec.block), rec.header["WARC-Block-Digest"])
+		records = append(records, rec)
+	}
+}
+
+func TestWARCWriterArchivesFetches(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<a href='/about'>About</a>"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "warc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWARCWriter(dir, "crawl", 0)
+	require.NoError(t, err)
+
+	root, _ := url.Parse(srv.URL + "/")
+	about, _ := url.Parse(srv.URL + "/about")
+
+	f := NewFetcher(srv.Client(), Archive(w))
+	w.OnFetchStart(&Request{URL: root})
+	body, err := f.Fetch(srv.URL + "/")
+	require.NoError(t, err)
+	w.OnFetchDone(&Request{URL: root}, 0, nil)
+
+	_, err = w.Process(&Page{URL: *root, Links: []*url.URL{about}})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "crawl-*-00001.warc.gz"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	records := readWARC(t, files[0])
+	require.Len(t, records, 4)
+
+	info, rsp, req, meta := records[0], records[1], records[2], records[3]
+	assert.Equal(t, "warcinfo", info.header["WARC-Type"])
+	assert.Equal(t, filepath.Base(files[0]), info.header["WARC-Filename"])
+
+	assert.Equal(t, "response", rsp.header["WARC-Type"])
+	assert.Equal(t, root.String(), rsp.header["WARC-Target-URI"])
+	assert.Equal(t, digest(body), rsp.header["WARC-Payload-Digest"])
+	assert.True(t, strings.HasPrefix(string(rsp.block), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, string(rsp.block), "Content-Type: text/html\r\n")
+	assert.True(t, strings.HasSuffix(string(rsp.block), "\r\n\r\n"+string(body)))
+
+	assert.Equal(t, "request", req.header["WARC-Type"])
+	assert.Equal(t, rsp.header["WARC-Record-ID"], req.header["WARC-Concurrent-To"])
+	assert.True(t, strings.HasPrefix(string(req.block), "GET / HTTP/1.1\r\n"))
+
+	assert.Equal(t, "metadata", meta.header["WARC-Type"])
+	assert.Equal(t, rsp.header["WARC-Record-ID"], meta.header["WARC-Concurrent-To"])
+	assert.Equal(t, "outlink: "+about.String()+" L a/@href\r\n", string(meta.block))
+}
+
+func TestWARCWriterRotatesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWARCWriter(dir, "crawl", 1)
+	require.NoError(t, err)
+
+	for _, p := range []string{"a", "b", "c"} {
+		u, _ := url.Parse("https://monzo.com/" + p)
+		_, err := w.Process(&Page{URL: *u})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "crawl-*.warc.gz"))
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	for _, f := range files {
+		records := readWARC(t, f)
+		require.Len(t, records, 2)
+		assert.Equal(t, "warcinfo", records[0].header["WARC-Type"])
+		assert.Equal(t, "metadata", records[1].header["WARC-Type"])
+	}
+}
+
+func TestWARCWriterForgetsResponsesOfFinishedFetches(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/", http.StatusMovedPermanently)
+		case "/gone":
+			http.NotFound(w, r)
+		default:
+			w.Write([]byte("<a href='/about'>About</a>"))
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "warc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWARCWriter(dir, "crawl", 0)
+	require.NoError(t, err)
+	defer w.Close()
+
+	f := NewFetcher(srv.Client(), Archive(w))
+	fetch := func(path string) error {
+		u, _ := url.Parse(srv.URL + path)
+		r := &Request{URL: u}
+
+		w.OnFetchStart(r)
+		_, err := f.Fetch(u.String())
+		w.OnFetchDone(r, 0, err)
+
+		return err
+	}
+
+	// Failed fetches are forgotten as soon as they're done
+	require.Error(t, fetch("/gone"))
+	assert.Empty(t, w.responses)
+
+	// Redirected pages are looked up by the url they were fetched for
+	require.NoError(t, fetch("/old"))
+	old, _ := url.Parse(srv.URL + "/old")
+	assert.NotEmpty(t, w.responses[old.String()])
+
+	// Pages which fail to parse are forgotten when the error is reported
+	w.OnError(newCrawlError(&Request{URL: old}, PhaseParse, errors.New("unparseable")))
+	assert.Empty(t, w.responses)
+
+	// Fetches the crawler didn't start, e.g. assets, aren't remembered
+	_, err = f.Fetch(srv.URL + "/logo.png")
+	require.NoError(t, err)
+	assert.Empty(t, w.responses)
+}
+
+func TestWARCWriterArchivesRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/moved", http.StatusMovedPermanently)
+		case "/moved":
+			http.Redirect(w, r, "/", http.StatusFound)
+		default:
+			w.Write([]byte("<a href='/about'>About</a>"))
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "warc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWARCWriter(dir, "crawl", 0)
+	require.NoError(t, err)
+
+	old, _ := url.Parse(srv.URL + "/old")
+	f := NewFetcher(srv.Client(), Archive(w))
+	w.OnFetchStart(&Request{URL: old})
+	body, err := f.Fetch(old.String())
+	require.NoError(t, err)
+	assert.Equal(t, "<a href='/about'>About</a>", string(body))
+
+	id := w.responses[old.String()]
+	require.NoError(t, w.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "crawl-*.warc.gz"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	var responses []warcRecord
+	for _, r := range readWARC(t, files[0]) {
+		if r.header["WARC-Type"] == "response" {
+			responses = append(responses, r)
+		}
+	}
+	require.Len(t, responses, 3)
+
+	assert.Equal(t, srv.URL+"/old", responses[0].header["WARC-Target-URI"])
+	assert.True(t, strings.HasPrefix(string(responses[0].block), "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, string(responses[0].block), "Location: /moved\r\n")
+	assert.Equal(t, srv.URL+"/moved", responses[1].header["WARC-Target-URI"])
+	assert.True(t, strings.HasPrefix(string(responses[1].block), "HTTP/1.1 302 Found\r\n"))
+	assert.Equal(t, srv.URL+"/", responses[2].header["WARC-Target-URI"])
+
+	// The page refers to the response it was parsed from
+	assert.Equal(t, responses[2].header["WARC-Record-ID"], id)
+}